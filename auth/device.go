@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+const deviceSecretPrefix = "dk_"
+
+// NewDeviceSecret returns a random device secret and the hash to store for it.
+// Secrets are high entropy, so a plain SHA-256 is enough for storage.
+func NewDeviceSecret() (secret string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = deviceSecretPrefix + hex.EncodeToString(b)
+	return secret, HashDeviceSecret(secret), nil
+}
+
+func HashDeviceSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyDeviceSecret compares a presented secret with the stored hash in constant time.
+func VerifyDeviceSecret(storedHash, secret string) bool {
+	if storedHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(HashDeviceSecret(secret))) == 1
+}
+
+// APIKeyPrefix starts every API key, so keys are easy to tell apart from
+// session tokens and to spot in leaked text.
+const APIKeyPrefix = "hk_"
+
+// NewAPIKey returns a key of the form hk_<prefix>_<secret>, its lookup prefix
+// and the hash to store for it. Like device secrets, keys are high entropy,
+// so they are stored as a plain SHA-256.
+func NewAPIKey() (key string, prefix string, hash string, err error) {
+	p := make([]byte, 6)
+	s := make([]byte, 32)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(s); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(p)
+	key = APIKeyPrefix + prefix + "_" + hex.EncodeToString(s)
+	return key, prefix, hashAPIKey(key), nil
+}
+
+// VerifyAPIKey compares a presented API key with the stored hash in constant time.
+func VerifyAPIKey(storedHash, key string) bool {
+	if storedHash == "" || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(hashAPIKey(key))) == 1
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
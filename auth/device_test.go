@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeviceSecret(t *testing.T) {
+	secret, hash, err := NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, deviceSecretPrefix) || len(secret) != len(deviceSecretPrefix)+64 {
+		t.Errorf("secret %q has the wrong shape", secret)
+	}
+	if hash != HashDeviceSecret(secret) || strings.Contains(hash, secret) {
+		t.Errorf("hash %q does not match the secret", hash)
+	}
+	if !VerifyDeviceSecret(hash, secret) {
+		t.Error("own secret rejected")
+	}
+
+	other, _, _ := NewDeviceSecret()
+	if other == secret {
+		t.Error("two secrets are equal")
+	}
+	for name, tc := range map[string][2]string{
+		"other secret": {hash, other},
+		"empty secret": {hash, ""},
+		"no hash":      {"", secret},
+		"hash as key":  {hash, hash},
+	} {
+		if VerifyDeviceSecret(tc[0], tc[1]) {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	key, prefix, hash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefix) != 12 || !strings.HasPrefix(key, APIKeyPrefix+prefix+"_") {
+		t.Errorf("key %q does not start with %s%s_", key, APIKeyPrefix, prefix)
+	}
+	if !VerifyAPIKey(hash, key) {
+		t.Error("own key rejected")
+	}
+	if VerifyAPIKey(hash, key+"x") || VerifyAPIKey(hash, "") || VerifyAPIKey("", key) {
+		t.Error("wrong key accepted")
+	}
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new hashes. They are encoded into every hash, so
+// raising them later only affects newly written hashes (older ones get
+// upgraded on the next successful login).
+const (
+	argonMemory  uint32 = 64 * 1024 // KiB
+	argonTime    uint32 = 3
+	argonThreads uint8  = 2
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+// Bounds accepted when reading a stored hash. argon2.IDKey panics on zero
+// iterations or threads, and huge values would let one row pin the CPU or
+// exhaust memory on every login attempt.
+const (
+	maxArgonMemory  uint32 = 1024 * 1024 // KiB, 1 GiB
+	maxArgonTime    uint32 = 64
+	maxArgonThreads uint8  = 64
+	minArgonKeyLen         = 16
+	maxArgonKeyLen         = 128
+	minArgonSaltLen        = 8
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// HashPassword returns an argon2id hash in the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash), which the Python backend
+// can verify with argon2-cffi / passlib.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against a stored hash. It accepts both
+// argon2id hashes and legacy unsalted SHA-256 hex digests. needsRehash is
+// true when the password matched but the stored hash should be replaced.
+func VerifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	if strings.HasPrefix(stored, "$argon2id$") {
+		ok, outdated, err := verifyArgon2id(stored, password)
+		if err != nil {
+			return false, false
+		}
+		return ok, ok && outdated
+	}
+
+	// Legacy format: hex(sha256(password))
+	sum := sha256.Sum256([]byte(password))
+	legacy := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(stored)), []byte(legacy)) == 1 {
+		return true, true
+	}
+	return false, false
+}
+
+func verifyArgon2id(encoded, password string) (ok bool, outdated bool, err error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, errMalformedHash
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, false, errMalformedHash
+	}
+	if iterations == 0 || iterations > maxArgonTime ||
+		threads == 0 || threads > maxArgonThreads ||
+		memory < 8*uint32(threads) || memory > maxArgonMemory {
+		return false, false, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < minArgonSaltLen {
+		return false, false, errMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < minArgonKeyLen || len(key) > maxArgonKeyLen {
+		return false, false, errMalformedHash
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return false, false, nil
+	}
+
+	outdated = memory < argonMemory || iterations < argonTime || threads < argonThreads || uint32(len(key)) < argonKeyLen
+	return true, outdated, nil
+}
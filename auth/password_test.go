@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Fatalf("unexpected hash format %q", hash)
+	}
+	if ok, rehash := VerifyPassword(hash, "correct horse"); !ok || rehash {
+		t.Errorf("VerifyPassword(own hash) = %v, %v; want true, false", ok, rehash)
+	}
+	if ok, _ := VerifyPassword(hash, "wrong"); ok {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestVerifyLegacyPassword(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	legacy := hex.EncodeToString(sum[:])
+	if ok, rehash := VerifyPassword(strings.ToUpper(legacy), "secret"); !ok || !rehash {
+		t.Errorf("VerifyPassword(legacy) = %v, %v; want true, true", ok, rehash)
+	}
+	if ok, _ := VerifyPassword(legacy, "other"); ok {
+		t.Error("wrong password accepted for legacy hash")
+	}
+}
+
+func TestVerifyOutdatedArgon2(t *testing.T) {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("pw"), salt, 1, 8192, 1, argonKeyLen)
+	weak := fmt.Sprintf("$argon2id$v=19$m=8192,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	if ok, rehash := VerifyPassword(weak, "pw"); !ok || !rehash {
+		t.Errorf("VerifyPassword(weak params) = %v, %v; want true, true", ok, rehash)
+	}
+}
+
+func TestVerifyRejectsBadArgon2Params(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	cases := map[string]string{
+		"zero iterations": "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key,
+		"zero threads":    "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key,
+		"zero memory":     "$argon2id$v=19$m=0,t=3,p=2$" + salt + "$" + key,
+		"huge memory":     "$argon2id$v=19$m=4294967295,t=3,p=2$" + salt + "$" + key,
+		"huge iterations": "$argon2id$v=19$m=65536,t=100000,p=2$" + salt + "$" + key,
+		"threads > uint8": "$argon2id$v=19$m=65536,t=3,p=300$" + salt + "$" + key,
+		"short salt":      "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$" + key,
+		"empty key":       "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$",
+		"wrong version":   "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key,
+		"missing part":    "$argon2id$v=19$m=65536,t=3,p=2$" + salt,
+		"bad base64 salt": "$argon2id$v=19$m=65536,t=3,p=2$!!!$" + key,
+	}
+	for name, hash := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panicked: %v", r)
+				}
+			}()
+			if ok, _, err := verifyArgon2id(hash, "pw"); ok || err == nil {
+				t.Errorf("verifyArgon2id = %v, %v; want malformed", ok, err)
+			}
+			if ok, _ := VerifyPassword(hash, "pw"); ok {
+				t.Error("VerifyPassword accepted a malformed hash")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package auth
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// API key scopes
+const (
+	ScopeDevicesRead   = "devices:read"
+	ScopeDevicesAdmin  = "devices:admin"
+	ScopeTelemetryRead = "telemetry:read"
+	ScopeCommandsRead  = "commands:read"
+	ScopeCommandsWrite = "commands:write"
+)
+
+// AllScopes lists every scope an API key may be granted.
+var AllScopes = []string{ScopeDevicesRead, ScopeDevicesAdmin, ScopeTelemetryRead, ScopeCommandsRead, ScopeCommandsWrite}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID string
+	Role   string
+
+	// Set when the caller authenticated with an API key instead of a session.
+	APIKeyID  string
+	Scopes    []string
+	DeviceIDs []string // optional allow-list; empty means every device the user can access
+}
+
+func (p Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+// IsAPIKey reports whether the caller authenticated with an API key.
+func (p Principal) IsAPIKey() bool {
+	return p.APIKeyID != ""
+}
+
+// HasScope reports whether the caller may use a scope. User sessions have every scope.
+func (p Principal) HasScope(scope string) bool {
+	if !p.IsAPIKey() {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDevice reports whether the API key allow-list (if any) includes the device.
+func (p Principal) AllowsDevice(deviceID string) bool {
+	if len(p.DeviceIDs) == 0 {
+		return true
+	}
+	for _, id := range p.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+	ErrRevokedToken = errors.New("token revoked")
+)
+
+// Claims is the payload carried by a session token.
+type Claims struct {
+	Subject   string `json:"sub"` // user id
+	Username  string `json:"username,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Type      string `json:"typ"` // access | refresh
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Version   int    `json:"ver"` // the user's token version when issued
+}
+
+// TokenVersionFunc returns a user's current token version. Tokens carrying an
+// older version were issued before a password change and are rejected.
+type TokenVersionFunc func(userID string) (int, error)
+
+// TokenPair is what login and refresh hand back to the client.
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// TokenManager issues and verifies HS256 signed tokens (JWT compatible).
+type TokenManager struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+	versions   TokenVersionFunc // nil skips the revocation check
+}
+
+func NewTokenManager(secret string, accessTTL, refreshTTL time.Duration) *TokenManager {
+	if accessTTL <= 0 {
+		accessTTL = 15 * time.Minute
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+	return &TokenManager{
+		secret:     []byte(secret),
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		now:        time.Now,
+	}
+}
+
+// SetTokenVersions makes Parse reject tokens whose version is not the user's
+// current one.
+func (m *TokenManager) SetTokenVersions(fn TokenVersionFunc) {
+	m.versions = fn
+}
+
+// RandomSecret returns a hex encoded random secret, used when AUTH_SECRET is not configured.
+func RandomSecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IssuePair creates a new access/refresh token pair for the user, bound to
+// the user's current token version.
+func (m *TokenManager) IssuePair(userID, username, role string, version int) (*TokenPair, error) {
+	access, accessExp, err := m.issue(userID, username, role, version, TokenTypeAccess, m.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, refreshExp, err := m.issue(userID, username, role, version, TokenTypeRefresh, m.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:      access,
+		AccessExpiresAt:  accessExp,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: refreshExp,
+	}, nil
+}
+
+func (m *TokenManager) issue(userID, username, role string, version int, typ string, ttl time.Duration) (string, time.Time, error) {
+	now := m.now().UTC()
+	exp := now.Add(ttl)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+	claims := Claims{
+		Subject:   userID,
+		Username:  username,
+		Role:      role,
+		Type:      typ,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: exp.Unix(),
+		ID:        hex.EncodeToString(jti),
+		Version:   version,
+	}
+	token, err := m.sign(claims)
+	return token, exp, err
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (m *TokenManager) sign(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + m.signature(unsigned), nil
+}
+
+func (m *TokenManager) signature(unsigned string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Parse verifies the signature and expiry of a token and checks its type and,
+// when token versions are configured, that it has not been revoked.
+func (m *TokenManager) Parse(token, expectedType string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrInvalidToken
+	}
+	expected := m.signature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.Type != expectedType {
+		return nil, ErrInvalidToken
+	}
+	if m.now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	if m.versions != nil {
+		current, err := m.versions(claims.Subject)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		if claims.Version != current {
+			return nil, ErrRevokedToken
+		}
+	}
+	return &claims, nil
+}
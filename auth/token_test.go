@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestManager(now time.Time) *TokenManager {
+	m := NewTokenManager("test-secret", time.Minute, time.Hour)
+	m.now = func() time.Time { return now }
+	return m
+}
+
+func TestIssueAndParse(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := newTestManager(now)
+	pair, err := m.IssuePair("u1", "alice", "admin", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pair.AccessExpiresAt.Equal(now.Add(time.Minute)) || !pair.RefreshExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expiries = %v, %v", pair.AccessExpiresAt, pair.RefreshExpiresAt)
+	}
+
+	claims, err := m.Parse(pair.AccessToken, TokenTypeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "u1" || claims.Username != "alice" || claims.Role != "admin" || claims.Version != 3 {
+		t.Errorf("claims = %+v", claims)
+	}
+	if claims.IssuedAt != now.Unix() || claims.ID == "" {
+		t.Errorf("iat = %d, jti = %q", claims.IssuedAt, claims.ID)
+	}
+	if _, err := m.Parse(pair.RefreshToken, TokenTypeRefresh); err != nil {
+		t.Errorf("refresh token: %v", err)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := newTestManager(now)
+	pair, err := m.IssuePair("u1", "alice", "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(pair.AccessToken, ".")
+
+	// Same payload with an elevated role, keeping the original signature
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(payload, &claims)
+	claims["role"] = "admin"
+	forged, _ := json.Marshal(claims)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	other := NewTokenManager("other-secret", time.Minute, time.Hour)
+	other.now = m.now
+	foreign, _ := other.IssuePair("u1", "alice", "user", 0)
+
+	cases := map[string]struct {
+		token, typ string
+	}{
+		"wrong type":      {pair.AccessToken, TokenTypeRefresh},
+		"refresh as auth": {pair.RefreshToken, TokenTypeAccess},
+		"tampered claims": {tampered, TokenTypeAccess},
+		"other secret":    {foreign.AccessToken, TokenTypeAccess},
+		"alg none header": {base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", TokenTypeAccess},
+		"two segments":    {parts[0] + "." + parts[1], TokenTypeAccess},
+		"empty":           {"", TokenTypeAccess},
+	}
+	for name, tc := range cases {
+		if _, err := m.Parse(tc.token, tc.typ); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	later := newTestManager(now.Add(time.Minute))
+	if _, err := later.Parse(pair.AccessToken, TokenTypeAccess); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expired access token: err = %v, want ErrExpiredToken", err)
+	}
+	if _, err := later.Parse(pair.RefreshToken, TokenTypeRefresh); err != nil {
+		t.Errorf("refresh token expired early: %v", err)
+	}
+}
+
+func TestParseRevokedVersion(t *testing.T) {
+	m := newTestManager(time.Now())
+	current := map[string]int{"u1": 1}
+	m.SetTokenVersions(func(userID string) (int, error) {
+		v, ok := current[userID]
+		if !ok {
+			return 0, errors.New("user not found")
+		}
+		return v, nil
+	})
+
+	pair, err := m.IssuePair("u1", "alice", "user", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Parse(pair.AccessToken, TokenTypeAccess); err != nil {
+		t.Fatalf("current version rejected: %v", err)
+	}
+
+	current["u1"] = 2 // password changed
+	for _, tc := range []struct{ token, typ string }{
+		{pair.AccessToken, TokenTypeAccess},
+		{pair.RefreshToken, TokenTypeRefresh},
+	} {
+		if _, err := m.Parse(tc.token, tc.typ); !errors.Is(err, ErrRevokedToken) {
+			t.Errorf("%s token after password change: err = %v, want ErrRevokedToken", tc.typ, err)
+		}
+	}
+
+	delete(current, "u1") // account removed
+	if _, err := m.Parse(pair.AccessToken, TokenTypeAccess); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of deleted user: err = %v, want ErrInvalidToken", err)
+	}
+}
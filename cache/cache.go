@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
 	"iot-server/entities"
 	"sync"
 	"time"
@@ -11,25 +13,115 @@ type DeviceDataPoint struct {
 	Timestamp time.Time
 }
 
+// OverflowPolicy decides what happens to a point that would exceed the cache limits.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest evicts the device's oldest point. The evicted point was
+	// already acknowledged to the device, so this policy trades the durability
+	// of the ack for never refusing new readings.
+	OverflowDropOldest   OverflowPolicy = "drop_oldest"
+	OverflowDropNewest   OverflowPolicy = "drop_newest"  // reject the incoming point
+	OverflowBackpressure OverflowPolicy = "backpressure" // reject it and ask the device to slow down
+)
+
+// ParseOverflowPolicy validates a policy name.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case OverflowDropOldest, OverflowDropNewest, OverflowBackpressure:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown cache overflow policy %q", s)
+}
+
+// Limits bounds the cache. A zero limit is unbounded.
+type Limits struct {
+	MaxPoints          int
+	MaxPointsPerDevice int
+	Policy             OverflowPolicy
+	RetryAfter         time.Duration // suggested to throttled devices
+}
+
+// ErrCacheFull is returned for a point rejected under OverflowDropNewest.
+var ErrCacheFull = errors.New("telemetry cache is full, point dropped")
+
+// SlowDownError is returned for a point rejected under OverflowBackpressure.
+// The device should resend it after RetryAfter.
+type SlowDownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *SlowDownError) Error() string {
+	return fmt.Sprintf("telemetry cache is full, retry after %s", e.RetryAfter)
+}
+
+// dropCounters counts points lost or refused because of the limits.
+type dropCounters struct {
+	Oldest    int64 `json:"dropped_oldest"`
+	Newest    int64 `json:"dropped_newest"`
+	Throttled int64 `json:"throttled"`
+}
+
 type DeviceCache struct {
 	mu           sync.RWMutex
 	deviceData   map[string][]DeviceDataPoint // map[deviceID][]dataPoints
 	lastInserted map[string]entities.DeviceData
+	size         int // total points across devices
+
+	limits      Limits
+	drops       dropCounters
+	deviceDrops map[string]*dropCounters
 }
 
-func NewDeviceCache() *DeviceCache {
+func NewDeviceCache(limits Limits) *DeviceCache {
+	if limits.Policy == "" {
+		limits.Policy = OverflowBackpressure
+	}
 	return &DeviceCache{
 		deviceData:   make(map[string][]DeviceDataPoint),
 		lastInserted: make(map[string]entities.DeviceData),
+		limits:       limits,
+		deviceDrops:  make(map[string]*dropCounters),
 	}
 }
 
-// AddDataPoint adds a new data point to the cache
-func (dc *DeviceCache) AddDataPoint(data entities.DeviceData) {
+// Admit reports whether a point from deviceID may be added. Under the
+// drop_newest and backpressure policies a full cache refuses it, and the
+// refusal is counted; drop_oldest always admits and evicts in AddDataPoint.
+func (dc *DeviceCache) Admit(deviceID string) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.limits.Policy == OverflowDropOldest || !dc.fullFor(deviceID) {
+		return nil
+	}
+	dev := dc.deviceCounters(deviceID)
+	if dc.limits.Policy == OverflowDropNewest {
+		dc.drops.Newest++
+		dev.Newest++
+		return ErrCacheFull
+	}
+	dc.drops.Throttled++
+	dev.Throttled++
+	return &SlowDownError{RetryAfter: dc.limits.RetryAfter}
+}
+
+// AddDataPoint adds a new data point to the cache and returns how many points
+// it now holds, along with the ids of any points evicted to make room. When a
+// limit is exceeded the oldest points are evicted, from the same device or,
+// for the global limit, from the device holding the most.
+func (dc *DeviceCache) AddDataPoint(data entities.DeviceData) (size int, evicted []string) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
 
 	deviceID := data.DeviceID
+	for dc.fullFor(deviceID) {
+		id, ok := dc.evictOldest(deviceID)
+		if !ok {
+			break
+		}
+		evicted = append(evicted, id)
+	}
 	point := DeviceDataPoint{
 		Data:      data,
 		Timestamp: time.Now(),
@@ -41,6 +133,48 @@ func (dc *DeviceCache) AddDataPoint(data entities.DeviceData) {
 	}
 
 	dc.deviceData[deviceID] = append(dc.deviceData[deviceID], point)
+	dc.size++
+	return dc.size, evicted
+}
+
+// fullFor reports whether one more point from deviceID would exceed a limit.
+func (dc *DeviceCache) fullFor(deviceID string) bool {
+	if dc.limits.MaxPointsPerDevice > 0 && len(dc.deviceData[deviceID]) >= dc.limits.MaxPointsPerDevice {
+		return true
+	}
+	return dc.limits.MaxPoints > 0 && dc.size >= dc.limits.MaxPoints
+}
+
+// evictOldest drops the oldest point of deviceID if it is at its own limit,
+// otherwise of the device holding the most points, and returns its id. It
+// returns false when there is nothing to evict.
+func (dc *DeviceCache) evictOldest(deviceID string) (string, bool) {
+	victim := deviceID
+	if dc.limits.MaxPointsPerDevice <= 0 || len(dc.deviceData[deviceID]) < dc.limits.MaxPointsPerDevice {
+		for id, points := range dc.deviceData {
+			if len(points) > len(dc.deviceData[victim]) {
+				victim = id
+			}
+		}
+	}
+	points := dc.deviceData[victim]
+	if len(points) == 0 {
+		return "", false
+	}
+	dc.deviceData[victim] = points[1:]
+	dc.size--
+	dc.drops.Oldest++
+	dc.deviceCounters(victim).Oldest++
+	return points[0].Data.ID, true
+}
+
+func (dc *DeviceCache) deviceCounters(deviceID string) *dropCounters {
+	c, ok := dc.deviceDrops[deviceID]
+	if !ok {
+		c = &dropCounters{}
+		dc.deviceDrops[deviceID] = c
+	}
+	return c
 }
 
 // Removed threshold-based filtering; all cached points are considered
@@ -72,15 +206,28 @@ func (dc *DeviceCache) GetCacheStats() map[string]interface{} {
 		totalPoints += len(dataPoints)
 	}
 
+	dropsByDevice := make(map[string]dropCounters, len(dc.deviceDrops))
+	for deviceID, c := range dc.deviceDrops {
+		dropsByDevice[deviceID] = *c
+	}
+
 	return map[string]interface{}{
 		"total_devices":     deviceCount,
 		"total_data_points": totalPoints,
 		"filtering":         "none",
+		"limits": map[string]interface{}{
+			"max_points":            dc.limits.MaxPoints,
+			"max_points_per_device": dc.limits.MaxPointsPerDevice,
+			"policy":                dc.limits.Policy,
+		},
+		"drops":           dc.drops,
+		"drops_by_device": dropsByDevice,
 	}
 }
 
-// ClearCache clears the cached data after it's been processed
-func (dc *DeviceCache) ClearCache() {
+// Drain removes and returns everything cached, in one step, so points added
+// while the caller processes them are kept for the next round
+func (dc *DeviceCache) Drain() map[string][]DeviceDataPoint {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
 
@@ -91,8 +238,10 @@ func (dc *DeviceCache) ClearCache() {
 		}
 	}
 
-	// Clear the cache
+	drained := dc.deviceData
 	dc.deviceData = make(map[string][]DeviceDataPoint)
+	dc.size = 0
+	return drained
 }
 
 // Threshold utility removed as no longer used
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"iot-server/entities"
+)
+
+func point(deviceID string, n int) entities.DeviceData {
+	return entities.DeviceData{ID: fmt.Sprintf("%s-%d", deviceID, n), DeviceID: deviceID}
+}
+
+func ids(points []DeviceDataPoint) []string {
+	out := make([]string, 0, len(points))
+	for _, p := range points {
+		out = append(out, p.Data.ID)
+	}
+	return out
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, name := range []string{"drop_oldest", "drop_newest", "backpressure"} {
+		if p, err := ParseOverflowPolicy(name); err != nil || string(p) != name {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v", name, p, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop_all"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestDropOldestPerDevice(t *testing.T) {
+	dc := NewDeviceCache(Limits{MaxPointsPerDevice: 2, Policy: OverflowDropOldest})
+	for i := 0; i < 4; i++ {
+		if err := dc.Admit("a"); err != nil {
+			t.Fatalf("Admit under drop_oldest: %v", err)
+		}
+		dc.AddDataPoint(point("a", i))
+	}
+	if _, evicted := dc.AddDataPoint(point("b", 0)); len(evicted) != 0 {
+		t.Errorf("evicted %v for a device under its limit", evicted)
+	}
+	if _, evicted := dc.AddDataPoint(point("a", 4)); fmt.Sprint(evicted) != "[a-2]" {
+		t.Errorf("evicted = %v, want [a-2]", evicted)
+	}
+
+	got := dc.GetAllCachedData()
+	if fmt.Sprint(ids(got["a"])) != "[a-3 a-4]" || len(got["b"]) != 1 {
+		t.Errorf("cached = %v / %v, want the two newest of a and b's point", ids(got["a"]), ids(got["b"]))
+	}
+	drops := dc.GetCacheStats()["drops_by_device"].(map[string]dropCounters)
+	if drops["a"].Oldest != 3 || drops["b"].Oldest != 0 {
+		t.Errorf("drops = %+v", drops)
+	}
+}
+
+func TestDropOldestGlobalEvictsLargestDevice(t *testing.T) {
+	dc := NewDeviceCache(Limits{MaxPoints: 4, Policy: OverflowDropOldest})
+	for i := 0; i < 3; i++ {
+		dc.AddDataPoint(point("big", i))
+	}
+	dc.AddDataPoint(point("small", 0))
+	// Full: the next point, from the small device, evicts from the big one
+	if n, _ := dc.AddDataPoint(point("small", 1)); n != 4 {
+		t.Fatalf("size = %d, want 4", n)
+	}
+	got := dc.GetAllCachedData()
+	if fmt.Sprint(ids(got["big"])) != "[big-1 big-2]" || len(got["small"]) != 2 {
+		t.Errorf("cached = %v / %v", ids(got["big"]), ids(got["small"]))
+	}
+}
+
+func TestDropNewestAndBackpressure(t *testing.T) {
+	dc := NewDeviceCache(Limits{MaxPointsPerDevice: 1, Policy: OverflowDropNewest})
+	dc.AddDataPoint(point("a", 0))
+	if err := dc.Admit("a"); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("drop_newest Admit = %v, want ErrCacheFull", err)
+	}
+	if err := dc.Admit("b"); err != nil {
+		t.Errorf("other device refused: %v", err)
+	}
+
+	dc = NewDeviceCache(Limits{MaxPoints: 1, Policy: OverflowBackpressure, RetryAfter: 3 * time.Second})
+	dc.AddDataPoint(point("a", 0))
+	var slow *SlowDownError
+	if err := dc.Admit("b"); !errors.As(err, &slow) || slow.RetryAfter != 3*time.Second {
+		t.Errorf("backpressure Admit = %v, want a SlowDownError with the configured delay", err)
+	}
+	if drops := dc.GetCacheStats()["drops"].(dropCounters); drops.Throttled != 1 {
+		t.Errorf("drops = %+v, want one throttled", drops)
+	}
+
+	// Draining frees room again
+	dc.Drain()
+	if err := dc.Admit("b"); err != nil {
+		t.Errorf("Admit after Drain = %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	dc := NewDeviceCache(Limits{})
+	dc.AddDataPoint(point("a", 0))
+	dc.AddDataPoint(point("a", 1))
+	drained := dc.Drain()
+	if len(drained["a"]) != 2 {
+		t.Errorf("drained %v", drained)
+	}
+	if n, _ := dc.AddDataPoint(point("a", 2)); n != 1 {
+		t.Errorf("size after drain = %d, want 1", n)
+	}
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"iot-server/entities"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const walSegmentExt = ".wal"
+
+// WAL is an append-only segment log that keeps cached telemetry on disk until
+// it has been written to the database. Each segment holds one JSON-encoded
+// data point per line, or an eviction record for a point the cache dropped.
+// Callers serialize access; WAL does no locking itself.
+type WAL struct {
+	dir  string
+	sync bool // fsync after every append
+
+	cur     *os.File
+	curID   uint64
+	curSize int64
+	open    []uint64 // segments whose points have not been handed out by Seal yet
+}
+
+// walEviction marks a logged point as evicted from the cache, so replay does
+// not bring it back.
+type walEviction struct {
+	EvictedID string `json:"evicted_id"`
+}
+
+// OpenWAL opens (creating if needed) the segment log in dir and returns the
+// points found in existing segments so they can be cached again. Points with
+// an eviction record are left out.
+func OpenWAL(dir string, sync bool) (*WAL, []entities.DeviceData, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("create wal dir: %w", err)
+	}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &WAL{dir: dir, sync: sync}
+	var logged []entities.DeviceData
+	evicted := map[string]bool{}
+	for _, id := range ids {
+		points, err := w.readSegment(id, evicted)
+		if err != nil {
+			return nil, nil, err
+		}
+		logged = append(logged, points...)
+		w.open = append(w.open, id)
+		w.curID = id
+	}
+	if err := w.next(); err != nil {
+		return nil, nil, err
+	}
+	replayed := logged[:0]
+	for _, data := range logged {
+		if !evicted[data.ID] {
+			replayed = append(replayed, data)
+		}
+	}
+	return w, replayed, nil
+}
+
+// Append writes one point to the current segment.
+func (w *WAL) Append(data entities.DeviceData) error {
+	return w.write(data)
+}
+
+// AppendEviction records that the cache dropped the point with the given id.
+func (w *WAL) AppendEviction(id string) error {
+	return w.write(walEviction{EvictedID: id})
+}
+
+func (w *WAL) write(record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := w.cur.Write(line); err != nil {
+		// Cut off a partial record so the next append starts on a clean line
+		w.cur.Truncate(w.curSize)
+		return fmt.Errorf("append to wal: %w", err)
+	}
+	w.curSize += int64(len(line))
+	if w.sync {
+		if err := w.cur.Sync(); err != nil {
+			return fmt.Errorf("sync wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// Seal closes the current segment, starts a new one and returns the ids of
+// every segment written since the previous Seal. Those segments hold exactly
+// the points appended up to now; Remove them once the points are stored.
+func (w *WAL) Seal() ([]uint64, error) {
+	if w.curSize == 0 {
+		// Nothing new since the last seal: keep writing to the same segment.
+		sealed := w.open[:len(w.open)-1]
+		w.open = []uint64{w.curID}
+		return sealed, nil
+	}
+	if err := w.cur.Close(); err != nil {
+		return nil, fmt.Errorf("close wal segment: %w", err)
+	}
+	sealed := w.open
+	w.open = nil
+	if err := w.next(); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// Remove deletes sealed segments.
+func (w *WAL) Remove(ids []uint64) error {
+	for _, id := range ids {
+		if err := os.Remove(w.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove wal segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the current segment. Unsealed and unremoved segments stay on
+// disk and are replayed by the next OpenWAL.
+func (w *WAL) Close() error {
+	return w.cur.Close()
+}
+
+func (w *WAL) next() error {
+	id := w.curID + 1
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	}
+	w.cur, w.curID, w.curSize = f, id, 0
+	w.open = append(w.open, id)
+	return nil
+}
+
+// readSegment returns the points in a segment and adds the ids of its
+// eviction records to evicted.
+func (w *WAL) readSegment(id uint64, evicted map[string]bool) ([]entities.DeviceData, error) {
+	f, err := os.Open(w.segmentPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("open wal segment: %w", err)
+	}
+	defer f.Close()
+
+	var points []entities.DeviceData
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var eviction walEviction
+		if err := json.Unmarshal(scanner.Bytes(), &eviction); err == nil && eviction.EvictedID != "" {
+			evicted[eviction.EvictedID] = true
+			continue
+		}
+		var data entities.DeviceData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			// A torn write at the tail of a segment was never acknowledged
+			log.Printf("skipping unreadable record in wal segment %d: %v", id, err)
+			continue
+		}
+		points = append(points, data)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read wal segment: %w", err)
+	}
+	return points, nil
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", id, walSegmentExt))
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read wal dir: %w", err)
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
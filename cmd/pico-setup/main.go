@@ -22,6 +22,9 @@ const (
 	PICO_PORT     = "80"
 )
 
+// apiBaseURL is the IoT server the tool logs in to and registers devices with.
+var apiBaseURL = "https://iot-picopi-module.onrender.com"
+
 // Styles
 var (
 	titleStyle = lipgloss.NewStyle().
@@ -87,6 +90,7 @@ type model struct {
 	loginPass    string
 	userID       string
 	authToken    string
+	pairingToken string // single-use, lets the Pico register itself into this account
 	homeSSID     string
 	homePassword string
 	currentInput string
@@ -100,8 +104,9 @@ type connectionSuccessMsg struct{}
 type sendSuccessMsg struct{}
 type scanTickMsg struct{}
 type loginSuccessMsg struct {
-	userID string
-	token  string
+	userID       string
+	token        string
+	pairingToken string
 }
 type errMsg struct{ err error }
 
@@ -135,7 +140,7 @@ func loginUser(username, password string) tea.Cmd {
 		}
 
 		jsonData, _ := json.Marshal(payload)
-		loginURL := "https://iot-picopi-module.onrender.com/api/v1/auth/login"
+		loginURL := apiBaseURL + "/api/v1/auth/login"
 
 		req, _ := http.NewRequest("POST", loginURL, bytes.NewBuffer(jsonData))
 		req.Header.Set("Content-Type", "application/json")
@@ -167,10 +172,44 @@ func loginUser(username, password string) tea.Cmd {
 
 		token, _ := result["token"].(string)
 
-		return loginSuccessMsg{userID: userID, token: token}
+		// Fetch the pairing token now: once we join the Pico's access point there is no internet
+		pairingToken, err := requestPairingToken(client, apiBaseURL, token)
+		if err != nil {
+			return errMsg{fmt.Errorf("login failed: %v", err)}
+		}
+
+		return loginSuccessMsg{userID: userID, token: token, pairingToken: pairingToken}
 	}
 }
 
+// requestPairingToken asks the server for a single-use token the Pico sends
+// with its registration, so the device is added to the logged-in account.
+func requestPairingToken(client *http.Client, baseURL, authToken string) (string, error) {
+	if authToken == "" {
+		return "", fmt.Errorf("no session token to request a pairing token with")
+	}
+	req, _ := http.NewRequest("POST", baseURL+"/api/v1/devices/pairing-tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pairing token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pairing token request failed: server returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		PairingToken string `json:"pairing_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.PairingToken == "" {
+		return "", fmt.Errorf("pairing token request failed: invalid response")
+	}
+	return result.PairingToken, nil
+}
+
 func listNetworks() tea.Msg {
 	cmd := exec.Command("netsh", "wlan", "show", "networks", "mode=bssid")
 	output, err := cmd.Output()
@@ -274,17 +313,24 @@ func connectToNetwork(ssid, password string) tea.Cmd {
 	}
 }
 
-func sendCredentials(ssid, password, userID string) tea.Cmd {
+// credentialsPayload is what the Pico's setup access point expects: the home
+// WiFi credentials plus the pairing token it registers itself with.
+func credentialsPayload(ssid, password, userID, pairingToken string) []byte {
+	payload := map[string]string{
+		"ssid":          ssid,
+		"password":      password,
+		"user_id":       userID,
+		"pairing_token": pairingToken,
+	}
+	jsonData, _ := json.Marshal(payload)
+	return jsonData
+}
+
+func sendCredentials(ssid, password, userID, pairingToken string) tea.Cmd {
 	return func() tea.Msg {
 		client := &http.Client{Timeout: 15 * time.Second}
 
-		payload := map[string]string{
-			"ssid":     ssid,
-			"password": password,
-			"user_id":  userID,
-		}
-
-		jsonData, _ := json.Marshal(payload)
+		jsonData := credentialsPayload(ssid, password, userID, pairingToken)
 		credURL := fmt.Sprintf("http://%s:%s/credentials", PICO_IP, PICO_PORT)
 
 		// Try multiple times in case of temporary connection issues
@@ -380,7 +426,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.currentInput = ""
 					m.step = stepSendingCredentials
 					m.message = "Sending credentials..."
-					return m, sendCredentials(m.homeSSID, m.homePassword, m.userID)
+					return m, sendCredentials(m.homeSSID, m.homePassword, m.userID, m.pairingToken)
 				}
 
 			case stepComplete:
@@ -416,6 +462,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case loginSuccessMsg:
 		m.userID = msg.userID
 		m.authToken = msg.token
+		m.pairingToken = msg.pairingToken
 		m.step = stepListingPicos
 		m.message = successStyle.Render("✓ Logged in as " + m.username)
 
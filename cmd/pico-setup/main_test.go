@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestPairingToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/devices/pairing-tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"pairing_token":"pt_123","expires_at":"2026-01-01T00:30:00Z"}`))
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	token, err := requestPairingToken(client, srv.URL, "session-token")
+	if err != nil || token != "pt_123" {
+		t.Fatalf("requestPairingToken = %q, %v; want pt_123", token, err)
+	}
+	if _, err := requestPairingToken(client, srv.URL, "wrong"); err == nil {
+		t.Error("rejected request reported success")
+	}
+	if _, err := requestPairingToken(client, srv.URL, ""); err == nil {
+		t.Error("request without a session token reported success")
+	}
+}
+
+func TestCredentialsPayloadCarriesPairingToken(t *testing.T) {
+	var got map[string]string
+	if err := json.Unmarshal(credentialsPayload("home", "wifi-pass", "u1", "pt_123"), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ssid": "home", "password": "wifi-pass", "user_id": "u1", "pairing_token": "pt_123"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
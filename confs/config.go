@@ -3,6 +3,9 @@ package confs
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -19,3 +22,61 @@ func LoadConfig() error {
 	}
 	return nil
 }
+
+// GetDuration reads a time.Duration (e.g. "15m") from the environment,
+// falling back to def when unset or invalid.
+func GetDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("warning: invalid duration for %s: %q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// GetBool reads a boolean ("true", "1", ...) from the environment, falling back to def when unset or invalid.
+func GetBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("warning: invalid boolean for %s: %q, using %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+// GetInt reads an integer from the environment, falling back to def when unset or invalid.
+func GetInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warning: invalid integer for %s: %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// GetList reads a comma-separated list from the environment, falling back to def when unset.
+func GetList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
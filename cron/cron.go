@@ -0,0 +1,236 @@
+// Package cron parses standard five-field cron expressions
+// ("minute hour day-of-month month day-of-week") and computes their next run time.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. Each field is a bit set of allowed values.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar/dowStar record an unrestricted field; when both day fields are
+	// restricted a day matches if either does, as in Vixie cron.
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowBounds = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var aliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a five-field expression or one of the @yearly, @monthly,
+// @weekly, @daily, @midnight and @hourly aliases. Fields accept *, lists,
+// ranges, steps and three-letter month/day names.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if alias, ok := aliases[strings.ToLower(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+
+	var s Schedule
+	var err error
+	if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, fmt.Errorf("day-of-month: %w", err)
+	}
+	if s.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, fmt.Errorf("day-of-week: %w", err)
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return &s, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := b.min, b.max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			a, z, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseValue(a, b); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(z, b); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := parseValue(rng, b)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if hasStep {
+				hi = b.max // "5/15" means from 5 through the end, every 15
+			} else {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+// Next returns the first time strictly after t that matches the schedule, in
+// t's location. It returns the zero time if nothing matches within five years
+// (e.g. "0 0 30 2 *").
+//
+// Daylight saving transitions follow Vixie cron for schedules with a fixed
+// hour: a local time skipped when clocks go forward fires once, at the first
+// instant after the jump, and a local time repeated when clocks go back fires
+// only on its first occurrence. Schedules that run every hour simply follow
+// the wall clock.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+	fixedHour := s.hour != allHours
+
+	for t.Year() <= limit {
+		// Hours and minutes advance in absolute time, so a step can never
+		// land inside a DST gap and be normalised back to an earlier instant.
+		var next time.Time
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minute&(1<<uint(t.Minute())) == 0 || (fixedHour && repeatedWallTime(t)):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !next.After(t) {
+			// Midnight fell in a DST gap and was normalised backwards
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		}
+		if fixedHour && s.matchSkipped(t, next) {
+			return next
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+const allHours = 1<<24 - 1
+
+// matchSkipped reports whether a local time matching the schedule was
+// skipped by a clock change between from and to. Every wall time between
+// them that was not skipped is already known not to match.
+func (s *Schedule) matchSkipped(from, to time.Time) bool {
+	start, end := wallClock(from), wallClock(to)
+	if end.Sub(start) <= to.Sub(from) {
+		return false
+	}
+	for w := start.Add(time.Minute); w.Before(end); w = w.Add(time.Minute) {
+		if s.month&(1<<uint(w.Month())) != 0 && s.dayMatches(w) &&
+			s.hour&(1<<uint(w.Hour())) != 0 && s.minute&(1<<uint(w.Minute())) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatedWallTime reports whether t's local time already occurred earlier,
+// because clocks went back less than one offset change ago.
+func repeatedWallTime(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-3 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	return wallClock(earlier).Equal(wallClock(t))
+}
+
+// wallClock returns t's local date and time as a UTC time, for comparing
+// clock readings across offset changes.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
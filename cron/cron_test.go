@@ -0,0 +1,154 @@
+package cron
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("load %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := time.UTC
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 1, 10, 0, 30, 0, utc), time.Date(2026, 1, 1, 10, 1, 0, 0, utc)},
+		{"0 * * * *", time.Date(2026, 1, 1, 10, 0, 0, 0, utc), time.Date(2026, 1, 1, 11, 0, 0, 0, utc)},
+		{"*/15 9-17 * * mon-fri", time.Date(2026, 1, 2, 17, 50, 0, 0, utc), time.Date(2026, 1, 5, 9, 0, 0, 0, utc)},
+		{"@daily", time.Date(2026, 12, 31, 12, 0, 0, 0, utc), time.Date(2027, 1, 1, 0, 0, 0, 0, utc)},
+		{"0 12 1 * *", time.Date(2026, 1, 31, 0, 0, 0, 0, utc), time.Date(2026, 2, 1, 12, 0, 0, 0, utc)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		// Both day fields restricted: either may match
+		{"0 0 13 * fri", time.Date(2026, 2, 1, 0, 0, 0, 0, utc), time.Date(2026, 2, 6, 0, 0, 0, 0, utc)},
+		// 7 is Sunday
+		{"0 0 * * 7", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Date(2026, 1, 4, 0, 0, 0, 0, utc)},
+		{"0 0 30 2 *", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	edt := time.FixedZone("EDT", -4*3600)
+	est := time.FixedZone("EST", -5*3600)
+	// 2026-03-08 02:00 EST jumps to 03:00 EDT; 2026-11-01 02:00 EDT falls back to 01:00 EST
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time // successive runs
+	}{
+		{
+			name: "skipped time fires once after the jump",
+			expr: "30 2 * * *",
+			from: time.Date(2026, 3, 7, 23, 0, 0, 0, ny),
+			want: []time.Time{
+				time.Date(2026, 3, 8, 3, 0, 0, 0, edt),
+				time.Date(2026, 3, 9, 2, 30, 0, 0, edt),
+			},
+		},
+		{
+			name: "time after the jump is unaffected",
+			expr: "0 22 * * *",
+			from: time.Date(2026, 3, 7, 23, 0, 0, 0, ny),
+			want: []time.Time{
+				time.Date(2026, 3, 8, 22, 0, 0, 0, edt),
+				time.Date(2026, 3, 9, 22, 0, 0, 0, edt),
+			},
+		},
+		{
+			name: "first hour after the jump",
+			expr: "0 3 * * *",
+			from: time.Date(2026, 3, 8, 1, 0, 0, 0, ny),
+			want: []time.Time{
+				time.Date(2026, 3, 8, 3, 0, 0, 0, edt),
+				time.Date(2026, 3, 9, 3, 0, 0, 0, edt),
+			},
+		},
+		{
+			name: "every minute keeps following the clock across the gap",
+			expr: "* * * * *",
+			from: time.Date(2026, 3, 8, 1, 58, 0, 0, ny),
+			want: []time.Time{
+				time.Date(2026, 3, 8, 1, 59, 0, 0, est),
+				time.Date(2026, 3, 8, 3, 0, 0, 0, edt),
+				time.Date(2026, 3, 8, 3, 1, 0, 0, edt),
+			},
+		},
+		{
+			name: "repeated time fires only on its first occurrence",
+			expr: "30 1 * * *",
+			from: time.Date(2026, 10, 31, 23, 0, 0, 0, ny),
+			want: []time.Time{
+				time.Date(2026, 11, 1, 1, 30, 0, 0, edt),
+				time.Date(2026, 11, 2, 1, 30, 0, 0, est),
+			},
+		},
+		{
+			name: "hourly schedule runs in both repeated hours",
+			expr: "30 * * * *",
+			from: time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC).In(ny), // 01:00 EDT
+			want: []time.Time{
+				time.Date(2026, 11, 1, 1, 30, 0, 0, edt),
+				time.Date(2026, 11, 1, 1, 30, 0, 0, est),
+				time.Date(2026, 11, 1, 2, 30, 0, 0, est),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			from := tt.from
+			for i, want := range tt.want {
+				got := s.Next(from)
+				if !got.Equal(want) {
+					t.Fatalf("run %d: Next(%s) = %s, want %s", i, from, got, want)
+				}
+				if got.Location() != ny {
+					t.Fatalf("run %d: location %s, want %s", i, got.Location(), ny)
+				}
+				from = got
+			}
+		})
+	}
+}
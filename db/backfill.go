@@ -0,0 +1,62 @@
+package db
+
+import (
+	"iot-server/entities"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// backfillRecordedAt parses recorded_at for telemetry written before the
+// column existed. Parsing happens in Go so malformed device timestamps fall
+// back to created_at instead of failing a SQL cast.
+func backfillRecordedAt(db *gorm.DB) error {
+	total := 0
+	for {
+		var rows []entities.DeviceData
+		err := db.Unscoped().Select("id", "timestamp", "created_at").
+			Where("recorded_at IS NULL").Limit(1000).Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				recordedAt := entities.ParseDeviceTimestamp(row.Timestamp, row.CreatedAt)
+				if err := tx.Unscoped().Model(&entities.DeviceData{}).Where("id = ?", row.ID).
+					UpdateColumn("recorded_at", recordedAt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		total += len(rows)
+	}
+	if total > 0 {
+		log.Printf("Backfilled recorded_at for %d device data rows", total)
+	}
+	return nil
+}
+
+// backfillAckDeadline gives commands left in "sent" before ack tracking
+// existed an already-passed deadline, so the timeout sweeper retries or fails
+// them instead of leaving them to block their module's queue.
+func backfillAckDeadline(db *gorm.DB) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	res := db.Model(&entities.Command{}).
+		Where("status = ? AND (ack_deadline IS NULL OR ack_deadline = '')", entities.CommandStatusSent).
+		UpdateColumn("ack_deadline", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		log.Printf("Backfilled ack_deadline for %d sent commands", res.RowsAffected)
+	}
+	return nil
+}
@@ -74,10 +74,18 @@ func Connect() (Database, error) {
 	log.Println("Connection pool configured for cloud database")
 
 	log.Println("Running database migrations...")
-	if err := db.AutoMigrate(&entities.Device{}, &entities.DeviceData{}, &entities.DeviceModule{}, &entities.Command{}); err != nil {
+	if err := db.AutoMigrate(&entities.Device{}, &entities.DeviceData{}, &entities.DeviceModule{}, &entities.Command{}, &entities.User{}, &entities.UserToken{}, &entities.DeviceMember{}, &entities.APIKey{}, &entities.IdempotencyKey{}, &entities.CommandSchedule{}, &entities.CommandScheduleRun{}, &entities.CommandBatch{}, &entities.DeviceCommandSequence{},
+		&entities.Macro{}, &entities.MacroExecution{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	if err := backfillRecordedAt(db); err != nil {
+		log.Printf("warning: failed to backfill device_data.recorded_at: %v", err)
+	}
+	if err := backfillAckDeadline(db); err != nil {
+		log.Printf("warning: failed to backfill commands.ack_deadline: %v", err)
+	}
+
 	log.Println("Database migrations completed successfully!")
 
 	return &GormDatabase{DB: db}, nil
@@ -0,0 +1,34 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// APIKey lets third-party integrations act on behalf of a user with limited scopes.
+// Only the SHA-256 of the key is stored; Prefix is used to look it up.
+type APIKey struct {
+	ID         string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID     string `gorm:"index;type:text" json:"user_id"`
+	Name       string `json:"name"`
+	Prefix     string `gorm:"uniqueIndex;type:varchar(32)" json:"prefix"`
+	KeyHash    string `gorm:"type:varchar(64)" json:"-"`
+	Scopes     string `gorm:"type:jsonb" json:"scopes"`     // JSON array of scopes
+	DeviceIDs  string `gorm:"type:jsonb" json:"device_ids"` // JSON array, empty = all devices
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+	RevokedAt  string `json:"revoked_at,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+func (k *APIKey) BeforeCreate(tx *gorm.DB) (err error) {
+	if k.ID == "" {
+		k.ID = uuid.New().String()
+	}
+	k.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	k.UpdatedAt = k.CreatedAt
+	return
+}
@@ -7,14 +7,41 @@ import (
 	"gorm.io/gorm"
 )
 
+// Command statuses
+const (
+	CommandStatusPending   = "pending"
+	CommandStatusSent      = "sent"
+	CommandStatusExecuted  = "executed"
+	CommandStatusFailed    = "failed"
+	CommandStatusExpired   = "expired" // TTL elapsed before the device acknowledged it
+	CommandStatusCancelled = "cancelled"
+)
+
+// Command priorities; higher values are delivered first
+const (
+	CommandPriorityLow    = -10
+	CommandPriorityNormal = 0
+	CommandPriorityHigh   = 10
+	CommandPriorityUrgent = 20
+)
+
 type Command struct {
 	ID             string         `json:"id" gorm:"primaryKey;type:varchar(36)"`
 	DeviceID       string         `json:"device_id" gorm:"index;type:varchar(36)"`
 	DeviceModuleID string         `json:"device_module_id" gorm:"index;type:varchar(36)"` // NEW: target specific module
 	Command        string         `json:"command" gorm:"type:varchar(128)"`
-	Params         string         `json:"params" gorm:"type:text"`        // JSON string
-	Status         string         `json:"status" gorm:"type:varchar(32)"` // pending, sent, executed, failed
-	Response       string         `json:"response" gorm:"type:text"`      // optional response payload
+	Seq            int64          `json:"seq" gorm:"index"`                               // per-device, monotonic; assigned on enqueue
+	Priority       int            `json:"priority" gorm:"default:0"`                      // see CommandPriority*
+	Params         string         `json:"params" gorm:"type:text"`                        // JSON string
+	Status         string         `json:"status" gorm:"type:varchar(32)"`                 // pending, sent, executed, failed
+	Response       string         `json:"response" gorm:"type:text"`                      // optional response payload
+	Attempts       int            `json:"attempts" gorm:"default:0"`                      // number of times the command was delivered
+	AckTimeout     int            `json:"ack_timeout_seconds" gorm:"default:0"`           // seconds the device has to ack a delivery
+	AckDeadline    string         `json:"ack_deadline,omitempty" gorm:"type:varchar(64)"` // set while status=sent
+	NextAttemptAt  string         `json:"next_attempt_at,omitempty" gorm:"type:varchar(64)"`
+	ExpiresAt      string         `json:"expires_at,omitempty" gorm:"index;type:varchar(64)"`
+	BatchID        string         `json:"batch_id,omitempty" gorm:"index;type:varchar(36)"`       // set for commands created by a fan-out
+	SupersedeKey   string         `json:"supersede_key,omitempty" gorm:"index;type:varchar(128)"` // newer commands with the same module and key cancel this one
 	CreatedAt      string         `json:"created_at" gorm:"type:varchar(64)"`
 	UpdatedAt      string         `json:"updated_at" gorm:"type:varchar(64)"`
 	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
@@ -28,7 +55,13 @@ func (c *Command) BeforeCreate(tx *gorm.DB) (err error) {
 	c.CreatedAt = now
 	c.UpdatedAt = now
 	if c.Status == "" {
-		c.Status = "pending"
+		c.Status = CommandStatusPending
 	}
 	return nil
 }
+
+// DeviceCommandSequence holds the last command sequence number issued per device.
+type DeviceCommandSequence struct {
+	DeviceID string `gorm:"primaryKey;type:varchar(36)"`
+	Seq      int64
+}
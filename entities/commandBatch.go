@@ -0,0 +1,25 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CommandBatch groups the commands created by one fan-out request.
+type CommandBatch struct {
+	ID          string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID      string `gorm:"index;type:varchar(36)" json:"user_id"`
+	Command     string `gorm:"type:varchar(128)" json:"command"`
+	TargetCount int    `json:"target_count"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (b *CommandBatch) BeforeCreate(tx *gorm.DB) (err error) {
+	if b.ID == "" {
+		b.ID = uuid.New().String()
+	}
+	b.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	return
+}
@@ -0,0 +1,75 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Schedule statuses
+const (
+	ScheduleStatusActive    = "active"
+	ScheduleStatusPaused    = "paused"
+	ScheduleStatusCompleted = "completed" // one-shot schedules after their run
+)
+
+// Schedule run outcomes
+const (
+	ScheduleRunEnqueued = "enqueued"
+	ScheduleRunMissed   = "missed" // the scheduler was not running close enough to the due time
+	ScheduleRunFailed   = "failed" // enqueue was rejected
+)
+
+// CommandSchedule enqueues a command on a cron expression or once at RunAt.
+type CommandSchedule struct {
+	ID             string         `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID         string         `gorm:"index;type:varchar(36)" json:"user_id"` // creator; runs act on their behalf
+	Name           string         `json:"name"`
+	DeviceID       string         `gorm:"index;type:varchar(36)" json:"device_id"`
+	DeviceModuleID string         `gorm:"type:varchar(36)" json:"device_module_id"`
+	Command        string         `gorm:"type:varchar(128)" json:"command"`
+	Params         string         `gorm:"type:text" json:"params"` // JSON string
+	CronExpr       string         `gorm:"type:varchar(128)" json:"cron,omitempty"`
+	RunAt          string         `gorm:"type:varchar(64)" json:"run_at,omitempty"` // one-shot, RFC3339
+	Timezone       string         `gorm:"type:varchar(64)" json:"timezone"`
+	Status         string         `gorm:"type:varchar(16)" json:"status"`
+	NextRunAt      string         `gorm:"index;type:varchar(64)" json:"next_run_at,omitempty"` // RFC3339 UTC
+	LastRunAt      string         `gorm:"type:varchar(64)" json:"last_run_at,omitempty"`
+	LastCommandID  string         `gorm:"type:varchar(36)" json:"last_command_id,omitempty"`
+	MissedRuns     int            `gorm:"default:0" json:"missed_runs"`
+	CreatedAt      string         `json:"created_at"`
+	UpdatedAt      string         `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (s *CommandSchedule) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		s.ID = uuid.New().String()
+	}
+	s.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	s.UpdatedAt = s.CreatedAt
+	if s.Status == "" {
+		s.Status = ScheduleStatusActive
+	}
+	return
+}
+
+// CommandScheduleRun records one due time of a schedule and what happened to it.
+type CommandScheduleRun struct {
+	ID           string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	ScheduleID   string `gorm:"index;type:varchar(36)" json:"schedule_id"`
+	ScheduledFor string `gorm:"type:varchar(64)" json:"scheduled_for"`
+	Status       string `gorm:"type:varchar(16)" json:"status"`
+	CommandID    string `gorm:"type:varchar(36)" json:"command_id,omitempty"`
+	Error        string `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+func (r *CommandScheduleRun) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		r.ID = uuid.New().String()
+	}
+	r.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	return
+}
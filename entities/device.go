@@ -16,6 +16,9 @@ type Device struct {
 	UpdatedAt string         `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
 	Status    string         `json:"status"`
+	Tags      StringList     `gorm:"type:jsonb" json:"tags"` // free-form groups, e.g. "living-room", used to target commands
+	// SecretHash is the SHA-256 of the device secret handed out at registration
+	SecretHash string `json:"-"`
 }
 
 func (d *Device) BeforeCreate(tx *gorm.DB) (err error) {
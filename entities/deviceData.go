@@ -12,14 +12,39 @@ type DeviceData struct {
 	DeviceID       string         `gorm:"index" json:"device_id"`
 	DeviceModuleID string         `gorm:"index" json:"device_module_id"`
 	Timestamp      string         `json:"timestamp"`
-	Data           string         `gorm:"type:jsonb" json:"data"` // JSON column for flexible sensor data
+	Data           string         `gorm:"type:jsonb" json:"data"`                    // JSON column for flexible sensor data
+	RecordedAt     time.Time      `gorm:"type:timestamptz;index" json:"recorded_at"` // Timestamp parsed for sorting and range queries
 	CreatedAt      string         `json:"created_at"`
 	UpdatedAt      string         `json:"updated_at"`
 	DeletedAt      gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
 }
 
+// deviceTimestampLayouts are the formats devices report readings in.
+var deviceTimestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// ParseDeviceTimestamp parses a device-reported timestamp, treating values
+// without a zone as UTC. Unparseable values fall back to fallback, then to now.
+func ParseDeviceTimestamp(ts, fallback string) time.Time {
+	for _, v := range []string{ts, fallback} {
+		for _, layout := range deviceTimestampLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return time.Now().UTC()
+}
+
+func (d *DeviceData) BeforeSave(tx *gorm.DB) (err error) {
+	d.RecordedAt = ParseDeviceTimestamp(d.Timestamp, d.CreatedAt)
+	return
+}
+
 func (d *DeviceData) BeforeCreate(tx *gorm.DB) (err error) {
-	d.ID = uuid.New().String()
+	// Points buffered by the data processor already carry an ID
+	if d.ID == "" {
+		d.ID = uuid.New().String()
+	}
 	d.CreatedAt = time.Now().Format(time.RFC3339)
 	d.UpdatedAt = d.CreatedAt
 	return
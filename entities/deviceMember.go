@@ -0,0 +1,59 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Device member roles. The device's UserID is always the owner; other
+// members are granted access through DeviceMember rows.
+const (
+	MemberRoleOwner  = "owner"
+	MemberRoleEditor = "editor"
+	MemberRoleViewer = "viewer"
+)
+
+// Invitation lifecycle
+const (
+	MemberStatusPending  = "pending"
+	MemberStatusAccepted = "accepted"
+)
+
+// DeviceMember grants another user scoped access to a device.
+type DeviceMember struct {
+	ID         string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	DeviceID   string `gorm:"uniqueIndex:idx_device_member;type:varchar(36)" json:"device_id"`
+	UserID     string `gorm:"uniqueIndex:idx_device_member;index;type:text" json:"user_id"`
+	Role       string `gorm:"type:varchar(16)" json:"role"`   // editor | viewer
+	Status     string `gorm:"type:varchar(16)" json:"status"` // pending | accepted
+	InvitedBy  string `gorm:"type:text" json:"invited_by"`
+	AcceptedAt string `json:"accepted_at,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+func (m *DeviceMember) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		m.ID = uuid.New().String()
+	}
+	m.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	m.UpdatedAt = m.CreatedAt
+	if m.Status == "" {
+		m.Status = MemberStatusPending
+	}
+	return
+}
+
+// DeviceWithRole is a device as seen by a given user, with that user's role.
+type DeviceWithRole struct {
+	Device
+	Role string `json:"role"`
+}
+
+// DeviceModuleWithRole is a module as seen by a given user, with that user's role on its device.
+type DeviceModuleWithRole struct {
+	DeviceModule
+	Role string `json:"role"`
+}
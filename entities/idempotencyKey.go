@@ -0,0 +1,31 @@
+package entities
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// IdempotencyKey remembers the outcome of a request made with an
+// Idempotency-Key header (or a device message id) so retries can be answered
+// without repeating the side effect. Scope keeps keys of different callers apart.
+type IdempotencyKey struct {
+	ID          string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Scope       string `gorm:"uniqueIndex:idx_idempotency_scope_key;type:varchar(128)" json:"scope"`
+	Key         string `gorm:"uniqueIndex:idx_idempotency_scope_key;type:varchar(255)" json:"key"`
+	RequestHash string `gorm:"type:varchar(64)" json:"-"` // SHA-256 of the request body
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code"`
+	Response    string `gorm:"type:text" json:"-"`
+	ExpiresAt   string `gorm:"index;type:varchar(64)" json:"expires_at"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (k *IdempotencyKey) BeforeCreate(tx *gorm.DB) (err error) {
+	if k.ID == "" {
+		k.ID = uuid.New().String()
+	}
+	k.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	return
+}
@@ -0,0 +1,148 @@
+package entities
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Macro execution statuses
+const (
+	MacroExecutionRunning     = "running"
+	MacroExecutionSucceeded   = "succeeded"
+	MacroExecutionFailed      = "failed"                // a step failed and did not allow continuing
+	MacroExecutionPartial     = "completed_with_errors" // every step ran but some failed
+	MacroExecutionInterrupted = "interrupted"           // the server stopped mid-run
+)
+
+// Macro step outcomes
+const (
+	MacroStepExecuted = "executed"
+	MacroStepFailed   = "failed"    // the device reported failure, or the command expired or was cancelled
+	MacroStepTimedOut = "timed_out" // no ack in time; the command is cancelled
+	MacroStepRejected = "rejected"  // the command could not be enqueued
+	MacroStepSkipped  = "skipped"   // an earlier step stopped the run
+	// MacroStepInterrupted: the server shut down while waiting for the ack;
+	// the command stays queued and may still run
+	MacroStepInterrupted = "interrupted"
+)
+
+// Macro is a stored, ordered list of commands run one after another.
+type Macro struct {
+	ID          string         `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID      string         `gorm:"index;type:varchar(36)" json:"user_id"`
+	Name        string         `json:"name"`
+	Description string         `gorm:"type:text" json:"description"`
+	Steps       MacroSteps     `gorm:"type:jsonb" json:"steps"`
+	CreatedAt   string         `json:"created_at"`
+	UpdatedAt   string         `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (m *Macro) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		m.ID = uuid.New().String()
+	}
+	m.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	m.UpdatedAt = m.CreatedAt
+	return
+}
+
+// MacroStep is one command of a macro.
+type MacroStep struct {
+	DeviceID          string                 `json:"device_id"`
+	DeviceModuleID    string                 `json:"device_module_id,omitempty"`
+	Command           string                 `json:"command"`
+	Params            map[string]interface{} `json:"params,omitempty"`
+	DelaySeconds      int                    `json:"delay_seconds,omitempty"`   // wait before sending this step
+	TimeoutSeconds    int                    `json:"timeout_seconds,omitempty"` // how long to wait for the ack
+	ContinueOnFailure bool                   `json:"continue_on_failure,omitempty"`
+}
+
+// MacroSteps is stored as a JSONB array.
+type MacroSteps []MacroStep
+
+func (s MacroSteps) Value() (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]MacroStep(s))
+	return string(b), err
+}
+
+func (s *MacroSteps) Scan(src interface{}) error {
+	return scanJSON(src, (*[]MacroStep)(s))
+}
+
+// MacroExecution records one run of a macro and what happened to each step.
+type MacroExecution struct {
+	ID         string           `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	MacroID    string           `gorm:"index;type:varchar(36)" json:"macro_id"`
+	UserID     string           `gorm:"index;type:varchar(36)" json:"user_id"` // who ran it
+	Status     string           `gorm:"index;type:varchar(32)" json:"status"`
+	Steps      MacroStepResults `gorm:"type:jsonb" json:"steps"`
+	StartedAt  string           `json:"started_at"`
+	FinishedAt string           `json:"finished_at,omitempty"`
+	UpdatedAt  string           `gorm:"index" json:"updated_at"`
+}
+
+func (e *MacroExecution) BeforeCreate(tx *gorm.DB) (err error) {
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	e.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	e.UpdatedAt = e.StartedAt
+	if e.Status == "" {
+		e.Status = MacroExecutionRunning
+	}
+	return
+}
+
+// MacroStepResult is the outcome of one step of an execution.
+type MacroStepResult struct {
+	Index          int             `json:"index"`
+	DeviceID       string          `json:"device_id"`
+	DeviceModuleID string          `json:"device_module_id,omitempty"`
+	Command        string          `json:"command"`
+	Status         string          `json:"status"` // see MacroStep*; "" while pending
+	CommandID      string          `json:"command_id,omitempty"`
+	Response       json.RawMessage `json:"response,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	StartedAt      string          `json:"started_at,omitempty"`
+	FinishedAt     string          `json:"finished_at,omitempty"`
+}
+
+// MacroStepResults is stored as a JSONB array.
+type MacroStepResults []MacroStepResult
+
+func (r MacroStepResults) Value() (driver.Value, error) {
+	if r == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]MacroStepResult(r))
+	return string(b), err
+}
+
+func (r *MacroStepResults) Scan(src interface{}) error {
+	return scanJSON(src, (*[]MacroStepResult)(r))
+}
+
+// scanJSON decodes a JSON column into dst, treating NULL as empty.
+func scanJSON(src interface{}, dst interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.New("unsupported type for JSON column")
+	}
+	return json.Unmarshal(b, dst)
+}
@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// StringList is a []string stored as a JSONB array, so clients can send and
+// receive plain JSON arrays.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]string(l))
+	return string(b), err
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = StringList{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.New("unsupported type for StringList")
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// Contains reports whether every value in want is in the list.
+func (l StringList) Contains(want ...string) bool {
+	for _, w := range want {
+		found := false
+		for _, v := range l {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -1,11 +1,62 @@
 package entities
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
 // User represents a user in the HomeNetAI system
 type User struct {
-	ID           string `gorm:"type:text;primaryKey" json:"id"`
-	Username     string `gorm:"unique;not null" json:"username"`
-	Email        string `gorm:"unique;not null" json:"email"`
-	PasswordHash string `gorm:"not null" json:"-"`
+	ID              string `gorm:"type:text;primaryKey" json:"id"`
+	Username        string `gorm:"unique;not null" json:"username"`
+	Email           string `gorm:"unique;not null" json:"email"`
+	PasswordHash    string `gorm:"not null" json:"-"`
+	Role            string `gorm:"type:varchar(16);not null;default:user" json:"role"` // user | admin
+	EmailVerified   bool   `gorm:"not null;default:false" json:"email_verified"`
+	EmailVerifiedAt string `json:"email_verified_at,omitempty"`
+	// TokenVersion is embedded in session tokens; bumping it revokes them all
+	TokenVersion int    `gorm:"not null;default:0" json:"-"`
 	CreatedAt    string `json:"created_at"`
 	UpdatedAt    string `json:"updated_at"`
 }
+
+func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
+	if u.ID == "" {
+		u.ID = uuid.New().String()
+	}
+	if u.Role == "" {
+		u.Role = "user"
+	}
+	u.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	u.UpdatedAt = u.CreatedAt
+	return
+}
+
+// User token purposes
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+	TokenPurposeDevicePairing = "device_pairing" // lets a new device register into the issuer's account
+)
+
+// UserToken is a single-use token sent to the user by email.
+// Only the SHA-256 of the token is stored.
+type UserToken struct {
+	ID        string `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	UserID    string `gorm:"index;type:text" json:"user_id"`
+	Purpose   string `gorm:"index;type:varchar(32)" json:"purpose"`
+	TokenHash string `gorm:"uniqueIndex;type:varchar(64)" json:"-"`
+	ExpiresAt string `json:"expires_at"`
+	UsedAt    string `json:"used_at,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+func (t *UserToken) BeforeCreate(tx *gorm.DB) (err error) {
+	if t.ID == "" {
+		t.ID = uuid.New().String()
+	}
+	t.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	return
+}
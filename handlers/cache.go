@@ -18,7 +18,10 @@ func NewCacheHandler(processor *services.DataProcessor) *CacheHandler {
 }
 
 func (h *CacheHandler) ProcessCache(c *gin.Context) {
-	h.processor.ProcessCachedData()
+	if err := h.processor.ProcessCachedData(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "status": "retrying"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"status": "processed"})
 }
 
@@ -0,0 +1,93 @@
+package httpHandler
+
+import (
+	"iot-server/usecases"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyHandler struct {
+	useCase *usecases.APIKeyUseCase
+}
+
+func NewAPIKeyHandler(useCase *usecases.APIKeyUseCase) *APIKeyHandler {
+	return &APIKeyHandler{
+		useCase: useCase,
+	}
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes" binding:"required"`
+	DeviceIDs []string `json:"device_ids"` // optional allow-list
+	ExpiresIn string   `json:"expires_in"` // optional Go duration, e.g. "720h"
+}
+
+// CreateAPIKey handles POST /api/v1/api-keys
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "expires_in must be a positive duration such as 720h",
+			})
+			return
+		}
+		ttl = d
+	}
+
+	key, plain, err := h.useCase.Create(CurrentPrincipal(c), req.Name, req.Scopes, req.DeviceIDs, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// The plain key is only ever returned here
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "API key created successfully",
+		"data":    key,
+		"key":     plain,
+	})
+}
+
+// GetAPIKeys handles GET /api/v1/api-keys
+func (h *APIKeyHandler) GetAPIKeys(c *gin.Context) {
+	keys, err := h.useCase.List(CurrentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve api keys",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  keys,
+		"count": len(keys),
+	})
+}
+
+// RevokeAPIKey handles DELETE /api/v1/api-keys/:id
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	if err := h.useCase.Revoke(CurrentUserID(c), c.Param("id")); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "API key revoked successfully",
+	})
+}
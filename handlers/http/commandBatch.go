@@ -0,0 +1,67 @@
+package httpHandler
+
+import (
+	"net/http"
+	"time"
+
+	"iot-server/usecases"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BatchHandler struct {
+	useCase *usecases.BatchUseCase
+}
+
+func NewBatchHandler(useCase *usecases.BatchUseCase) *BatchHandler {
+	return &BatchHandler{useCase: useCase}
+}
+
+type fanOutReq struct {
+	Command      string                  `json:"command"`
+	Params       map[string]interface{}  `json:"params"`
+	Targets      []usecases.BatchTarget  `json:"targets"`  // explicit devices/modules
+	Selector     *usecases.BatchSelector `json:"selector"` // and/or devices matching tags
+	AckTimeout   int                     `json:"ack_timeout_seconds"`
+	TTL          int                     `json:"ttl_seconds"`
+	SupersedeKey string                  `json:"supersede_key"`
+}
+
+// POST /api/v1/command-batches
+// { "command": "BLINK_PICO1", "params": {"n": 3}, "selector": {"tags": ["living-room"]} }
+// Creates one command per target under a shared batch id
+func (h *BatchHandler) CreateBatch(c *gin.Context) {
+	var req fanOutReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
+		return
+	}
+
+	batch, results, err := h.useCase.FanOut(CurrentPrincipal(c), req.Targets, req.Selector, req.Command, req.Params, usecases.EnqueueOptions{
+		AckTimeout:   time.Duration(req.AckTimeout) * time.Second,
+		TTL:          time.Duration(req.TTL) * time.Second,
+		SupersedeKey: req.SupersedeKey,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusCreated
+	if batch.TargetCount == 0 {
+		// Every target was rejected; the per-target errors say why
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, gin.H{"batch": batch, "results": results})
+}
+
+// GET /api/v1/command-batches/:id
+// Aggregate status counts for the batch's commands
+func (h *BatchHandler) GetBatch(c *gin.Context) {
+	st, err := h.useCase.Status(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": st})
+}
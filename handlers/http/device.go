@@ -4,42 +4,117 @@ import (
 	"iot-server/entities"
 	"iot-server/usecases"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type DeviceHandler struct {
 	useCase *usecases.DeviceUseCase
+	authz   *usecases.Authorizer
+	pairing *usecases.UserUseCase
 }
 
-func NewDeviceHandler(useCase *usecases.DeviceUseCase) *DeviceHandler {
+func NewDeviceHandler(useCase *usecases.DeviceUseCase, authz *usecases.Authorizer) *DeviceHandler {
 	return &DeviceHandler{
 		useCase: useCase,
+		authz:   authz,
 	}
 }
 
+// SetPairing lets unauthenticated devices register by presenting a pairing
+// token issued through POST /api/v1/devices/pairing-tokens.
+func (h *DeviceHandler) SetPairing(users *usecases.UserUseCase) {
+	h.pairing = users
+}
+
+type createDeviceReq struct {
+	entities.Device
+	PairingToken string `json:"pairing_token"`
+}
+
 // CreateDevice handles POST /api/v1/devices
+// Called by a device during provisioning. The owner comes from the single-use
+// pairing token, never from the body.
 func (h *DeviceHandler) CreateDevice(c *gin.Context) {
-	var device entities.Device
+	var req createDeviceReq
 
-	if err := c.ShouldBindJSON(&device); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid request body",
 			"details": err.Error(),
 		})
 		return
 	}
+	if h.pairing == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "device registration is not available"})
+		return
+	}
+	userID, err := h.pairing.ConsumePairingToken(req.PairingToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid pairing_token is required"})
+		return
+	}
+	device := req.Device
+	device.UserID = userID
 
-	if err := h.useCase.CreateDevice(&device); err != nil {
+	secret, err := h.useCase.RegisterDevice(&device)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
 
+	// The secret is only ever returned here
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "Device created successfully",
-		"data":    device,
+		"message":       "Device created successfully",
+		"data":          device,
+		"device_secret": secret,
+	})
+}
+
+// CreatePairingToken handles POST /api/v1/devices/pairing-tokens
+// Issues a single-use token that registers one new device into the caller's
+// account. It is handed to the device during provisioning.
+func (h *DeviceHandler) CreatePairingToken(c *gin.Context) {
+	p := CurrentPrincipal(c)
+	if h.pairing == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "device registration is not available"})
+		return
+	}
+	token, expiresAt, err := h.pairing.IssuePairingToken(p.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue pairing token"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"pairing_token": token,
+		"expires_at":    expiresAt.Format(time.RFC3339),
+	})
+}
+
+// RotateDeviceSecret handles POST /api/v1/devices/:id/secret
+func (h *DeviceHandler) RotateDeviceSecret(c *gin.Context) {
+	id := c.Param("id")
+
+	if _, err := h.authz.Device(CurrentPrincipal(c), id, usecases.AccessManage); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	secret, err := h.useCase.RotateDeviceSecret(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Device secret rotated successfully",
+		"device_id":     id,
+		"device_secret": secret,
 	})
 }
 
@@ -47,11 +122,9 @@ func (h *DeviceHandler) CreateDevice(c *gin.Context) {
 func (h *DeviceHandler) GetDevice(c *gin.Context) {
 	id := c.Param("id")
 
-	device, err := h.useCase.GetDevice(id)
+	device, err := h.authz.Device(CurrentPrincipal(c), id, usecases.AccessRead)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Device not found",
-		})
+		respondAuthzError(c, err)
 		return
 	}
 
@@ -60,7 +133,7 @@ func (h *DeviceHandler) GetDevice(c *gin.Context) {
 	})
 }
 
-// GetAllDevices handles GET /api/v1/devices
+// GetAllDevices handles GET /api/v1/devices (admin only)
 func (h *DeviceHandler) GetAllDevices(c *gin.Context) {
 	devices, err := h.useCase.GetAllDevices()
 	if err != nil {
@@ -89,6 +162,11 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 		return
 	}
 
+	if _, err := h.authz.Device(CurrentPrincipal(c), id, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	device.ID = id
 
 	if err := h.useCase.UpdateDevice(&device); err != nil {
@@ -108,6 +186,11 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 func (h *DeviceHandler) DeleteDevice(c *gin.Context) {
 	id := c.Param("id")
 
+	if _, err := h.authz.Device(CurrentPrincipal(c), id, usecases.AccessManage); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	if err := h.useCase.DeleteDevice(id); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
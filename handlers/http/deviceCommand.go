@@ -2,23 +2,25 @@ package httpHandler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"iot-server/entities"
 	"iot-server/usecases"
-	"iot-server/ws"
 
 	"github.com/gin-gonic/gin"
 )
 
 type CommandHandler struct {
-	wsMgr *ws.Manager
 	cmdUC *usecases.CommandsUseCase
+	authz *usecases.Authorizer
 }
 
-func NewCommandHandler(mgr *ws.Manager, uc *usecases.CommandsUseCase) *CommandHandler {
-	return &CommandHandler{wsMgr: mgr, cmdUC: uc}
+func NewCommandHandler(uc *usecases.CommandsUseCase, authz *usecases.Authorizer) *CommandHandler {
+	return &CommandHandler{cmdUC: uc, authz: authz}
 }
 
 type enqueueReq struct {
@@ -26,52 +28,100 @@ type enqueueReq struct {
 	DeviceModuleID string                 `json:"device_module_id"` // NEW: target specific module
 	Command        string                 `json:"command"`
 	Params         map[string]interface{} `json:"params"`
+	AckTimeout     int                    `json:"ack_timeout_seconds"` // optional, overrides the server default
+	TTL            int                    `json:"ttl_seconds"`         // optional, expire the command if not acked by then
+	SupersedeKey   string                 `json:"supersede_key"`       // optional, cancels older pending commands for the module with the same key
+	Priority       *int                   `json:"priority"`            // optional, -10 (low) to 20 (urgent); urgent commands jump the queue
 }
 
-// POST /api/v1/commands
-// Enqueue a command and, if device is connected via WS, push immediately
+// POST /api/v1/commands[?wait=10s]
+// Dispatch a command: pushed immediately if the device is connected via WS, otherwise queued for polling.
+// With wait, block until the device acknowledges it or the timeout expires.
 func (h *CommandHandler) Enqueue(c *gin.Context) {
+	var wait time.Duration
+	if v := c.Query("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > usecases.MaxCommandWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a positive duration up to " + usecases.MaxCommandWait.String()})
+			return
+		}
+		wait = d
+	}
+
 	var req enqueueReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
 		return
 	}
 
-	cmd, err := h.cmdUC.Enqueue(req.DeviceID, req.DeviceModuleID, req.Command, req.Params)
+	if err := h.authz.CommandTarget(CurrentPrincipal(c), req.DeviceID, req.DeviceModuleID); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	cmd, err := h.cmdUC.Dispatch(req.DeviceID, req.DeviceModuleID, req.Command, req.Params, usecases.EnqueueOptions{
+		AckTimeout:   time.Duration(req.AckTimeout) * time.Second,
+		TTL:          time.Duration(req.TTL) * time.Second,
+		SupersedeKey: req.SupersedeKey,
+		Priority:     req.Priority,
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondEnqueueError(c, err)
 		return
 	}
 
+	// Pushed right away if the device is connected via WS, queued otherwise
 	status := "queued"
-	// Try to send via WS if connected
-	if h.wsMgr != nil && h.wsMgr.IsConnected(req.DeviceID) {
-		env := map[string]interface{}{
-			"type":             "command",
-			"command_id":       cmd.ID,
-			"device_module_id": req.DeviceModuleID,
-			"command":          req.Command,
-			"params":           req.Params,
-			"timestamp":        time.Now().UTC().Format(time.RFC3339Nano),
-		}
-		b, _ := json.Marshal(env)
-		if err := h.wsMgr.SendToDevice(req.DeviceID, b); err == nil {
-			_ = h.cmdUC.MarkSent([]string{cmd.ID})
-			status = "sent"
-		}
+	if cmd.Status == entities.CommandStatusSent {
+		status = "sent"
+	}
+
+	if wait > 0 {
+		h.waitForResult(c, cmd.ID, status == "sent", wait)
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "command": usecases.ToCommandView(cmd)})
+}
 
-	c.JSON(http.StatusOK, gin.H{"status": status, "command": cmd})
+// waitForResult blocks the request until the command is final and writes it out.
+func (h *CommandHandler) waitForResult(c *gin.Context, commandID string, pushed bool, wait time.Duration) {
+	cmd, err := h.cmdUC.WaitForResult(c.Request.Context(), commandID, wait)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"status": cmd.Status, "command": usecases.ToCommandView(cmd)})
+	case errors.Is(err, usecases.ErrWaitTimeout):
+		msg := err.Error()
+		if !pushed {
+			msg = "device is offline; the command stays queued until it connects or polls"
+		}
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": msg, "status": cmd.Status, "command": usecases.ToCommandView(cmd)})
+	case errors.Is(err, usecases.ErrShuttingDown):
+		// The command itself is unaffected; the client can look it up again
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "status": cmd.Status, "command": usecases.ToCommandView(cmd)})
+	case errors.Is(err, usecases.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		// Client went away; nothing to write
+		c.Abort()
+	}
 }
 
-// GET /api/v1/commands/poll?device_id=...&limit=...
-// Devices call this to fetch pending commands when WS isn't available
+// GET /api/v1/commands/poll?device_id=...&limit=...[&wait=30s]
+// Devices call this to fetch pending commands when WS isn't available.
+// With wait, the request is held until a command arrives or the wait runs
+// out, in which case the response is empty.
 func (h *CommandHandler) Poll(c *gin.Context) {
 	deviceID := c.Query("device_id")
+	if deviceID == "" {
+		deviceID = CurrentDeviceID(c)
+	}
 	if deviceID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id required"})
 		return
 	}
+	if !requireDevice(c, deviceID) {
+		return
+	}
 	// optional limit
 	limit := 10
 	if l := c.Query("limit"); l != "" {
@@ -79,41 +129,54 @@ func (h *CommandHandler) Poll(c *gin.Context) {
 			limit = v
 		}
 	}
-	cmds, err := h.cmdUC.Poll(deviceID, limit)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Polled commands are marked sent so they aren't re-delivered endlessly
+	cmds, ok := h.pollCommands(c, deviceID, limit)
+	if !ok {
 		return
 	}
-	// mark as sent so they aren't re-delivered endlessly
-	ids := make([]string, 0, len(cmds))
-	safe := make([]map[string]interface{}, 0, len(cmds))
-	for _, c0 := range cmds {
-		ids = append(ids, c0.ID)
-		// parse params JSON
-		var p interface{}
-		if c0.Params != "" && json.Valid([]byte(c0.Params)) {
-			_ = json.Unmarshal([]byte(c0.Params), &p)
-		} else {
-			p = map[string]interface{}{}
+	c.JSON(http.StatusOK, gin.H{"data": cmds, "count": len(cmds)})
+}
+
+// pollCommands claims the device's due commands, holding the request for up
+// to ?wait= until one arrives. It writes the error response itself.
+func (h *CommandHandler) pollCommands(c *gin.Context, deviceID string, limit int) ([]usecases.CommandEnvelope, bool) {
+	var wait time.Duration
+	if v := c.Query("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > usecases.MaxCommandWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a duration up to " + usecases.MaxCommandWait.String()})
+			return nil, false
+		}
+		wait = d
+	}
+
+	var cmds []usecases.CommandEnvelope
+	var err error
+	if wait > 0 {
+		cmds, err = h.cmdUC.WaitForCommands(c.Request.Context(), deviceID, limit, wait)
+	} else {
+		cmds, err = h.cmdUC.Poll(deviceID, limit)
+	}
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			// Client went away; nothing to write
+			c.Abort()
+			return nil, false
 		}
-		safe = append(safe, map[string]interface{}{
-			"id":               c0.ID,
-			"type":             "command",
-			"device_module_id": c0.DeviceModuleID,
-			"command":          c0.Command,
-			"params":           p,
-			"timestamp":        time.Now().UTC().Format(time.RFC3339Nano),
-		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
 	}
-	_ = h.cmdUC.MarkSent(ids)
-	c.JSON(http.StatusOK, gin.H{"data": safe, "count": len(safe)})
+	return cmds, true
 }
 
-// GET /api/v1/devices/:id/commands?status=pending
+// GET /api/v1/devices/:id/commands?status=pending[&wait=30s]
 // REST endpoint for fetching device commands
 func (h *CommandHandler) GetDeviceCommands(c *gin.Context) {
 	deviceID := c.Param("id")
 	status := c.DefaultQuery("status", "pending")
+	if !requireDevice(c, deviceID) {
+		return
+	}
 
 	// optional limit
 	limit := 10
@@ -129,41 +192,143 @@ func (h *CommandHandler) GetDeviceCommands(c *gin.Context) {
 		return
 	}
 
-	cmds, err := h.cmdUC.Poll(deviceID, limit)
+	cmds, ok := h.pollCommands(c, deviceID, limit)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": cmds, "count": len(cmds)})
+}
+
+// GET /api/v1/commands?device_id=&device_module_id=&batch_id=&status=&command=&from=&to=&cursor=&limit=
+// Read-only command history, newest first. status may be a comma-separated list;
+// from/to are RFC3339 bounds on created_at.
+func (h *CommandHandler) ListCommands(c *gin.Context) {
+	p := CurrentPrincipal(c)
+	q := usecases.CommandQuery{
+		DeviceID:       c.Query("device_id"),
+		DeviceModuleID: c.Query("device_module_id"),
+		BatchID:        c.Query("batch_id"),
+		Command:        c.Query("command"),
+		Cursor:         c.Query("cursor"),
+	}
+	if status := c.Query("status"); status != "" {
+		q.Statuses = strings.Split(status, ",")
+	}
+	for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC3339 timestamp"})
+				return
+			}
+			*dst = t
+		}
+	}
+	if l := c.Query("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		q.Limit = v
+	}
+
+	var deviceIDs []string
+	if q.DeviceID != "" {
+		if _, err := h.authz.Device(p, q.DeviceID, usecases.AccessRead); err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+	} else {
+		ids, err := h.authz.ReadableDeviceIDs(p)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve accessible devices"})
+			return
+		}
+		deviceIDs = ids
+	}
+
+	cmds, next, err := h.cmdUC.ListCommands(deviceIDs, q)
+	if err != nil {
+		if errors.Is(err, usecases.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list commands"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": cmds, "count": len(cmds), "next_cursor": next})
+}
+
+// GET /api/v1/commands/:id
+// A single command with its params and the device's response
+func (h *CommandHandler) GetCommand(c *gin.Context) {
+	cmd, err := h.cmdUC.GetCommand(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondAuthzError(c, err)
+		return
+	}
+	if _, err := h.authz.Device(CurrentPrincipal(c), cmd.DeviceID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": usecases.ToCommandView(cmd)})
+}
+
+// GET /api/v1/device-modules/:id/commands
+// Commands the module declares, with their parameter schemas, for building UIs
+func (h *CommandHandler) GetModuleCommands(c *gin.Context) {
+	module, err := h.authz.Module(CurrentPrincipal(c), c.Param("id"), usecases.AccessRead)
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	specs, err := h.cmdUC.ModuleCommands(module)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "module has an invalid command schema", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": specs, "count": len(specs)})
+}
+
+// respondEnqueueError maps schema violations to 422 with per-field details.
+func respondEnqueueError(c *gin.Context, err error) {
+	var verr *usecases.CommandValidationError
+	if errors.As(err, &verr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid command", "details": verr.Errors})
 		return
 	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
 
-	// mark as sent and format response
-	ids := make([]string, 0, len(cmds))
-	safe := make([]map[string]interface{}, 0, len(cmds))
-	for _, c0 := range cmds {
-		ids = append(ids, c0.ID)
-		// parse params JSON
-		var p interface{}
-		if c0.Params != "" && json.Valid([]byte(c0.Params)) {
-			_ = json.Unmarshal([]byte(c0.Params), &p)
-		} else {
-			p = map[string]interface{}{}
+// POST /api/v1/commands/:id/cancel
+// Withdraw a pending or sent command
+func (h *CommandHandler) CancelCommand(c *gin.Context) {
+	cmd, err := h.cmdUC.GetCommand(c.Param("id"))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	if _, err := h.authz.Device(CurrentPrincipal(c), cmd.DeviceID, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	cmd, err = h.cmdUC.Cancel(cmd.ID)
+	if err != nil {
+		if errors.Is(err, usecases.ErrNotCancellable) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
 		}
-		safe = append(safe, map[string]interface{}{
-			"id":               c0.ID,
-			"command":          c0.Command,
-			"device_module_id": c0.DeviceModuleID,
-			"module_type":      "",
-			"status":           "pending",
-			"params":           p,
-		})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel command"})
+		return
 	}
-	_ = h.cmdUC.MarkSent(ids)
-	c.JSON(http.StatusOK, gin.H{"data": safe, "count": len(safe)})
+	c.JSON(http.StatusOK, gin.H{"status": cmd.Status, "data": usecases.ToCommandView(cmd)})
 }
 
 type ackReq struct {
-	CommandID string `json:"command_id"`
-	Status    string `json:"status"`
-	Message   string `json:"message"`
+	usecases.CommandResponse
+	Message string `json:"message"` // legacy free-text response
 }
 
 // POST /api/v1/command-responses
@@ -174,21 +339,42 @@ func (h *CommandHandler) Ack(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
 		return
 	}
-	resp := req.Message
-	// store as simple JSON string
-	if resp == "" {
-		resp = "{}"
-	} else {
-		b, _ := json.Marshal(map[string]string{"message": resp})
-		resp = string(b)
+	if CurrentDeviceID(c) == "" {
+		// Legacy request without credentials: act as the command's device, if it has no secret
+		cmd, err := h.cmdUC.GetCommand(req.CommandID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+			return
+		}
+		if !requireDevice(c, cmd.DeviceID) {
+			return
+		}
 	}
-	if err := h.cmdUC.Ack(req.CommandID, req.Status, resp); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if req.Message == "" || len(req.Result) > 0 || req.Error != "" {
+		if err := h.cmdUC.Respond(CurrentDeviceID(c), req.CommandResponse); err != nil {
+			respondAckError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	// Legacy free-text response, stored as {"message": "..."}
+	b, _ := json.Marshal(map[string]string{"message": req.Message})
+	if err := h.cmdUC.Ack(CurrentDeviceID(c), req.CommandID, req.Status, string(b)); err != nil {
+		respondAckError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
+func respondAckError(c *gin.Context, err error) {
+	if errors.Is(err, usecases.ErrCommandFinished) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
 type changeWiFiReq struct {
 	DeviceID string `json:"device_id" binding:"required"`
 	SSID     string `json:"ssid" binding:"required"`
@@ -209,35 +395,27 @@ func (h *CommandHandler) ChangeWiFiCredentials(c *gin.Context) {
 	// Override deviceID from URL param
 	req.DeviceID = deviceID
 
+	if err := h.authz.CommandTarget(CurrentPrincipal(c), req.DeviceID, ""); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	// Create command params
 	params := map[string]interface{}{
 		"ssid":     req.SSID,
 		"password": req.Password,
 	}
 
-	// Enqueue CHANGE_WIFI command
-	cmd, err := h.cmdUC.Enqueue(req.DeviceID, "", "CHANGE_WIFI", params)
+	// Dispatch CHANGE_WIFI command
+	cmd, err := h.cmdUC.Dispatch(req.DeviceID, "", "CHANGE_WIFI", params, usecases.EnqueueOptions{})
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	status := "queued"
-	// Try to send via WS if connected
-	if h.wsMgr != nil && h.wsMgr.IsConnected(req.DeviceID) {
-		env := map[string]interface{}{
-			"type":             "command",
-			"command_id":       cmd.ID,
-			"device_module_id": cmd.DeviceModuleID,
-			"command":          cmd.Command,
-			"params":           params,
-			"timestamp":        time.Now().UTC().Format(time.RFC3339Nano),
-		}
-		b, _ := json.Marshal(env)
-		if err := h.wsMgr.SendToDevice(req.DeviceID, b); err == nil {
-			_ = h.cmdUC.MarkSent([]string{cmd.ID})
-			status = "sent"
-		}
+	if cmd.Status == entities.CommandStatusSent {
+		status = "sent"
 	}
 
 	c.JSON(http.StatusOK, gin.H{
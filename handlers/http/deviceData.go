@@ -1,8 +1,12 @@
 package httpHandler
 
 import (
+	"errors"
 	"iot-server/entities"
+	"iot-server/usecases"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,7 +22,15 @@ func (h *DeviceHandler) CreateDeviceData(c *gin.Context) {
 		return
 	}
 
+	if !requireDevice(c, data.DeviceID) {
+		return
+	}
+
 	if err := h.useCase.CreateDeviceData(&data); err != nil {
+		if errors.Is(err, usecases.ErrModuleNotOwned) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
@@ -34,11 +46,9 @@ func (h *DeviceHandler) CreateDeviceData(c *gin.Context) {
 func (h *DeviceHandler) GetDeviceData(c *gin.Context) {
 	id := c.Param("id")
 
-	data, err := h.useCase.GetDeviceData(id)
+	data, err := h.authz.DeviceData(CurrentPrincipal(c), id, usecases.AccessRead)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Device data not found",
-		})
+		respondAuthzError(c, err)
 		return
 	}
 
@@ -47,38 +57,101 @@ func (h *DeviceHandler) GetDeviceData(c *gin.Context) {
 	})
 }
 
+// GetAllDeviceData handles GET /api/v1/device-data?device_id=&module_id=&from=&to=&cursor=&limit=
+// Telemetry across all devices, newest device timestamp first.
 func (h *DeviceHandler) GetAllDeviceData(c *gin.Context) {
-	data, err := h.useCase.GetAllDeviceData()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to retrieve device data",
-		})
+	q, ok := parseDeviceDataQuery(c)
+	if !ok {
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"data":  data,
-		"count": len(data),
-	})
+	q.DeviceID = c.Query("device_id")
+	h.listDeviceData(c, q)
 }
 
+// GetDeviceDataByDeviceID handles GET /api/v1/devices/:id/data?module_id=&from=&to=&cursor=&limit=
 func (h *DeviceHandler) GetDeviceDataByDeviceID(c *gin.Context) {
 	deviceID := c.Param("id")
 
-	data, err := h.useCase.GetDeviceDataByDeviceID(deviceID)
+	if _, err := h.authz.Device(CurrentPrincipal(c), deviceID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	q, ok := parseDeviceDataQuery(c)
+	if !ok {
+		return
+	}
+	q.DeviceID = deviceID
+	h.listDeviceData(c, q)
+}
+
+func (h *DeviceHandler) listDeviceData(c *gin.Context, q usecases.DeviceDataQuery) {
+	data, next, err := h.useCase.ListDeviceData(q)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+		if errors.Is(err, usecases.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve device data",
 		})
 		return
 	}
 
+	nextURL := ""
+	if next != "" {
+		nextURL = nextPageURL(c, next)
+		c.Header("Link", "<"+nextURL+">; rel=\"next\"")
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"data":  data,
-		"count": len(data),
+		"data":        data,
+		"count":       len(data),
+		"next_cursor": next,
+		"links":       gin.H{"next": nextURL},
 	})
 }
 
+// parseDeviceDataQuery reads the module_id, from/to (RFC3339, to exclusive),
+// cursor and limit parameters shared by the telemetry listings.
+func parseDeviceDataQuery(c *gin.Context) (usecases.DeviceDataQuery, bool) {
+	q := usecases.DeviceDataQuery{
+		DeviceModuleID: c.Query("module_id"),
+		Cursor:         c.Query("cursor"),
+	}
+	for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC3339 timestamp"})
+				return q, false
+			}
+			*dst = t
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return q, false
+	}
+	if l := c.Query("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return q, false
+		}
+		q.Limit = v
+	}
+	return q, true
+}
+
+// nextPageURL is the current request URL with its cursor replaced.
+func nextPageURL(c *gin.Context, cursor string) string {
+	u := *c.Request.URL
+	query := u.Query()
+	query.Set("cursor", cursor)
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
 func (h *DeviceHandler) UpdateDeviceData(c *gin.Context) {
 	id := c.Param("id")
 
@@ -91,6 +164,11 @@ func (h *DeviceHandler) UpdateDeviceData(c *gin.Context) {
 		return
 	}
 
+	if _, err := h.authz.DeviceData(CurrentPrincipal(c), id, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	data.ID = id
 
 	if err := h.useCase.UpdateDeviceData(&data); err != nil {
@@ -109,6 +187,11 @@ func (h *DeviceHandler) UpdateDeviceData(c *gin.Context) {
 func (h *DeviceHandler) DeleteDeviceData(c *gin.Context) {
 	id := c.Param("id")
 
+	if _, err := h.authz.DeviceData(CurrentPrincipal(c), id, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	if err := h.useCase.DeleteDeviceData(id); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -1,20 +1,26 @@
 package httpHandler
 
 import (
+	"errors"
 	"iot-server/entities"
 	"iot-server/usecases"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type DeviceModuleHandler struct {
 	useCase *usecases.DeviceUseCase
+	authz   *usecases.Authorizer
 }
 
-func NewDeviceModuleHandler(useCase *usecases.DeviceUseCase) *DeviceModuleHandler {
+func NewDeviceModuleHandler(useCase *usecases.DeviceUseCase, authz *usecases.Authorizer) *DeviceModuleHandler {
 	return &DeviceModuleHandler{
 		useCase: useCase,
+		authz:   authz,
 	}
 }
 
@@ -30,6 +36,16 @@ func (h *DeviceModuleHandler) CreateDeviceModule(c *gin.Context) {
 		return
 	}
 
+	if !requireDevice(c, module.DeviceID) {
+		return
+	}
+	// Modules registered by a device belong to the device's owner
+	if deviceID := CurrentDeviceID(c); deviceID != "" {
+		if device, err := h.useCase.GetDevice(deviceID); err == nil {
+			module.UserID = device.UserID
+		}
+	}
+
 	if err := h.useCase.CreateDeviceModule(&module); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -47,11 +63,9 @@ func (h *DeviceModuleHandler) CreateDeviceModule(c *gin.Context) {
 func (h *DeviceModuleHandler) GetDeviceModule(c *gin.Context) {
 	id := c.Param("id")
 
-	module, err := h.useCase.GetDeviceModule(id)
+	module, err := h.authz.Module(CurrentPrincipal(c), id, usecases.AccessRead)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Device module not found",
-		})
+		respondAuthzError(c, err)
 		return
 	}
 
@@ -60,7 +74,7 @@ func (h *DeviceModuleHandler) GetDeviceModule(c *gin.Context) {
 	})
 }
 
-// GetAllDeviceModules handles GET /api/v1/device-modules
+// GetAllDeviceModules handles GET /api/v1/device-modules (admin only)
 func (h *DeviceModuleHandler) GetAllDeviceModules(c *gin.Context) {
 	modules, err := h.useCase.GetAllDeviceModules()
 	if err != nil {
@@ -78,7 +92,10 @@ func (h *DeviceModuleHandler) GetAllDeviceModules(c *gin.Context) {
 
 // GetDeviceModulesByUserID handles GET /api/v1/users/:user_id/device-modules
 func (h *DeviceModuleHandler) GetDeviceModulesByUserID(c *gin.Context) {
-	userID := c.Param("user_id")
+	userID, ok := resolveUserParam(c)
+	if !ok {
+		return
+	}
 
 	modules, err := h.useCase.GetDeviceModulesByUserID(userID)
 	if err != nil {
@@ -88,15 +105,30 @@ func (h *DeviceModuleHandler) GetDeviceModulesByUserID(c *gin.Context) {
 		return
 	}
 
+	// Honour an API key's device allow-list
+	principal := CurrentPrincipal(c)
+	allowed := modules[:0]
+	for _, m := range modules {
+		if principal.AllowsDevice(m.DeviceID) {
+			allowed = append(allowed, m)
+		}
+	}
+	modules = allowed
+
 	c.JSON(http.StatusOK, gin.H{
 		"data":  modules,
 		"count": len(modules),
 	})
 }
 
-// GetDeviceModulesByDeviceID handles GET /api/v1/devices/:device_id/modules
+// GetDeviceModulesByDeviceID handles GET /api/v1/devices/:id/modules
 func (h *DeviceModuleHandler) GetDeviceModulesByDeviceID(c *gin.Context) {
-	deviceID := c.Param("device_id")
+	deviceID := c.Param("id")
+
+	if _, err := h.authz.Device(CurrentPrincipal(c), deviceID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
 
 	modules, err := h.useCase.GetDeviceModulesByDeviceID(deviceID)
 	if err != nil {
@@ -125,6 +157,23 @@ func (h *DeviceModuleHandler) UpdateDeviceModule(c *gin.Context) {
 		return
 	}
 
+	if _, err := h.authz.Module(CurrentPrincipal(c), id, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	// Moving a module requires access to the target device; ownership changes are admin only
+	principal := CurrentPrincipal(c)
+	if module.DeviceID != "" {
+		if _, err := h.authz.Device(principal, module.DeviceID, usecases.AccessWrite); err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+	}
+	if !principal.IsAdmin() {
+		module.UserID = ""
+	}
+
 	module.ID = id
 
 	if err := h.useCase.UpdateDeviceModule(&module); err != nil {
@@ -144,6 +193,11 @@ func (h *DeviceModuleHandler) UpdateDeviceModule(c *gin.Context) {
 func (h *DeviceModuleHandler) DeleteDeviceModule(c *gin.Context) {
 	id := c.Param("id")
 
+	if _, err := h.authz.Module(CurrentPrincipal(c), id, usecases.AccessWrite); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	if err := h.useCase.DeleteDeviceModule(id); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -158,7 +212,10 @@ func (h *DeviceModuleHandler) DeleteDeviceModule(c *gin.Context) {
 
 // GetDevicesByUserID handles GET /api/v1/users/:user_id/devices
 func (h *DeviceModuleHandler) GetDevicesByUserID(c *gin.Context) {
-	userID := c.Param("user_id")
+	userID, ok := resolveUserParam(c)
+	if !ok {
+		return
+	}
 
 	devices, err := h.useCase.GetDevicesByUserID(userID)
 	if err != nil {
@@ -168,6 +225,16 @@ func (h *DeviceModuleHandler) GetDevicesByUserID(c *gin.Context) {
 		return
 	}
 
+	// Honour an API key's device allow-list
+	principal := CurrentPrincipal(c)
+	allowed := devices[:0]
+	for _, d := range devices {
+		if principal.AllowsDevice(d.ID) {
+			allowed = append(allowed, d)
+		}
+	}
+	devices = allowed
+
 	c.JSON(http.StatusOK, gin.H{
 		"data":  devices,
 		"count": len(devices),
@@ -178,6 +245,11 @@ func (h *DeviceModuleHandler) GetDevicesByUserID(c *gin.Context) {
 func (h *DeviceModuleHandler) GetLatestReading(c *gin.Context) {
 	moduleID := c.Param("id")
 
+	if _, err := h.authz.Module(CurrentPrincipal(c), moduleID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
 	data, err := h.useCase.GetLatestDeviceDataByModuleID(moduleID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
@@ -190,3 +262,84 @@ func (h *DeviceModuleHandler) GetLatestReading(c *gin.Context) {
 		"data": data,
 	})
 }
+
+// AggregateReadings handles GET /api/v1/device-modules/:id/aggregate?field=&bucket=&fn=&from=&to=&origin=&fill=
+// field is a dot-separated path into the reading's JSON (e.g. env.temperature),
+// bucket a duration such as 15m, 1h or 1d (whole days above 1d), fn a
+// comma-separated list of avg, min, max, count, first and last. Buckets start
+// at origin plus whole buckets; it defaults to a Monday UTC midnight, so days
+// start at 00:00 UTC and weeks on Monday. fill=true also returns empty buckets.
+func (h *DeviceModuleHandler) AggregateReadings(c *gin.Context) {
+	moduleID := c.Param("id")
+
+	if _, err := h.authz.Module(CurrentPrincipal(c), moduleID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	q := usecases.AggregateQuery{DeviceModuleID: moduleID}
+	if field := c.Query("field"); field != "" {
+		q.FieldPath = strings.Split(field, ".")
+	}
+	bucket, err := parseBucketSize(c.DefaultQuery("bucket", "1h"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be a duration such as 15m, 1h or 1d"})
+		return
+	}
+	q.Bucket = bucket
+	if fn := c.Query("fn"); fn != "" {
+		q.Functions = strings.Split(fn, ",")
+	}
+	for name, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To, "origin": &q.Origin} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC3339 timestamp"})
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := c.Query("fill"); v != "" {
+		fill, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fill must be true or false"})
+			return
+		}
+		q.FillGaps = fill
+	}
+
+	buckets, q, err := h.useCase.AggregateDeviceData(q)
+	if err != nil {
+		if errors.Is(err, usecases.ErrInvalidAggregation) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to aggregate device data"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      buckets,
+		"count":     len(buckets),
+		"module_id": moduleID,
+		"field":     strings.Join(q.FieldPath, "."),
+		"bucket":    q.Bucket.String(),
+		"origin":    q.Origin.Format(time.RFC3339),
+		"functions": q.Functions,
+		"from":      q.From.Format(time.RFC3339),
+		"to":        q.To.Format(time.RFC3339),
+	})
+}
+
+// parseBucketSize accepts Go durations plus a whole number of days ("1d").
+func parseBucketSize(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid bucket")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
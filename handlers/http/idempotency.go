@@ -0,0 +1,113 @@
+package httpHandler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"iot-server/usecases"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	headerIdempotencyReplayed = "Idempotent-Replayed"
+)
+
+// Idempotency scopes; WebSocket telemetry shares the device-data scope so a
+// message retried over HTTP after WS (or vice versa) is still recognised.
+const (
+	IdempotencyScopeCommands   = "commands"
+	IdempotencyScopeDeviceData = "device-data"
+	IdempotencyScopeMacroRuns  = "macro-runs"
+)
+
+// responseRecorder keeps a copy of the response body written by the handler.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response when a request repeats an
+// Idempotency-Key already used by the same caller. Requests without the
+// header pass straight through. scope namespaces the keys per endpoint; the
+// caller (device, or user) is appended so keys never collide across callers.
+// The method and path are fingerprinted with the body, so reusing a key for a
+// different resource is rejected rather than replayed.
+func Idempotency(uc *usecases.IdempotencyUseCase, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(HeaderIdempotencyKey)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...)
+		rec, fresh, err := uc.Begin(IdempotencyScope(c, scope), key, fingerprint)
+		switch {
+		case errors.Is(err, usecases.ErrIdempotencyInProgress):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, usecases.ErrIdempotencyMismatch):
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !fresh {
+			c.Header(headerIdempotencyReplayed, "true")
+			if rec.StatusCode == 0 {
+				// Claimed by a WebSocket message, which leaves no response to replay
+				c.AbortWithStatusJSON(http.StatusOK, gin.H{"message": "Request was already processed"})
+				return
+			}
+			c.Data(rec.StatusCode, "application/json; charset=utf-8", []byte(rec.Response))
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Server errors (and requests abandoned by the client) may be retried.
+		// A 504 from ?wait still queued the command, so it is kept.
+		status := recorder.Status()
+		if recorder.body.Len() == 0 || (status >= 500 && status != http.StatusGatewayTimeout) {
+			uc.Abandon(rec)
+			return
+		}
+		uc.Complete(rec, status, recorder.body.Bytes())
+	}
+}
+
+// IdempotencyScope namespaces keys by endpoint and caller.
+func IdempotencyScope(c *gin.Context, scope string) string {
+	if id := CurrentDeviceID(c); id != "" {
+		return scope + ":device:" + id
+	}
+	if id := CurrentUserID(c); id != "" {
+		return scope + ":user:" + id
+	}
+	return scope + ":anonymous"
+}
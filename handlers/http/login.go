@@ -1,21 +1,23 @@
 package httpHandler
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"iot-server/auth"
 	"iot-server/entities"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type LoginHandler struct {
-	db *gorm.DB
+	db     *gorm.DB
+	tokens *auth.TokenManager
 }
 
-func NewLoginHandler(db *gorm.DB) *LoginHandler {
-	return &LoginHandler{db: db}
+func NewLoginHandler(db *gorm.DB, tokens *auth.TokenManager) *LoginHandler {
+	return &LoginHandler{db: db, tokens: tokens}
 }
 
 type LoginRequest struct {
@@ -24,18 +26,21 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
-	Success  bool   `json:"success"`
+	UserID           string `json:"user_id"`
+	Username         string `json:"username"`
+	Success          bool   `json:"success"`
+	Token            string `json:"token"`
+	TokenType        string `json:"token_type"`
+	ExpiresAt        string `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt string `json:"refresh_expires_at"`
 }
 
-// hashPassword creates SHA-256 hash of password (matching Python backend)
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
-// Login authenticates user and returns user_id
+// Login authenticates user and returns user_id plus a session token pair
 func (h *LoginHandler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -52,17 +57,80 @@ func (h *LoginHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Verify password hash
-	hashedPassword := hashPassword(req.Password)
-	if user.PasswordHash != hashedPassword {
+	// Verify password hash (argon2id, or a legacy unsalted SHA-256 digest)
+	ok, needsRehash := auth.VerifyPassword(user.PasswordHash, req.Password)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
 		return
 	}
 
-	// Return user_id
+	// Transparently upgrade legacy SHA-256 and weaker argon2id hashes
+	if needsRehash {
+		h.rehashPassword(&user, req.Password)
+	}
+
+	h.respondWithTokens(c, &user)
+}
+
+// rehashPassword replaces the stored hash with a fresh argon2id hash.
+// Failures are logged only; the login itself already succeeded.
+func (h *LoginHandler) rehashPassword(user *entities.User, password string) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("failed to rehash password for user %s: %v", user.ID, err)
+		return
+	}
+	err = h.db.Model(&entities.User{}).Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+		Updates(map[string]interface{}{
+			"password_hash": hash,
+			"updated_at":    time.Now().UTC().Format(time.RFC3339),
+		}).Error
+	if err != nil {
+		log.Printf("failed to store upgraded password hash for user %s: %v", user.ID, err)
+		return
+	}
+	user.PasswordHash = hash
+}
+
+// Refresh exchanges a valid refresh token for a new token pair
+func (h *LoginHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	claims, err := h.tokens.Parse(req.RefreshToken, auth.TokenTypeRefresh)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	// Make sure the account still exists, and the password is unchanged, before minting new tokens
+	var user entities.User
+	if err := h.db.Where("id = ?", claims.Subject).First(&user).Error; err != nil || user.TokenVersion != claims.Version {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	h.respondWithTokens(c, &user)
+}
+
+func (h *LoginHandler) respondWithTokens(c *gin.Context, user *entities.User) {
+	pair, err := h.tokens.IssuePair(user.ID, user.Username, user.Role, user.TokenVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
+		return
+	}
+
 	c.JSON(http.StatusOK, LoginResponse{
-		UserID:   user.ID,
-		Username: user.Username,
-		Success:  true,
+		UserID:           user.ID,
+		Username:         user.Username,
+		Success:          true,
+		Token:            pair.AccessToken,
+		TokenType:        "Bearer",
+		ExpiresAt:        pair.AccessExpiresAt.Format(time.RFC3339),
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresAt: pair.RefreshExpiresAt.Format(time.RFC3339),
 	})
 }
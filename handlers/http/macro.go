@@ -0,0 +1,154 @@
+package httpHandler
+
+import (
+	"iot-server/usecases"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MacroHandler struct {
+	useCase *usecases.MacroUseCase
+}
+
+func NewMacroHandler(useCase *usecases.MacroUseCase) *MacroHandler {
+	return &MacroHandler{
+		useCase: useCase,
+	}
+}
+
+// CreateMacro handles POST /api/v1/macros
+// { "name": "leave home", "steps": [{ "device_id": "...", "command": "CLOSE_DOOR", "delay_seconds": 10, "continue_on_failure": true }] }
+func (h *MacroHandler) CreateMacro(c *gin.Context) {
+	var req usecases.MacroInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	macro, err := h.useCase.Create(CurrentPrincipal(c), req)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Macro created successfully",
+		"data":    usecases.RedactMacro(*macro),
+	})
+}
+
+// GetMacros handles GET /api/v1/macros
+func (h *MacroHandler) GetMacros(c *gin.Context) {
+	macros, err := h.useCase.List(CurrentPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve macros",
+		})
+		return
+	}
+
+	for i := range macros {
+		macros[i] = usecases.RedactMacro(macros[i])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":  macros,
+		"count": len(macros),
+	})
+}
+
+// GetMacro handles GET /api/v1/macros/:id
+func (h *MacroHandler) GetMacro(c *gin.Context) {
+	macro, err := h.useCase.Get(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": usecases.RedactMacro(*macro),
+	})
+}
+
+// UpdateMacro handles PUT /api/v1/macros/:id, replacing name, description and steps
+func (h *MacroHandler) UpdateMacro(c *gin.Context) {
+	var req usecases.MacroInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	macro, err := h.useCase.Update(CurrentPrincipal(c), c.Param("id"), req)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Macro updated successfully",
+		"data":    usecases.RedactMacro(*macro),
+	})
+}
+
+// DeleteMacro handles DELETE /api/v1/macros/:id
+func (h *MacroHandler) DeleteMacro(c *gin.Context) {
+	if err := h.useCase.Delete(CurrentPrincipal(c), c.Param("id")); err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Macro deleted successfully",
+	})
+}
+
+// RunMacro handles POST /api/v1/macros/:id/run
+// The macro runs in the background; poll the returned execution for progress.
+func (h *MacroHandler) RunMacro(c *gin.Context) {
+	execution, err := h.useCase.Run(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Macro started",
+		"data":    execution,
+	})
+}
+
+// GetMacroExecutions handles GET /api/v1/macros/:id/executions?limit=50
+// Runs of the macro with per-step outcomes, newest first
+func (h *MacroHandler) GetMacroExecutions(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	executions, err := h.useCase.Executions(CurrentPrincipal(c), c.Param("id"), limit)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  executions,
+		"count": len(executions),
+	})
+}
+
+// GetMacroExecution handles GET /api/v1/macro-executions/:id
+func (h *MacroHandler) GetMacroExecution(c *gin.Context) {
+	execution, err := h.useCase.GetExecution(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": execution,
+	})
+}
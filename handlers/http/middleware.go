@@ -0,0 +1,268 @@
+package httpHandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"iot-server/auth"
+	"iot-server/usecases"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by AuthMiddleware
+const (
+	ctxUserID   = "auth_user_id"
+	ctxUsername = "auth_username"
+	ctxRole     = "auth_role"
+	ctxDeviceID = "auth_device_id"
+	ctxAPIKey   = "auth_api_key"
+	// set for credential-less device requests in legacy mode; requireDevice resolves them
+	ctxLegacyDevices = "auth_legacy_devices"
+)
+
+// Headers carrying device credentials
+const (
+	HeaderDeviceID  = "X-Device-ID"
+	HeaderDeviceKey = "X-Device-Key"
+)
+
+// secretQueryParams are replaced with "REDACTED" in access logs.
+var secretQueryParams = []string{"key", "token"}
+
+// RequestLogger is gin's access logger with secrets stripped from query strings.
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if p.IsOutputColor() {
+			statusColor, methodColor, resetColor = p.StatusCodeColor(), p.MethodColor(), p.ResetColor()
+		}
+		if p.Latency > time.Minute {
+			p.Latency = p.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, p.StatusCode, resetColor,
+			p.Latency,
+			p.ClientIP,
+			methodColor, p.Method, resetColor,
+			redactQuery(p.Path),
+			p.ErrorMessage,
+		)
+	})
+}
+
+// redactQuery masks the values of secretQueryParams in a logged request path.
+func redactQuery(path string) string {
+	base, rawQuery, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return base + "?REDACTED"
+	}
+	redacted := false
+	for _, name := range secretQueryParams {
+		if _, found := query[name]; found {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return path
+	}
+	return base + "?" + query.Encode()
+}
+
+// AuthMiddleware requires a valid "Authorization: Bearer <access token | api key>"
+// header and stores the caller's identity in the gin context.
+func AuthMiddleware(tokens *auth.TokenManager, apiKeys *usecases.APIKeyUseCase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		scheme, token, ok := strings.Cut(header, " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+
+		if strings.HasPrefix(token, auth.APIKeyPrefix) {
+			principal, err := apiKeys.Authenticate(token)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			c.Set(ctxUserID, principal.UserID)
+			c.Set(ctxRole, principal.Role)
+			c.Set(ctxAPIKey, principal)
+			c.Next()
+			return
+		}
+
+		claims, err := tokens.Parse(token, auth.TokenTypeAccess)
+		if err != nil {
+			msg := "invalid token"
+			switch {
+			case errors.Is(err, auth.ErrExpiredToken):
+				msg = "token expired"
+			case errors.Is(err, auth.ErrRevokedToken):
+				msg = "token revoked"
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+			return
+		}
+
+		c.Set(ctxUserID, claims.Subject)
+		c.Set(ctxUsername, claims.Username)
+		c.Set(ctxRole, claims.Role)
+		c.Next()
+	}
+}
+
+// RequireScope rejects API keys that were not granted scope. User sessions always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !CurrentPrincipal(c).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSession rejects API keys, for account management routes.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentPrincipal(c).IsAPIKey() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this endpoint requires a user session"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin rejects callers without the admin role. Must run after AuthMiddleware.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !CurrentPrincipal(c).IsAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// DeviceAuthMiddleware authenticates device-facing requests with the
+// X-Device-ID / X-Device-Key headers. When allowLegacy is set, requests
+// without a key are let through so devices registered before secrets existed
+// keep working until re-provisioned; requireDevice then only accepts them for
+// a device that has no secret.
+func DeviceAuthMiddleware(uc *usecases.DeviceUseCase, allowLegacy bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderDeviceID)
+		key := c.GetHeader(HeaderDeviceKey)
+		if key == "" && allowLegacy {
+			if id != "" {
+				device, err := uc.AuthenticateLegacyDevice(id)
+				if err != nil {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+					return
+				}
+				c.Set(ctxDeviceID, device.ID)
+			} else {
+				c.Set(ctxLegacyDevices, uc)
+			}
+			c.Next()
+			return
+		}
+
+		device, err := uc.AuthenticateDevice(id, key)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ctxDeviceID, device.ID)
+		c.Next()
+	}
+}
+
+// CurrentDeviceID returns the authenticated device id, or "" for a legacy
+// request that requireDevice has not resolved yet.
+func CurrentDeviceID(c *gin.Context) string {
+	return c.GetString(ctxDeviceID)
+}
+
+// requireDevice checks that the request may act as deviceID. A credential-less
+// legacy request is bound to deviceID only if that device has no secret.
+func requireDevice(c *gin.Context, deviceID string) bool {
+	if deviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id required"})
+		return false
+	}
+	if authed := CurrentDeviceID(c); authed != "" {
+		if authed != deviceID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "device credentials do not match device_id"})
+			return false
+		}
+		return true
+	}
+	v, ok := c.Get(ctxLegacyDevices)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "device credentials required"})
+		return false
+	}
+	if _, err := v.(*usecases.DeviceUseCase).AuthenticateLegacyDevice(deviceID); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return false
+	}
+	c.Set(ctxDeviceID, deviceID)
+	return true
+}
+
+// CurrentUserID returns the authenticated user's id, or "" if the request is anonymous.
+func CurrentUserID(c *gin.Context) string {
+	return c.GetString(ctxUserID)
+}
+
+// CurrentPrincipal returns the authenticated caller as seen by the authorization layer.
+func CurrentPrincipal(c *gin.Context) auth.Principal {
+	if v, ok := c.Get(ctxAPIKey); ok {
+		if p, ok := v.(*auth.Principal); ok {
+			return *p
+		}
+	}
+	return auth.Principal{UserID: c.GetString(ctxUserID), Role: c.GetString(ctxRole)}
+}
+
+// resolveUserParam maps a :user_id path param to the authenticated user.
+// "me" is accepted as an alias; any other id must match the caller unless they are an admin.
+func resolveUserParam(c *gin.Context) (string, bool) {
+	userID := CurrentUserID(c)
+	param := c.Param("user_id")
+	if param == "" || param == "me" || param == userID {
+		return userID, true
+	}
+	if CurrentPrincipal(c).IsAdmin() {
+		return param, true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "cannot access another user's resources"})
+	return "", false
+}
+
+// respondAuthzError writes the HTTP response for an Authorizer error.
+func respondAuthzError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecases.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecases.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
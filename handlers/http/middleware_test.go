@@ -0,0 +1,107 @@
+package httpHandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+	"iot-server/usecases"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubDeviceRepo serves devices from a map.
+type stubDeviceRepo struct {
+	repositories.DeviceRepository
+	devices map[string]*entities.Device
+}
+
+func (r stubDeviceRepo) GetByID(id string) (*entities.Device, error) {
+	if d, ok := r.devices[id]; ok {
+		return d, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+func deviceAuthRouter(t *testing.T, allowLegacy bool) (*gin.Engine, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	secret, hash, err := auth.NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := stubDeviceRepo{devices: map[string]*entities.Device{
+		"secured": {ID: "secured", SecretHash: hash},
+		"legacy":  {ID: "legacy"},
+	}}
+	uc := usecases.NewDeviceUseCase(repo, nil, nil)
+
+	r := gin.New()
+	r.GET("/devices/:id", DeviceAuthMiddleware(uc, allowLegacy), func(c *gin.Context) {
+		if requireDevice(c, c.Param("id")) {
+			c.String(http.StatusOK, CurrentDeviceID(c))
+		}
+	})
+	return r, secret
+}
+
+func TestDeviceAuth(t *testing.T) {
+	cases := []struct {
+		name        string
+		allowLegacy bool
+		path        string
+		id, key     string // headers; key "SECRET" is replaced with the real secret
+		want        int
+	}{
+		{"valid credentials", false, "/devices/secured", "secured", "SECRET", http.StatusOK},
+		{"wrong key", false, "/devices/secured", "secured", "dk_nope", http.StatusUnauthorized},
+		{"no credentials", false, "/devices/legacy", "", "", http.StatusUnauthorized},
+		{"credentials for another device", false, "/devices/legacy", "secured", "SECRET", http.StatusForbidden},
+
+		{"legacy: device without secret", true, "/devices/legacy", "", "", http.StatusOK},
+		{"legacy: id header without secret", true, "/devices/legacy", "legacy", "", http.StatusOK},
+		{"legacy: cannot skip a secret", true, "/devices/secured", "", "", http.StatusUnauthorized},
+		{"legacy: cannot claim a secured id", true, "/devices/secured", "secured", "", http.StatusUnauthorized},
+		{"legacy: id header must match", true, "/devices/secured", "legacy", "", http.StatusForbidden},
+		{"legacy: unknown device", true, "/devices/ghost", "", "", http.StatusUnauthorized},
+		{"legacy: keys still checked", true, "/devices/secured", "secured", "dk_nope", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, secret := deviceAuthRouter(t, tc.allowLegacy)
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.id != "" {
+				req.Header.Set(HeaderDeviceID, tc.id)
+			}
+			if tc.key == "SECRET" {
+				req.Header.Set(HeaderDeviceKey, secret)
+			} else if tc.key != "" {
+				req.Header.Set(HeaderDeviceKey, tc.key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tc.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	cases := map[string]string{
+		"/ws?id=d1&key=dk_secret":           "/ws?id=d1&key=REDACTED",
+		"/api/v1/auth/verify-email?token=t": "/api/v1/auth/verify-email?token=REDACTED",
+		"/api/v1/commands/poll?wait=5s":     "/api/v1/commands/poll?wait=5s",
+		"/health":                           "/health",
+		"/ws?key=%zz":                       "/ws?REDACTED",
+	}
+	for in, want := range cases {
+		if got := redactQuery(in); got != want {
+			t.Errorf("redactQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package httpHandler
+
+import (
+	"errors"
+	"iot-server/usecases"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ScheduleHandler struct {
+	useCase *usecases.ScheduleUseCase
+}
+
+func NewScheduleHandler(useCase *usecases.ScheduleUseCase) *ScheduleHandler {
+	return &ScheduleHandler{
+		useCase: useCase,
+	}
+}
+
+// CreateSchedule handles POST /api/v1/schedules
+// { "device_id": "...", "device_module_id": "...", "command": "CLOSE_DOOR", "cron": "0 22 * * *", "timezone": "Europe/Berlin" }
+func (h *ScheduleHandler) CreateSchedule(c *gin.Context) {
+	var req usecases.ScheduleInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	schedule, err := h.useCase.Create(CurrentPrincipal(c), req)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Schedule created successfully",
+		"data":    usecases.RedactSchedule(*schedule),
+	})
+}
+
+// GetSchedules handles GET /api/v1/schedules
+func (h *ScheduleHandler) GetSchedules(c *gin.Context) {
+	schedules, err := h.useCase.List(CurrentPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve schedules",
+		})
+		return
+	}
+
+	for i := range schedules {
+		schedules[i] = usecases.RedactSchedule(schedules[i])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":  schedules,
+		"count": len(schedules),
+	})
+}
+
+// GetSchedule handles GET /api/v1/schedules/:id
+func (h *ScheduleHandler) GetSchedule(c *gin.Context) {
+	schedule, err := h.useCase.Get(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": usecases.RedactSchedule(*schedule),
+	})
+}
+
+// PauseSchedule handles POST /api/v1/schedules/:id/pause
+func (h *ScheduleHandler) PauseSchedule(c *gin.Context) {
+	schedule, err := h.useCase.Pause(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Schedule paused",
+		"data":    usecases.RedactSchedule(*schedule),
+	})
+}
+
+// ResumeSchedule handles POST /api/v1/schedules/:id/resume
+func (h *ScheduleHandler) ResumeSchedule(c *gin.Context) {
+	schedule, err := h.useCase.Resume(CurrentPrincipal(c), c.Param("id"))
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Schedule resumed",
+		"data":    usecases.RedactSchedule(*schedule),
+	})
+}
+
+// DeleteSchedule handles DELETE /api/v1/schedules/:id
+func (h *ScheduleHandler) DeleteSchedule(c *gin.Context) {
+	if err := h.useCase.Delete(CurrentPrincipal(c), c.Param("id")); err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Schedule deleted successfully",
+	})
+}
+
+// GetScheduleRuns handles GET /api/v1/schedules/:id/runs?limit=50
+// Enqueued, failed and missed runs, newest first
+func (h *ScheduleHandler) GetScheduleRuns(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	runs, err := h.useCase.Runs(CurrentPrincipal(c), c.Param("id"), limit)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  runs,
+		"count": len(runs),
+	})
+}
+
+func respondScheduleError(c *gin.Context, err error) {
+	if errors.Is(err, usecases.ErrNotFound) || errors.Is(err, usecases.ErrForbidden) {
+		respondAuthzError(c, err)
+		return
+	}
+	if errors.Is(err, usecases.ErrShuttingDown) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	respondEnqueueError(c, err)
+}
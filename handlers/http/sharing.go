@@ -0,0 +1,180 @@
+package httpHandler
+
+import (
+	"errors"
+	"iot-server/usecases"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SharingHandler struct {
+	useCase *usecases.SharingUseCase
+	authz   *usecases.Authorizer
+}
+
+func NewSharingHandler(useCase *usecases.SharingUseCase, authz *usecases.Authorizer) *SharingHandler {
+	return &SharingHandler{
+		useCase: useCase,
+		authz:   authz,
+	}
+}
+
+type InviteMemberRequest struct {
+	User string `json:"user" binding:"required"` // username or email
+	Role string `json:"role"`                    // editor | viewer (default viewer)
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// InviteMember handles POST /api/v1/devices/:id/members
+func (h *SharingHandler) InviteMember(c *gin.Context) {
+	deviceID := c.Param("id")
+	principal := CurrentPrincipal(c)
+
+	if _, err := h.authz.Device(principal, deviceID, usecases.AccessManage); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	var req InviteMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	member, err := h.useCase.Invite(deviceID, principal.UserID, req.User, req.Role)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Invitation created successfully",
+		"data":    member,
+	})
+}
+
+// ListMembers handles GET /api/v1/devices/:id/members
+func (h *SharingHandler) ListMembers(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	if _, err := h.authz.Device(CurrentPrincipal(c), deviceID, usecases.AccessRead); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	members, err := h.useCase.ListMembers(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve members",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  members,
+		"count": len(members),
+	})
+}
+
+// UpdateMember handles PUT /api/v1/devices/:id/members/:member_id
+func (h *SharingHandler) UpdateMember(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	if _, err := h.authz.Device(CurrentPrincipal(c), deviceID, usecases.AccessManage); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	member, err := h.useCase.UpdateRole(deviceID, c.Param("member_id"), req.Role)
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Member updated successfully",
+		"data":    member,
+	})
+}
+
+// RevokeMember handles DELETE /api/v1/devices/:id/members/:member_id
+// Owners revoke members or invitations; members can remove themselves.
+func (h *SharingHandler) RevokeMember(c *gin.Context) {
+	deviceID := c.Param("id")
+	principal := CurrentPrincipal(c)
+
+	_, manageErr := h.authz.Device(principal, deviceID, usecases.AccessManage)
+	if manageErr != nil && !errors.Is(manageErr, usecases.ErrForbidden) {
+		respondAuthzError(c, manageErr)
+		return
+	}
+
+	if err := h.useCase.Revoke(principal, manageErr == nil, deviceID, c.Param("member_id")); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Member removed successfully",
+	})
+}
+
+// ListInvitations handles GET /api/v1/invitations
+func (h *SharingHandler) ListInvitations(c *gin.Context) {
+	invitations, err := h.useCase.ListInvitations(CurrentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  invitations,
+		"count": len(invitations),
+	})
+}
+
+// AcceptInvitation handles POST /api/v1/invitations/:id/accept
+func (h *SharingHandler) AcceptInvitation(c *gin.Context) {
+	member, err := h.useCase.Accept(c.Param("id"), CurrentUserID(c))
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invitation accepted",
+		"data":    member,
+	})
+}
+
+// DeclineInvitation handles POST /api/v1/invitations/:id/decline
+func (h *SharingHandler) DeclineInvitation(c *gin.Context) {
+	if err := h.useCase.Decline(c.Param("id"), CurrentUserID(c)); err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invitation declined",
+	})
+}
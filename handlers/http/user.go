@@ -0,0 +1,179 @@
+package httpHandler
+
+import (
+	"errors"
+	"iot-server/usecases"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UserHandler struct {
+	useCase *usecases.UserUseCase
+}
+
+func NewUserHandler(useCase *usecases.UserUseCase) *UserHandler {
+	return &UserHandler{
+		useCase: useCase,
+	}
+}
+
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// Register handles POST /api/v1/auth/register
+func (h *UserHandler) Register(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	user, err := h.useCase.Register(req.Username, req.Email, req.Password)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, usecases.ErrUsernameTaken) || errors.Is(err, usecases.ErrEmailTaken) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "User registered successfully, check your email to verify the account",
+		"data":    user,
+	})
+}
+
+// VerifyEmail handles GET/POST /api/v1/auth/verify-email?token=...
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		var body struct {
+			Token string `json:"token"`
+		}
+		_ = c.ShouldBindJSON(&body)
+		token = body.Token
+	}
+
+	if err := h.useCase.VerifyEmail(token); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Email verified successfully",
+	})
+}
+
+// ResendVerification handles POST /api/v1/auth/verify-email/resend
+func (h *UserHandler) ResendVerification(c *gin.Context) {
+	if err := h.useCase.ResendVerification(CurrentUserID(c)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Verification email sent",
+	})
+}
+
+// ChangePassword handles POST /api/v1/auth/password/change
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if err := h.useCase.ChangePassword(CurrentUserID(c), req.CurrentPassword, req.NewPassword); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, usecases.ErrInvalidCredentials) {
+			status = http.StatusUnauthorized
+		}
+		c.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password changed successfully; please sign in again",
+	})
+}
+
+// ForgotPassword handles POST /api/v1/auth/password/forgot
+func (h *UserHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if err := h.useCase.RequestPasswordReset(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to send reset email",
+		})
+		return
+	}
+
+	// Same answer whether or not the email exists
+	c.JSON(http.StatusOK, gin.H{
+		"message": "If the email is registered, a reset link has been sent",
+	})
+}
+
+// ResetPassword handles POST /api/v1/auth/password/reset
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if err := h.useCase.ResetPassword(req.Token, req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password reset successfully",
+	})
+}
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"time"
 
+	"iot-server/cache"
 	"iot-server/entities"
+	httpHandler "iot-server/handlers/http"
 	"iot-server/services"
 	"iot-server/usecases"
 	"iot-server/ws"
@@ -25,53 +28,92 @@ type sensorDataPayload struct {
 	DeviceID       string `json:"device_id"`
 	DeviceModuleID string `json:"device_module_id"`
 	Timestamp      string `json:"timestamp"`
-	Data           string `json:"data"` // JSON string containing sensor data
+	Data           string `json:"data"`       // JSON string containing sensor data
+	MessageID      string `json:"message_id"` // optional; repeated ids are dropped
 }
 
-type commandRequest struct {
-	DeviceID       string                 `json:"device_id"`        // target device
-	DeviceModuleID string                 `json:"device_module_id"` // target specific module
-	Command        string                 `json:"command"`
-	Params         map[string]interface{} `json:"params"`
+// commandResponsePayload is sent by the device after executing a command:
+// {"type":"command_response","command_id":"...","status":"executed|failed","result":{...},"error":"..."}
+type commandResponsePayload struct {
+	Type string `json:"type"`
+	usecases.CommandResponse
 }
 
 // WSHandler groups dependencies for websocket flows
 type WSHandler struct {
-	mgr       *ws.Manager
-	usecase   *usecases.DeviceUseCase
-	processor *services.DataProcessor
+	mgr         *ws.Manager
+	usecase     *usecases.DeviceUseCase
+	cmdUC       *usecases.CommandsUseCase
+	processor   *services.DataProcessor
+	idempotency *usecases.IdempotencyUseCase
+	allowLegacy bool // accept devices that connect without a secret
 }
 
-func NewWSHandler(mgr *ws.Manager, uc *usecases.DeviceUseCase, processor *services.DataProcessor) *WSHandler {
-	return &WSHandler{mgr: mgr, usecase: uc, processor: processor}
+func NewWSHandler(mgr *ws.Manager, uc *usecases.DeviceUseCase, cmdUC *usecases.CommandsUseCase, processor *services.DataProcessor, allowLegacy bool) *WSHandler {
+	return &WSHandler{mgr: mgr, usecase: uc, cmdUC: cmdUC, processor: processor, allowLegacy: allowLegacy}
 }
 
+// SetIdempotency enables de-duplication of sensor_data messages that carry a message_id.
+func (h *WSHandler) SetIdempotency(uc *usecases.IdempotencyUseCase) {
+	h.idempotency = uc
+}
+
+// inProgressRetryAfter is suggested to a device resending a message whose
+// first attempt is still being stored.
+const inProgressRetryAfter = time.Second
+
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
 
 // HandleDeviceWS upgrades to websocket and reads messages from device
 // GET /ws?id=<device_id>
+// The device secret is accepted only in the X-Device-Key header, never in the
+// query string, so it does not end up in access logs.
 func (h *WSHandler) HandleDeviceWS(c *gin.Context) {
-	deviceID := c.Query("id")
+	deviceID := c.GetHeader(httpHandler.HeaderDeviceID)
+	if deviceID == "" {
+		deviceID = c.Query("id")
+	}
+	key := c.GetHeader(httpHandler.HeaderDeviceKey)
+	if c.Query("key") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "send the device key in the " + httpHandler.HeaderDeviceKey + " header"})
+		return
+	}
 	if deviceID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing device id"})
 		return
 	}
 
+	// Verify the device before upgrading; only devices without a secret may skip it
+	if key != "" || !h.allowLegacy {
+		if _, err := h.usecase.AuthenticateDevice(deviceID, key); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		if _, err := h.usecase.AuthenticateLegacyDevice(deviceID); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("WARNING: device %s connected without credentials (legacy mode)", deviceID)
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("websocket upgrade failed: %v", err)
 		return
 	}
-	// Register connection
-	h.mgr.Register(deviceID, conn)
+	// Bind connection to the verified device identity
+	client := h.mgr.Register(deviceID, conn)
 	log.Printf("device connected: %s", deviceID)
 
 	// Ensure cleanup on exit
 	defer func() {
-		h.mgr.Unregister(deviceID)
+		h.mgr.Unregister(client)
 		log.Printf("device disconnected: %s", deviceID)
 	}()
 
+	// Modules already verified as this device's, so each reading costs no lookup
+	ownModules := map[string]bool{}
 	for {
 		// Read message type and bytes
 		mt, message, err := conn.ReadMessage()
@@ -101,63 +143,157 @@ func (h *WSHandler) HandleDeviceWS(c *gin.Context) {
 				log.Printf("invalid sensor_data payload from %s: %v", deviceID, err)
 				continue
 			}
+			if payload.DeviceID != "" && payload.DeviceID != client.DeviceID {
+				log.Printf("rejected sensor_data for device %s on connection of %s", payload.DeviceID, client.DeviceID)
+				continue
+			}
+			if payload.DeviceModuleID != "" && !ownModules[payload.DeviceModuleID] {
+				if err := h.usecase.CheckModuleOwner(client.DeviceID, payload.DeviceModuleID); err != nil {
+					log.Printf("rejected sensor_data for module %s from %s: %v", payload.DeviceModuleID, client.DeviceID, err)
+					h.sendError(client, "", err.Error())
+					continue
+				}
+				ownModules[payload.DeviceModuleID] = true
+			}
+			var claim *entities.IdempotencyKey
+			if payload.MessageID != "" && h.idempotency != nil {
+				scope := httpHandler.IdempotencyScopeDeviceData + ":device:" + client.DeviceID
+				rec, fresh, err := h.idempotency.Claim(scope, payload.MessageID)
+				if errors.Is(err, usecases.ErrIdempotencyInProgress) {
+					// Not stored yet, and that attempt may still fail: ask for a retry instead of acking
+					h.sendSlowDown(client, payload.MessageID, inProgressRetryAfter)
+					continue
+				}
+				if err != nil {
+					log.Printf("rejected sensor_data from %s: %v", client.DeviceID, err)
+					h.sendError(client, "", err.Error())
+					continue
+				}
+				if !fresh {
+					h.sendAck(client, payload.MessageID, true)
+					log.Printf("dropped duplicate sensor_data %s from %s", payload.MessageID, client.DeviceID)
+					continue
+				}
+				claim = rec
+			}
 			// Build data entity
 			data := &entities.DeviceData{
-				DeviceID:       payload.DeviceID,
+				DeviceID:       client.DeviceID,
 				DeviceModuleID: payload.DeviceModuleID,
 				Timestamp:      payload.Timestamp,
 				Data:           payload.Data,
 			}
 			// Always store into cache for batch processing with threshold rules
 			if h.processor != nil {
-				h.processor.AddDataPoint(*data)
-				log.Printf("added data point to cache for device %s, module %s", payload.DeviceID, payload.DeviceModuleID)
+				if err := h.processor.AddDataPoint(*data); err != nil {
+					log.Printf("failed to buffer sensor_data from %s: %v", client.DeviceID, err)
+					if claim != nil {
+						h.idempotency.Abandon(claim)
+					}
+					var slowDown *cache.SlowDownError
+					switch {
+					case errors.As(err, &slowDown):
+						h.sendSlowDown(client, payload.MessageID, slowDown.RetryAfter)
+					case errors.Is(err, cache.ErrCacheFull):
+						h.sendError(client, "", err.Error())
+					default:
+						h.sendError(client, "", "failed to store sensor_data, retry later")
+					}
+					continue
+				}
+				log.Printf("added data point to cache for device %s, module %s", client.DeviceID, payload.DeviceModuleID)
 			} else {
 				log.Printf("WARNING: data processor not available, data might be lost")
 			}
+			// Acknowledge only once the point is durably buffered
+			if claim != nil {
+				h.idempotency.Complete(claim, 0, nil)
+				h.sendAck(client, payload.MessageID, false)
+			}
 		case "heartbeat":
 			// No-op, could update a last-seen cache
 		case "command_response":
-			// For now just log it; could persist to a commands table later
-			log.Printf("command response from %s: %s", deviceID, string(message))
+			var payload commandResponsePayload
+			if err := json.Unmarshal(message, &payload); err != nil {
+				log.Printf("invalid command_response payload from %s: %v", deviceID, err)
+				h.sendError(client, "", "invalid command_response payload")
+				continue
+			}
+			// Only commands addressed to this connection's device may be updated
+			if err := h.cmdUC.Respond(client.DeviceID, payload.CommandResponse); err != nil {
+				log.Printf("rejected command_response from %s for command %s: %v", deviceID, payload.CommandID, err)
+				h.sendError(client, payload.CommandID, err.Error())
+				continue
+			}
+			log.Printf("command %s %s by device %s", payload.CommandID, payload.Status, deviceID)
 		default:
 			log.Printf("unknown message type from %s: %s", deviceID, base.Type)
 		}
 	}
 }
 
-// SendCommandToDevice POST /api/v1/commands
-// { "device_id": "<id>", "command": "LED_ON", "params": {"duration_ms": 500}}
-func (h *WSHandler) SendCommandToDevice(c *gin.Context) {
-	var req commandRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
-		return
-	}
-	if req.DeviceID == "" || req.Command == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id and command are required"})
-		return
+// sendError reports a rejected message back to the device.
+func (h *WSHandler) sendError(client *ws.Client, commandID, msg string) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":       "error",
+		"command_id": commandID,
+		"error":      msg,
+		"timestamp":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err := client.Write(b); err != nil {
+		log.Printf("failed to send error to %s: %v", client.DeviceID, err)
 	}
+}
 
-	// Envelope to match Pico expectation
-	cmd := map[string]interface{}{
-		"type":             "command",
-		"command_id":       time.Now().UTC().Format(time.RFC3339Nano),
-		"device_module_id": req.DeviceModuleID,
-		"command":          req.Command,
-		"params":           req.Params,
-		"timestamp":        time.Now().UTC().Format(time.RFC3339Nano),
+// sendAck confirms receipt of a sensor_data message so the device can stop retrying it.
+func (h *WSHandler) sendAck(client *ws.Client, messageID string, duplicate bool) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":       "ack",
+		"message_id": messageID,
+		"duplicate":  duplicate,
+		"timestamp":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err := client.Write(b); err != nil {
+		log.Printf("failed to send ack to %s: %v", client.DeviceID, err)
 	}
-	b, _ := json.Marshal(cmd)
+}
 
-	if err := h.mgr.SendToDevice(req.DeviceID, b); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "device not connected", "details": err.Error()})
-		return
+// sendSlowDown asks a device to back off; the rejected sensor_data message
+// should be resent after retryAfter.
+func (h *WSHandler) sendSlowDown(client *ws.Client, messageID string, retryAfter time.Duration) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":           "slow_down",
+		"message_id":     messageID,
+		"retry_after_ms": retryAfter.Milliseconds(),
+		"timestamp":      time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err := client.Write(b); err != nil {
+		log.Printf("failed to send slow_down to %s: %v", client.DeviceID, err)
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "sent", "payload": cmd})
 }
 
 // GetConnectedDevices GET /api/v1/devices/connected
+// Admins see every connection, other users only their own devices.
 func (h *WSHandler) GetConnectedDevices(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"devices": h.mgr.List(), "count": len(h.mgr.List())})
+	connected := h.mgr.List()
+	principal := httpHandler.CurrentPrincipal(c)
+	if !principal.IsAdmin() {
+		owned, err := h.usecase.GetDevicesByUserID(principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve devices"})
+			return
+		}
+		mine := make(map[string]bool, len(owned))
+		for _, d := range owned {
+			mine[d.ID] = principal.AllowsDevice(d.ID)
+		}
+		filtered := make([]string, 0, len(connected))
+		for _, id := range connected {
+			if mine[id] {
+				filtered = append(filtered, id)
+			}
+		}
+		connected = filtered
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": connected, "count": len(connected)})
 }
@@ -70,7 +70,7 @@ def _parse_body(body, content_type):
 def listen_for_credentials(timeout_seconds=300):
     """
     Start AP mode with SSID Pico-XXX and listen on http://192.168.4.1/credentials
-    for a POST body containing {ssid, password, user_id?} either as form or JSON.
+    for a POST body containing {ssid, password, user_id?, pairing_token?} either as form or JSON.
     Returns a credentials dict or None on timeout/error.
     """
     ssid = _gen_ap_ssid()
@@ -145,11 +145,12 @@ def listen_for_credentials(timeout_seconds=300):
                 ct = headers.get("content-type", "application/x-www-form-urlencoded")
                 data = _parse_body(body, ct)
                 if isinstance(data, dict) and ("ssid" in data) and ("password" in data):
-                    # Optional user_id
+                    # Optional user_id; pairing_token registers the device into the app user's account
                     creds = {
                         "ssid": data.get("ssid"),
                         "password": data.get("password"),
-                        "user_id": data.get("user_id") or data.get("uid") or data.get("user")
+                        "user_id": data.get("user_id") or data.get("uid") or data.get("user"),
+                        "pairing_token": data.get("pairing_token")
                     }
                     print("Received credentials for:", creds.get("ssid"))
                     _send_response(cl, 200, b"OK")
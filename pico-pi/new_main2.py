@@ -53,9 +53,19 @@ def check_tls():
 API_HOST = "iot-picopi-module.onrender.com"
 API_PORT_HTTPS = 443
 API_PORT_HTTP = 80
+COMMAND_POLL_WAIT = "5s"  # server holds the command poll open this long, replacing a fixed sleep
 
 CONFIG_FILE = "device_config.json"
 
+# Device credentials returned at registration, sent on every device request
+DEVICE_CREDS = {"id": None, "key": None}
+
+def DeviceAuthHeaders():
+    """HTTP header lines authenticating this device (empty until registered)"""
+    if DEVICE_CREDS.get("id") and DEVICE_CREDS.get("key"):
+        return f"X-Device-ID: {DEVICE_CREDS['id']}\r\nX-Device-Key: {DEVICE_CREDS['key']}\r\n"
+    return ""
+
 def blink_led(times=1, on_time=0.1, off_time=0.1):
     """Blink LED to indicate activity"""
     for _ in range(times):
@@ -101,13 +111,14 @@ def Phase1_GetCredentials():
     
     print(f"\n✓ Received credentials:")
     print(f"  SSID: {creds['ssid']}")
-    print(f"  User ID: {creds['user_id']}")
+    print(f"  User ID: {creds.get('user_id')}")
     
     # Save to config
     config = {
         "ssid": creds["ssid"],
         "password": creds["password"],
-        "user_id": creds["user_id"],
+        "user_id": creds.get("user_id"),
+        "pairing_token": creds.get("pairing_token"),
         "phase": "credentials_saved"
     }
     
@@ -150,14 +161,14 @@ def GetMACAddress():
     wlan.active(True)
     return ubinascii.hexlify(wlan.config('mac')).decode()
 
-def RegisterDeviceHTTP_Direct(user_id):
+def RegisterDeviceHTTP_Direct(pairing_token):
     """Register device via direct HTTP to IP (bypass redirect)"""
     mac = GetMACAddress()
     device_name = f"pico_{mac[-6:]}"
     payload = {
         "name": device_name,
         "type": "pico_pi",
-        "user_id": user_id
+        "pairing_token": pairing_token
     }
     body = json.dumps(payload)
     
@@ -202,9 +213,12 @@ def RegisterDeviceHTTP_Direct(user_id):
         
         if status.startswith("HTTP/1.1 2") or status.startswith("HTTP/1.0 2"):
             body_bytes = parts[1] if len(parts) > 1 else b""
-            data = json.loads(body_bytes.decode()).get("data", {})
+            resp_json = json.loads(body_bytes.decode())
+            data = resp_json.get("data", {})
             device_id = data.get("id") or data.get("device_id")
             if device_id:
+                DEVICE_CREDS["id"] = device_id
+                DEVICE_CREDS["key"] = resp_json.get("device_secret")
                 print(f"✓ Device registered: {device_id}")
                 return device_id
     except Exception as e:
@@ -212,7 +226,7 @@ def RegisterDeviceHTTP_Direct(user_id):
     
     return None
 
-def RegisterDeviceHTTPS(user_id):
+def RegisterDeviceHTTPS(pairing_token):
     """Register device via HTTPS - same logic as test_connection.py"""
     # Re-check TLS at runtime
     if not check_tls():
@@ -224,7 +238,7 @@ def RegisterDeviceHTTPS(user_id):
     payload = {
         "name": device_name,
         "type": "pico_pi",
-        "user_id": user_id
+        "pairing_token": pairing_token  # single-use, issued by the app; the server derives the owner from it
     }
     body = json.dumps(payload)
     
@@ -306,9 +320,12 @@ def RegisterDeviceHTTPS(user_id):
             try:
                 body_str = body_bytes.decode()
                 print(f"  Body: {body_str[:150]}...")
-                data = json.loads(body_str).get("data", {})
+                resp_json = json.loads(body_str)
+                data = resp_json.get("data", {})
                 device_id = data.get("id") or data.get("device_id")
                 if device_id:
+                    DEVICE_CREDS["id"] = device_id
+                    DEVICE_CREDS["key"] = resp_json.get("device_secret")
                     print(f"✓ Device registered: {device_id}")
                     return device_id
                 else:
@@ -355,6 +372,7 @@ def RegisterModuleHTTPS(device_id, user_id, module_type, module_name, commands):
         req = (
             f"POST /api/v1/device-modules HTTP/1.1\r\n"
             f"Host: {API_HOST}\r\n"
+            f"{DeviceAuthHeaders()}"
             "Content-Type: application/json\r\n"
             f"Content-Length: {len(body)}\r\n"
             "Connection: close\r\n\r\n" + body
@@ -426,7 +444,7 @@ def Phase2_RegisterDevice():
     
     print(f"\n✓ Config loaded:")
     print(f"  SSID: {config['ssid']}")
-    print(f"  User ID: {config['user_id']}")
+    print(f"  User ID: {config.get('user_id')}")
     
     # Connect to WiFi
     if not ConnectWiFi(config["ssid"], config["password"]):
@@ -438,13 +456,14 @@ def Phase2_RegisterDevice():
     time.sleep(20)
     
     # Register device via HTTPS
-    device_id = RegisterDeviceHTTPS(config["user_id"])
+    device_id = RegisterDeviceHTTPS(config.get("pairing_token"))
     
     if not device_id:
         print("\n✗ Phase 2 failed: device registration")
         return False
     
     config["device_id"] = device_id
+    config["device_key"] = DEVICE_CREDS.get("key")
     
     # Register modules
     print("\n" + "=" * 50)
@@ -475,7 +494,7 @@ def Phase2_RegisterDevice():
     saved_config = LoadConfig()
     if saved_config:
         for key, value in saved_config.items():
-            if key == "password":
+            if key in ("password", "device_key"):
                 print(f"  {key}: ****")
             else:
                 print(f"  {key}: {value}")
@@ -520,6 +539,7 @@ def SendDataToAPI(device_id, module_id, data_type, data):
         req = (
             f"POST /api/v1/device-data HTTP/1.1\r\n"
             f"Host: {API_HOST}\r\n"
+            f"{DeviceAuthHeaders()}"
             "Content-Type: application/json\r\n"
             f"Content-Length: {len(body)}\r\n"
             "Connection: close\r\n\r\n" + body
@@ -555,16 +575,17 @@ def GetCommandsFromAPI(device_id):
         addr = dns_results[0][-1]
         
         s = socket.socket()
-        s.settimeout(10)
+        s.settimeout(20)
         s.connect(addr)
         s = ssl_mod.wrap_socket(s, server_hostname=API_HOST)
         
-        url_path = f"/api/v1/devices/{device_id}/commands?status=pending"
+        url_path = f"/api/v1/devices/{device_id}/commands?status=pending&wait={COMMAND_POLL_WAIT}"
         print(f"   Request: GET {url_path}")
         
         req = (
             f"GET {url_path} HTTP/1.1\r\n"
             f"Host: {API_HOST}\r\n"
+            f"{DeviceAuthHeaders()}"
             "Connection: close\r\n\r\n"
         )
         s.send(req.encode())
@@ -622,6 +643,52 @@ def GetCommandsFromAPI(device_id):
         print(f"    ✗ Command fetch failed: {e}")
         return []
 
+def SendCommandResponse(command_id, error=None):
+    """Acknowledge a command so the server doesn't redeliver it"""
+    if not command_id or not check_tls():
+        return False
+    
+    payload = {"command_id": command_id, "status": "failed" if error else "executed"}
+    if error:
+        payload["error"] = error
+    body = json.dumps(payload)
+    
+    try:
+        dns_results = socket.getaddrinfo(API_HOST, API_PORT_HTTPS)
+        addr = dns_results[0][-1]
+        
+        s = socket.socket()
+        s.settimeout(10)
+        s.connect(addr)
+        s = ssl_mod.wrap_socket(s, server_hostname=API_HOST)
+        
+        req = (
+            f"POST /api/v1/command-responses HTTP/1.1\r\n"
+            f"Host: {API_HOST}\r\n"
+            f"{DeviceAuthHeaders()}"
+            "Content-Type: application/json\r\n"
+            f"Content-Length: {len(body)}\r\n"
+            "Connection: close\r\n\r\n" + body
+        )
+        s.send(req.encode())
+        
+        resp = b""
+        while True:
+            chunk = s.recv(512)
+            if not chunk:
+                break
+            resp += chunk
+        s.close()
+        
+        status = resp.split(b"\r\n", 1)[0].decode()
+        if "20" in status:
+            return True
+        print(f"      ⚠ Ack response: {status}")
+        return False
+    except Exception as e:
+        print(f"      ✗ Ack failed: {e}")
+        return False
+
 def ReadDoorStatus():
     """Read door status from LED state"""
     # LED on = door open (1), LED off = door closed (0)
@@ -679,6 +746,8 @@ def Phase3_Operation():
     
     device_id = config['device_id']
     modules = config.get('modules', {})
+    DEVICE_CREDS["id"] = device_id
+    DEVICE_CREDS["key"] = config.get("device_key")
     
     print(f"\n✓ Device ID: {device_id}")
     if modules:
@@ -749,6 +818,7 @@ def Phase3_Operation():
                     # Execute command based on type
                     command_name = cmd.get('command', '')
                     cmd_module_id = cmd.get('device_module_id', '')
+                    cmd_error = None
                     
                     # Match command to correct module
                     if command_name == 'OPEN_DOOR' and cmd_module_id == modules.get("door_id"):
@@ -801,23 +871,30 @@ def Phase3_Operation():
                             config['password'] = new_password
                             if SaveConfig(config):
                                 print(f"      ✓ WiFi credentials updated in config")
+                                SendCommandResponse(cmd.get('id'))
                                 print(f"      🔄 Restarting to apply new WiFi...")
                                 time.sleep(2)
                                 machine.reset()
                             else:
                                 print(f"      ✗ Failed to save new credentials")
+                                cmd_error = "failed to save new credentials"
                         else:
                             print(f"   ⚠️  Missing ssid or password in CHANGE_WIFI command")
+                            cmd_error = "missing ssid or password"
                     else:
                         if command_name in ['OPEN_DOOR', 'CLOSE_DOOR']:
                             print(f"   ⚠️  Door command for different module (Expected: {modules.get('door_id')}, Got: {cmd_module_id})")
                         else:
                             print(f"   ⚠️  Unknown command: {command_name}")
+                        cmd_error = f"unsupported command {command_name} for module {cmd_module_id}"
+                    
+                    # Acknowledge so the server doesn't redeliver it
+                    SendCommandResponse(cmd.get('id'), cmd_error)
             else:
                 print("   No pending commands")
             
-            print("\n⏱️  Waiting 5 seconds...\n")
-            time.sleep(5)
+            # The command poll already waited for up to COMMAND_POLL_WAIT
+            time.sleep(1)
             
     except KeyboardInterrupt:
         print("\n\n⏹  Stopped by user")
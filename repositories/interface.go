@@ -1,12 +1,15 @@
 package repositories
 
-import "iot-server/entities"
+import (
+	"iot-server/entities"
+	"time"
+)
 
 type DeviceRepository interface {
 	Create(device *entities.Device) error
 	GetByID(id string) (*entities.Device, error)
 	GetAll() ([]entities.Device, error)
-	GetByUserID(userID string) ([]entities.Device, error)
+	GetByUserID(userID string) ([]entities.DeviceWithRole, error) // owned and shared devices
 	Update(device *entities.Device) error
 	Delete(id string) error
 }
@@ -14,8 +17,8 @@ type DeviceRepository interface {
 type DeviceDataRepository interface {
 	Create(data *entities.DeviceData) error
 	GetByID(id string) (*entities.DeviceData, error)
-	GetAll() ([]entities.DeviceData, error)
-	GetByDeviceID(deviceID string) ([]entities.DeviceData, error)
+	List(f DeviceDataFilter) ([]entities.DeviceData, error)
+	Aggregate(a DeviceDataAggregation) ([]DeviceDataBucket, error)
 	GetLatestByModuleID(moduleID string) (*entities.DeviceData, error)
 	Update(data *entities.DeviceData) error
 	Delete(id string) error
@@ -25,15 +28,161 @@ type DeviceModuleRepository interface {
 	Create(module *entities.DeviceModule) error
 	GetByID(id string) (*entities.DeviceModule, error)
 	GetAll() ([]entities.DeviceModule, error)
-	GetByUserID(userID string) ([]entities.DeviceModule, error)
+	GetByUserID(userID string) ([]entities.DeviceModuleWithRole, error) // modules of owned and shared devices
 	GetByDeviceID(deviceID string) ([]entities.DeviceModule, error)
 	Update(module *entities.DeviceModule) error
 	Delete(id string) error
 }
 
+// DeviceDataFilter narrows a telemetry query. Empty fields are ignored.
+// Rows come newest first by recorded_at, then id.
+type DeviceDataFilter struct {
+	DeviceID       string
+	DeviceModuleID string
+	From           time.Time // recorded_at >= From
+	To             time.Time // recorded_at < To
+	// Keyset cursor: only rows after (older than) this position
+	AfterRecordedAt time.Time
+	AfterID         string
+	Limit           int
+}
+
+// Aggregate functions supported by DeviceDataRepository.Aggregate.
+const (
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateCount = "count"
+	AggregateFirst = "first"
+	AggregateLast  = "last"
+)
+
+// DeviceDataAggregation buckets one numeric field of a module's readings by
+// recorded_at. Buckets start at Origin plus a whole multiple of Bucket, so
+// with a UTC midnight origin hour and day buckets match date_trunc in UTC.
+type DeviceDataAggregation struct {
+	DeviceModuleID string
+	FieldPath      []string // keys into data, e.g. {"env", "temperature"}
+	Bucket         time.Duration
+	Origin         time.Time
+	From           time.Time
+	To             time.Time // exclusive
+	Functions      []string
+	FillGaps       bool // also return the empty buckets between From and To
+}
+
+// DeviceDataBucket holds the aggregates of one bucket, keyed by function.
+// A nil value means the bucket had no numeric readings.
+type DeviceDataBucket struct {
+	Start  time.Time           `json:"start"`
+	Values map[string]*float64 `json:"values"`
+}
+
+// CommandFilter narrows a command history query. Empty fields are ignored.
+type CommandFilter struct {
+	DeviceIDs      []string // restrict to these devices; nil means no restriction
+	DeviceID       string
+	DeviceModuleID string
+	BatchID        string
+	Statuses       []string
+	Command        string
+	CreatedFrom    string // RFC3339 UTC, inclusive
+	CreatedTo      string // RFC3339 UTC, exclusive
+	AfterCreatedAt string // cursor: continue after (created_at, id) in newest-first order
+	AfterID        string
+	Limit          int
+}
+
 type CommandRepository interface {
 	Enqueue(cmd *entities.Command) error
+	GetByID(id string) (*entities.Command, error)
+	List(filter CommandFilter) ([]entities.Command, error) // newest first
 	GetPendingByDeviceID(deviceID string, limit int) ([]entities.Command, error)
-	MarkSent(ids []string) error
-	UpdateStatus(id, status, response string) error
+	// ClaimPending marks sent those of ids that are still pending and returns them,
+	// so concurrent pollers never receive the same command
+	ClaimPending(ids []string, now time.Time) ([]string, error)
+	UpdateStatus(id, status, response string) (bool, error) // only while pending or sent
+	GetTimedOut(now time.Time, limit int) ([]entities.Command, error)
+	Requeue(id string, nextAttemptAt time.Time) (bool, error)                // sent -> pending, only if still sent
+	FailDelivery(id, response string) (bool, error)                          // sent -> failed, only if still sent
+	ExpireBefore(now time.Time, response string) ([]entities.Command, error) // pending/sent past their TTL -> expired; returns them
+	Cancel(id, response string) (bool, error)                                // pending/sent -> cancelled
+	CancelSuperseded(cmd *entities.Command, response string) ([]entities.Command, error)
+	CountByBatch(batchID string) (map[string]int64, error) // status -> count
+}
+
+type UserRepository interface {
+	Create(user *entities.User) error
+	GetByID(id string) (*entities.User, error)
+	GetByUsername(username string) (*entities.User, error)
+	GetByEmail(email string) (*entities.User, error)
+	UpdatePassword(id, passwordHash string) error // also revokes the user's sessions
+	MarkEmailVerified(id string) error
+}
+
+type UserTokenRepository interface {
+	Create(token *entities.UserToken) error
+	GetByHash(purpose, tokenHash string) (*entities.UserToken, error)
+	MarkUsed(id string) error
+	DeleteByUser(userID, purpose string) error
+}
+
+type DeviceMemberRepository interface {
+	Create(member *entities.DeviceMember) error
+	GetByID(id string) (*entities.DeviceMember, error)
+	GetByDeviceAndUser(deviceID, userID string) (*entities.DeviceMember, error)
+	GetByDeviceID(deviceID string) ([]entities.DeviceMember, error)
+	GetPendingByUserID(userID string) ([]entities.DeviceMember, error)
+	Update(member *entities.DeviceMember) error
+	Delete(id string) error
+}
+
+type APIKeyRepository interface {
+	Create(key *entities.APIKey) error
+	GetByID(id string) (*entities.APIKey, error)
+	GetByPrefix(prefix string) (*entities.APIKey, error)
+	GetByUserID(userID string) ([]entities.APIKey, error)
+	Revoke(id string) error
+	TouchLastUsed(id string, at time.Time) error
+}
+
+type IdempotencyKeyRepository interface {
+	// Reserve returns false (with key loaded) if the key is already taken. An
+	// uncompleted record created before staleBefore is abandoned and reclaimed.
+	Reserve(key *entities.IdempotencyKey, staleBefore time.Time) (bool, error)
+	Complete(id string, statusCode int, response string) error
+	Delete(id string) error
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+type CommandScheduleRepository interface {
+	Create(s *entities.CommandSchedule) error
+	GetByID(id string) (*entities.CommandSchedule, error)
+	GetByUserID(userID string) ([]entities.CommandSchedule, error)
+	GetDue(now time.Time, limit int) ([]entities.CommandSchedule, error)
+	Claim(id, expectedRunAt, nextRunAt, status string, missed int) (bool, error)
+	RecordRun(run *entities.CommandScheduleRun, lastCommandID string) error
+	GetRuns(scheduleID string, limit int) ([]entities.CommandScheduleRun, error)
+	SetState(id, status, nextRunAt string) error
+	Delete(id string) error
+}
+
+type MacroRepository interface {
+	Create(m *entities.Macro) error
+	GetByID(id string) (*entities.Macro, error)
+	GetByUserID(userID string) ([]entities.Macro, error)
+	Update(m *entities.Macro) error
+	Delete(id string) error
+	CreateExecution(e *entities.MacroExecution) error
+	UpdateExecution(e *entities.MacroExecution) error
+	GetExecution(id string) (*entities.MacroExecution, error)
+	GetExecutions(macroID string, limit int) ([]entities.MacroExecution, error)
+	// InterruptStale marks running executions not updated since before as interrupted
+	InterruptStale(before time.Time) (int64, error)
+}
+
+type CommandBatchRepository interface {
+	Create(batch *entities.CommandBatch) error
+	GetByID(id string) (*entities.CommandBatch, error)
+	SetTargetCount(id string, n int) error
 }
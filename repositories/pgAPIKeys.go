@@ -0,0 +1,56 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+)
+
+type apiKeyPgRepository struct {
+	db db.Database
+}
+
+func NewAPIKeyPgRepository(database db.Database) APIKeyRepository {
+	return &apiKeyPgRepository{db: database}
+}
+
+func (r *apiKeyPgRepository) Create(key *entities.APIKey) error {
+	return r.db.GetDB().Create(key).Error
+}
+
+func (r *apiKeyPgRepository) GetByID(id string) (*entities.APIKey, error) {
+	var key entities.APIKey
+	err := r.db.GetDB().Where("id = ?", id).First(&key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *apiKeyPgRepository) GetByPrefix(prefix string) (*entities.APIKey, error) {
+	var key entities.APIKey
+	err := r.db.GetDB().Where("prefix = ?", prefix).First(&key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *apiKeyPgRepository) GetByUserID(userID string) ([]entities.APIKey, error) {
+	var keys []entities.APIKey
+	err := r.db.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+func (r *apiKeyPgRepository) Revoke(id string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return r.db.GetDB().Model(&entities.APIKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"revoked_at": now,
+		"updated_at": now,
+	}).Error
+}
+
+func (r *apiKeyPgRepository) TouchLastUsed(id string, at time.Time) error {
+	return r.db.GetDB().Model(&entities.APIKey{}).Where("id = ?", id).
+		Update("last_used_at", at.UTC().Format(time.RFC3339)).Error
+}
@@ -0,0 +1,30 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+)
+
+type commandBatchPgRepository struct {
+	db db.Database
+}
+
+func NewCommandBatchPgRepository(database db.Database) CommandBatchRepository {
+	return &commandBatchPgRepository{db: database}
+}
+
+func (r *commandBatchPgRepository) Create(batch *entities.CommandBatch) error {
+	return r.db.GetDB().Create(batch).Error
+}
+
+func (r *commandBatchPgRepository) GetByID(id string) (*entities.CommandBatch, error) {
+	var batch entities.CommandBatch
+	if err := r.db.GetDB().Where("id = ?", id).First(&batch).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func (r *commandBatchPgRepository) SetTargetCount(id string, n int) error {
+	return r.db.GetDB().Model(&entities.CommandBatch{}).Where("id = ?", id).Update("target_count", n).Error
+}
@@ -0,0 +1,90 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type commandSchedulePgRepository struct {
+	db db.Database
+}
+
+func NewCommandSchedulePgRepository(database db.Database) CommandScheduleRepository {
+	return &commandSchedulePgRepository{db: database}
+}
+
+func (r *commandSchedulePgRepository) Create(s *entities.CommandSchedule) error {
+	return r.db.GetDB().Create(s).Error
+}
+
+func (r *commandSchedulePgRepository) GetByID(id string) (*entities.CommandSchedule, error) {
+	var s entities.CommandSchedule
+	if err := r.db.GetDB().Where("id = ?", id).First(&s).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *commandSchedulePgRepository) GetByUserID(userID string) ([]entities.CommandSchedule, error) {
+	var schedules []entities.CommandSchedule
+	err := r.db.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&schedules).Error
+	return schedules, err
+}
+
+func (r *commandSchedulePgRepository) GetDue(now time.Time, limit int) ([]entities.CommandSchedule, error) {
+	var schedules []entities.CommandSchedule
+	err := r.db.GetDB().
+		Where("status = ? AND next_run_at <> '' AND next_run_at <= ?", entities.ScheduleStatusActive, now.UTC().Format(time.RFC3339)).
+		Order("next_run_at ASC").Limit(limit).Find(&schedules).Error
+	return schedules, err
+}
+
+// Claim advances a due schedule to its next run. Only one caller can claim a
+// given run: the update is conditional on next_run_at still being expectedRunAt,
+// which makes the scheduler safe to run on several instances.
+func (r *commandSchedulePgRepository) Claim(id, expectedRunAt, nextRunAt, status string, missed int) (bool, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	res := r.db.GetDB().Model(&entities.CommandSchedule{}).
+		Where("id = ? AND status = ? AND next_run_at = ?", id, entities.ScheduleStatusActive, expectedRunAt).
+		Updates(map[string]interface{}{
+			"next_run_at": nextRunAt,
+			"status":      status,
+			"missed_runs": gorm.Expr("missed_runs + ?", missed),
+			"updated_at":  now,
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r *commandSchedulePgRepository) RecordRun(run *entities.CommandScheduleRun, lastCommandID string) error {
+	if err := r.db.GetDB().Create(run).Error; err != nil {
+		return err
+	}
+	if run.Status != entities.ScheduleRunEnqueued {
+		return nil
+	}
+	return r.db.GetDB().Model(&entities.CommandSchedule{}).Where("id = ?", run.ScheduleID).Updates(map[string]interface{}{
+		"last_run_at":     run.ScheduledFor,
+		"last_command_id": lastCommandID,
+	}).Error
+}
+
+func (r *commandSchedulePgRepository) GetRuns(scheduleID string, limit int) ([]entities.CommandScheduleRun, error) {
+	var runs []entities.CommandScheduleRun
+	err := r.db.GetDB().Where("schedule_id = ?", scheduleID).Order("scheduled_for DESC, created_at DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+func (r *commandSchedulePgRepository) SetState(id, status, nextRunAt string) error {
+	return r.db.GetDB().Model(&entities.CommandSchedule{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":      status,
+		"next_run_at": nextRunAt,
+		"updated_at":  time.Now().UTC().Format(time.RFC3339),
+	}).Error
+}
+
+func (r *commandSchedulePgRepository) Delete(id string) error {
+	return r.db.GetDB().Where("id = ?", id).Delete(&entities.CommandSchedule{}).Error
+}
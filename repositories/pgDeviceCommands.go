@@ -6,6 +6,9 @@ import (
 
 	"iot-server/db"
 	"iot-server/entities"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type commandPgRepository struct {
@@ -16,31 +19,133 @@ func NewCommandPgRepository(database db.Database) CommandRepository {
 	return &commandPgRepository{db: database}
 }
 
+// Enqueue stores the command with the next sequence number of its device.
+// The upsert locks the device's counter row until the transaction commits, so
+// sequence numbers follow insertion order.
 func (r *commandPgRepository) Enqueue(cmd *entities.Command) error {
-	return r.db.GetDB().Create(cmd).Error
+	return r.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Raw(`INSERT INTO device_command_sequences (device_id, seq) VALUES (?, 1)
+			ON CONFLICT (device_id) DO UPDATE SET seq = device_command_sequences.seq + 1
+			RETURNING seq`, cmd.DeviceID).Scan(&cmd.Seq).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(cmd).Error
+	})
+}
+
+func (r *commandPgRepository) GetByID(id string) (*entities.Command, error) {
+	var cmd entities.Command
+	err := r.db.GetDB().Where("id = ?", id).First(&cmd).Error
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+func (r *commandPgRepository) List(f CommandFilter) ([]entities.Command, error) {
+	if f.DeviceIDs != nil && len(f.DeviceIDs) == 0 {
+		return []entities.Command{}, nil
+	}
+	q := r.db.GetDB().Model(&entities.Command{})
+	if f.DeviceIDs != nil {
+		q = q.Where("device_id IN ?", f.DeviceIDs)
+	}
+	if f.DeviceID != "" {
+		q = q.Where("device_id = ?", f.DeviceID)
+	}
+	if f.DeviceModuleID != "" {
+		q = q.Where("device_module_id = ?", f.DeviceModuleID)
+	}
+	if f.BatchID != "" {
+		q = q.Where("batch_id = ?", f.BatchID)
+	}
+	if len(f.Statuses) > 0 {
+		q = q.Where("status IN ?", f.Statuses)
+	}
+	if f.Command != "" {
+		q = q.Where("command = ?", f.Command)
+	}
+	if f.CreatedFrom != "" {
+		q = q.Where("created_at >= ?", f.CreatedFrom)
+	}
+	if f.CreatedTo != "" {
+		q = q.Where("created_at < ?", f.CreatedTo)
+	}
+	if f.AfterCreatedAt != "" {
+		q = q.Where("(created_at < ? OR (created_at = ? AND id < ?))", f.AfterCreatedAt, f.AfterCreatedAt, f.AfterID)
+	}
+	var cmds []entities.Command
+	err := q.Order("created_at DESC, id DESC").Limit(f.Limit).Find(&cmds).Error
+	return cmds, err
 }
 
+// GetPendingByDeviceID returns commands ready for delivery: pending, past
+// their retry backoff and not expired, highest priority first and then in
+// sequence order. A command waits while an earlier command for the same
+// module, of at least its priority, is unacknowledged or backing off, so a
+// module never sees its commands out of order; only a higher priority
+// command may overtake. Timestamps are RFC3339 UTC strings, so they compare
+// correctly as text.
 func (r *commandPgRepository) GetPendingByDeviceID(deviceID string, limit int) ([]entities.Command, error) {
 	if limit <= 0 {
 		limit = 10
 	}
+	now := time.Now().UTC().Format(time.RFC3339)
 	var cmds []entities.Command
-	err := r.db.GetDB().Where("device_id = ? AND status = ?", deviceID, "pending").Order("created_at ASC").Limit(limit).Find(&cmds).Error
+	err := r.db.GetDB().
+		Where("device_id = ? AND status = ?", deviceID, entities.CommandStatusPending).
+		Where("(next_attempt_at IS NULL OR next_attempt_at = '' OR next_attempt_at <= ?)", now).
+		Where("(expires_at IS NULL OR expires_at = '' OR expires_at > ?)", now).
+		Where(`NOT EXISTS (SELECT 1 FROM commands b
+			WHERE b.device_id = commands.device_id AND b.device_module_id = commands.device_module_id
+			AND b.seq < commands.seq AND b.priority >= commands.priority AND b.deleted_at IS NULL
+			AND (b.status = ? OR (b.status = ? AND b.next_attempt_at > ?)))`,
+			entities.CommandStatusSent, entities.CommandStatusPending, now).
+		Order("priority DESC, seq ASC, created_at ASC").Limit(limit).Find(&cmds).Error
 	return cmds, err
 }
 
-func (r *commandPgRepository) MarkSent(ids []string) error {
+// ClaimPending records a delivery of each command that is still pending,
+// bumping attempts and setting its ack deadline, and returns the ids updated.
+// Commands another caller already moved on are skipped.
+func (r *commandPgRepository) ClaimPending(ids []string, now time.Time) ([]string, error) {
 	if len(ids) == 0 {
+		return nil, nil
+	}
+	now = now.UTC()
+	var updated []string
+	err := r.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var cmds []entities.Command
+		if err := tx.Where("id IN ?", ids).Find(&cmds).Error; err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			res := tx.Model(&entities.Command{}).Where("id = ? AND status = ?", cmd.ID, entities.CommandStatusPending).Updates(map[string]interface{}{
+				"status":       entities.CommandStatusSent,
+				"attempts":     gorm.Expr("attempts + 1"),
+				"ack_deadline": now.Add(time.Duration(cmd.AckTimeout) * time.Second).Format(time.RFC3339),
+				"updated_at":   now.Format(time.RFC3339),
+			})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				updated = append(updated, cmd.ID)
+			}
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	now := time.Now().UTC().Format(time.RFC3339)
-	return r.db.GetDB().Model(&entities.Command{}).Where("id IN ?", ids).Updates(map[string]interface{}{
-		"status":     "sent",
-		"updated_at": now,
-	}).Error
+	return updated, nil
 }
 
-func (r *commandPgRepository) UpdateStatus(id, status, response string) error {
+// UpdateStatus records a command's final status. It reports false, leaving the
+// command untouched, if it is no longer pending or sent, e.g. because it was
+// already acknowledged, cancelled or expired.
+func (r *commandPgRepository) UpdateStatus(id, status, response string) (bool, error) {
 	now := time.Now().UTC().Format(time.RFC3339)
 	updates := map[string]interface{}{
 		"status":     status,
@@ -54,5 +159,109 @@ func (r *commandPgRepository) UpdateStatus(id, status, response string) error {
 		}
 		updates["response"] = response
 	}
-	return r.db.GetDB().Model(&entities.Command{}).Where("id = ?", id).Updates(updates).Error
+	res := r.db.GetDB().Model(&entities.Command{}).
+		Where("id = ? AND status IN ?", id, []string{entities.CommandStatusPending, entities.CommandStatusSent}).
+		Updates(updates)
+	return res.RowsAffected > 0, res.Error
+}
+
+// GetTimedOut returns sent commands whose ack deadline has passed. A sent
+// command without a deadline predates ack tracking and is treated as due, so
+// it cannot hold back the rest of its module's queue forever.
+func (r *commandPgRepository) GetTimedOut(now time.Time, limit int) ([]entities.Command, error) {
+	var cmds []entities.Command
+	err := r.db.GetDB().
+		Where("status = ? AND (ack_deadline IS NULL OR ack_deadline = '' OR ack_deadline <= ?)", entities.CommandStatusSent, now.UTC().Format(time.RFC3339)).
+		Order("ack_deadline ASC").Limit(limit).Find(&cmds).Error
+	return cmds, err
+}
+
+// Requeue puts a timed-out command back in the queue. It reports false if the
+// command was acknowledged (or otherwise moved on) in the meantime.
+func (r *commandPgRepository) Requeue(id string, nextAttemptAt time.Time) (bool, error) {
+	res := r.db.GetDB().Model(&entities.Command{}).
+		Where("id = ? AND status = ?", id, entities.CommandStatusSent).
+		Updates(map[string]interface{}{
+			"status":          entities.CommandStatusPending,
+			"ack_deadline":    "",
+			"next_attempt_at": nextAttemptAt.UTC().Format(time.RFC3339),
+			"updated_at":      time.Now().UTC().Format(time.RFC3339),
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+// FailDelivery marks a command that ran out of delivery attempts as failed.
+func (r *commandPgRepository) FailDelivery(id, response string) (bool, error) {
+	res := r.db.GetDB().Model(&entities.Command{}).
+		Where("id = ? AND status = ?", id, entities.CommandStatusSent).
+		Updates(map[string]interface{}{
+			"status":       entities.CommandStatusFailed,
+			"ack_deadline": "",
+			"response":     response,
+			"updated_at":   time.Now().UTC().Format(time.RFC3339),
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+// ExpireBefore expires every undelivered or unacknowledged command whose TTL has passed.
+func (r *commandPgRepository) ExpireBefore(now time.Time, response string) ([]entities.Command, error) {
+	ts := now.UTC().Format(time.RFC3339)
+	var expired []entities.Command
+	res := r.db.GetDB().Model(&expired).Clauses(clause.Returning{}).
+		Where("status IN ? AND expires_at <> '' AND expires_at <= ?",
+			[]string{entities.CommandStatusPending, entities.CommandStatusSent}, ts).
+		Updates(map[string]interface{}{
+			"status":       entities.CommandStatusExpired,
+			"ack_deadline": "",
+			"response":     response,
+			"updated_at":   ts,
+		})
+	return expired, res.Error
+}
+
+// Cancel withdraws a command that has not been acknowledged yet.
+func (r *commandPgRepository) Cancel(id, response string) (bool, error) {
+	res := r.db.GetDB().Model(&entities.Command{}).
+		Where("id = ? AND status IN ?", id, []string{entities.CommandStatusPending, entities.CommandStatusSent}).
+		Updates(map[string]interface{}{
+			"status":       entities.CommandStatusCancelled,
+			"ack_deadline": "",
+			"response":     response,
+			"updated_at":   time.Now().UTC().Format(time.RFC3339),
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+// CancelSuperseded cancels pending commands queued before cmd for the same
+// device, module and supersede key, and returns the ones it cancelled.
+func (r *commandPgRepository) CancelSuperseded(cmd *entities.Command, response string) ([]entities.Command, error) {
+	var cancelled []entities.Command
+	res := r.db.GetDB().Model(&cancelled).Clauses(clause.Returning{}).
+		Where("device_id = ? AND device_module_id = ? AND supersede_key = ? AND status = ? AND id <> ? AND seq < ?",
+			cmd.DeviceID, cmd.DeviceModuleID, cmd.SupersedeKey, entities.CommandStatusPending, cmd.ID, cmd.Seq).
+		Updates(map[string]interface{}{
+			"status":     entities.CommandStatusCancelled,
+			"response":   response,
+			"updated_at": time.Now().UTC().Format(time.RFC3339),
+		})
+	return cancelled, res.Error
+}
+
+func (r *commandPgRepository) CountByBatch(batchID string) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := r.db.GetDB().Model(&entities.Command{}).
+		Select("status, COUNT(*) AS count").
+		Where("batch_id = ?", batchID).
+		Group("status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
 }
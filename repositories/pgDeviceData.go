@@ -1,8 +1,11 @@
 package repositories
 
 import (
+	"database/sql"
+	"fmt"
 	"iot-server/db"
 	"iot-server/entities"
+	"strings"
 	"time"
 )
 
@@ -27,16 +30,118 @@ func (r *deviceDataPgRepository) GetByID(id string) (*entities.DeviceData, error
 	return &data, nil
 }
 
-func (r *deviceDataPgRepository) GetAll() ([]entities.DeviceData, error) {
+func (r *deviceDataPgRepository) List(f DeviceDataFilter) ([]entities.DeviceData, error) {
+	q := r.db.GetDB().Model(&entities.DeviceData{})
+	if f.DeviceID != "" {
+		q = q.Where("device_id = ?", f.DeviceID)
+	}
+	if f.DeviceModuleID != "" {
+		q = q.Where("device_module_id = ?", f.DeviceModuleID)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("recorded_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("recorded_at < ?", f.To)
+	}
+	if !f.AfterRecordedAt.IsZero() {
+		q = q.Where("(recorded_at < ? OR (recorded_at = ? AND id < ?))", f.AfterRecordedAt, f.AfterRecordedAt, f.AfterID)
+	}
 	var data []entities.DeviceData
-	err := r.db.GetDB().Order("created_at DESC").Find(&data).Error
+	err := q.Order("recorded_at DESC, id DESC").Limit(f.Limit).Find(&data).Error
 	return data, err
 }
 
-func (r *deviceDataPgRepository) GetByDeviceID(deviceID string) ([]entities.DeviceData, error) {
-	var data []entities.DeviceData
-	err := r.db.GetDB().Where("device_id = ?", deviceID).Order("created_at DESC").Find(&data).Error
-	return data, err
+// aggregateSQL maps each aggregate function to its expression over the
+// bucketed readings (v is the numeric field, NULL when missing or not a number).
+var aggregateSQL = map[string]string{
+	AggregateAvg:   "avg(v)",
+	AggregateMin:   "min(v)",
+	AggregateMax:   "max(v)",
+	AggregateCount: "count(v)",
+	AggregateFirst: "(array_agg(v ORDER BY recorded_at ASC, id ASC) FILTER (WHERE v IS NOT NULL))[1]",
+	AggregateLast:  "(array_agg(v ORDER BY recorded_at DESC, id DESC) FILTER (WHERE v IS NOT NULL))[1]",
+}
+
+// Aggregate computes the requested functions per bucket in Postgres. With
+// FillGaps the buckets come from generate_series, so empty ones are returned
+// with NULL values and a count of 0.
+func (r *deviceDataPgRepository) Aggregate(a DeviceDataAggregation) ([]DeviceDataBucket, error) {
+	cols := make([]string, 0, len(a.Functions))
+	outer := make([]string, 0, len(a.Functions))
+	for i, fn := range a.Functions {
+		expr, ok := aggregateSQL[fn]
+		if !ok {
+			return nil, fmt.Errorf("unsupported aggregate function %q", fn)
+		}
+		cols = append(cols, fmt.Sprintf("%s AS f%d", expr, i))
+		if fn == AggregateCount {
+			outer = append(outer, fmt.Sprintf("COALESCE(agg.f%d, 0)", i))
+		} else {
+			outer = append(outer, fmt.Sprintf("agg.f%d", i))
+		}
+	}
+
+	buckets := "agg"
+	if a.FillGaps {
+		buckets = `generate_series(
+			to_timestamp(CAST(@origin AS double precision) + floor((extract(epoch FROM CAST(@from AS timestamptz)) - CAST(@origin AS double precision)) / @secs) * @secs),
+			CAST(@to AS timestamptz) - interval '1 microsecond',
+			make_interval(secs => @secs)) AS b(bucket)
+			LEFT JOIN agg USING (bucket)`
+	}
+	query := `WITH readings AS (
+			SELECT id, recorded_at,
+				to_timestamp(CAST(@origin AS double precision) + floor((extract(epoch FROM recorded_at) - CAST(@origin AS double precision)) / @secs) * @secs) AS bucket,
+				CASE WHEN jsonb_typeof(data #> CAST(@path AS text[])) = 'number'
+					THEN (data #>> CAST(@path AS text[]))::double precision END AS v
+			FROM device_data
+			WHERE device_module_id = @module AND deleted_at IS NULL
+				AND recorded_at >= @from AND recorded_at < @to
+		), agg AS (
+			SELECT bucket, ` + strings.Join(cols, ", ") + `
+			FROM readings GROUP BY bucket
+		)
+		SELECT bucket, ` + strings.Join(outer, ", ") + `
+		FROM ` + buckets + `
+		ORDER BY bucket`
+
+	rows, err := r.db.GetDB().Raw(query, map[string]interface{}{
+		"secs":   a.Bucket.Seconds(),
+		"origin": float64(a.Origin.Unix()),
+		"path":   "{" + strings.Join(a.FieldPath, ",") + "}",
+		"module": a.DeviceModuleID,
+		"from":   a.From,
+		"to":     a.To,
+	}).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []DeviceDataBucket
+	for rows.Next() {
+		var start time.Time
+		values := make([]sql.NullFloat64, len(a.Functions))
+		dest := []interface{}{&start}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		bucket := DeviceDataBucket{Start: start.UTC(), Values: make(map[string]*float64, len(values))}
+		for i, fn := range a.Functions {
+			if values[i].Valid {
+				v := values[i].Float64
+				bucket.Values[fn] = &v
+			} else {
+				bucket.Values[fn] = nil
+			}
+		}
+		result = append(result, bucket)
+	}
+	return result, rows.Err()
 }
 
 func (r *deviceDataPgRepository) GetLatestByModuleID(moduleID string) (*entities.DeviceData, error) {
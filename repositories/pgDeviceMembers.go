@@ -0,0 +1,59 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+)
+
+type deviceMemberPgRepository struct {
+	db db.Database
+}
+
+func NewDeviceMemberPgRepository(database db.Database) DeviceMemberRepository {
+	return &deviceMemberPgRepository{db: database}
+}
+
+func (r *deviceMemberPgRepository) Create(member *entities.DeviceMember) error {
+	return r.db.GetDB().Create(member).Error
+}
+
+func (r *deviceMemberPgRepository) GetByID(id string) (*entities.DeviceMember, error) {
+	var member entities.DeviceMember
+	err := r.db.GetDB().Where("id = ?", id).First(&member).Error
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (r *deviceMemberPgRepository) GetByDeviceAndUser(deviceID, userID string) (*entities.DeviceMember, error) {
+	var member entities.DeviceMember
+	err := r.db.GetDB().Where("device_id = ? AND user_id = ?", deviceID, userID).First(&member).Error
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (r *deviceMemberPgRepository) GetByDeviceID(deviceID string) ([]entities.DeviceMember, error) {
+	var members []entities.DeviceMember
+	err := r.db.GetDB().Where("device_id = ?", deviceID).Order("created_at ASC").Find(&members).Error
+	return members, err
+}
+
+func (r *deviceMemberPgRepository) GetPendingByUserID(userID string) ([]entities.DeviceMember, error) {
+	var members []entities.DeviceMember
+	err := r.db.GetDB().Where("user_id = ? AND status = ?", userID, entities.MemberStatusPending).
+		Order("created_at DESC").Find(&members).Error
+	return members, err
+}
+
+func (r *deviceMemberPgRepository) Update(member *entities.DeviceMember) error {
+	member.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return r.db.GetDB().Save(member).Error
+}
+
+func (r *deviceMemberPgRepository) Delete(id string) error {
+	return r.db.GetDB().Where("id = ?", id).Delete(&entities.DeviceMember{}).Error
+}
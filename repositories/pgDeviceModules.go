@@ -33,9 +33,16 @@ func (r *deviceModulePgRepository) GetAll() ([]entities.DeviceModule, error) {
 	return modules, err
 }
 
-func (r *deviceModulePgRepository) GetByUserID(userID string) ([]entities.DeviceModule, error) {
-	var modules []entities.DeviceModule
-	err := r.db.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&modules).Error
+func (r *deviceModulePgRepository) GetByUserID(userID string) ([]entities.DeviceModuleWithRole, error) {
+	var modules []entities.DeviceModuleWithRole
+	err := r.db.GetDB().Model(&entities.DeviceModule{}).
+		Select("device_modules.*, CASE WHEN device_modules.user_id = ? OR d.user_id = ? THEN ? ELSE dm.role END AS role",
+			userID, userID, entities.MemberRoleOwner).
+		Joins("LEFT JOIN devices d ON d.id = device_modules.device_id AND d.deleted_at IS NULL").
+		Joins("LEFT JOIN device_members dm ON dm.device_id = device_modules.device_id AND dm.user_id = ? AND dm.status = ?", userID, entities.MemberStatusAccepted).
+		Where("device_modules.user_id = ? OR d.user_id = ? OR dm.id IS NOT NULL", userID, userID).
+		Order("device_modules.created_at DESC").
+		Scan(&modules).Error
 	return modules, err
 }
 
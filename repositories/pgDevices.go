@@ -33,9 +33,14 @@ func (r *devicePgRepository) GetAll() ([]entities.Device, error) {
 	return devices, err
 }
 
-func (r *devicePgRepository) GetByUserID(userID string) ([]entities.Device, error) {
-	var devices []entities.Device
-	err := r.db.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&devices).Error
+func (r *devicePgRepository) GetByUserID(userID string) ([]entities.DeviceWithRole, error) {
+	var devices []entities.DeviceWithRole
+	err := r.db.GetDB().Model(&entities.Device{}).
+		Select("devices.*, CASE WHEN devices.user_id = ? THEN ? ELSE dm.role END AS role", userID, entities.MemberRoleOwner).
+		Joins("LEFT JOIN device_members dm ON dm.device_id = devices.id AND dm.user_id = ? AND dm.status = ?", userID, entities.MemberStatusAccepted).
+		Where("devices.user_id = ? OR dm.id IS NOT NULL", userID).
+		Order("devices.created_at DESC").
+		Scan(&devices).Error
 	return devices, err
 }
 
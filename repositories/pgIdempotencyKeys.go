@@ -0,0 +1,56 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+type idempotencyKeyPgRepository struct {
+	db db.Database
+}
+
+func NewIdempotencyKeyPgRepository(database db.Database) IdempotencyKeyRepository {
+	return &idempotencyKeyPgRepository{db: database}
+}
+
+// Reserve inserts the key unless a live one exists for the same scope. It
+// reports false, and loads the existing record into key, when it was already taken.
+func (r *idempotencyKeyPgRepository) Reserve(key *entities.IdempotencyKey, staleBefore time.Time) (bool, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	// An expired record no longer guards anything, and neither does a
+	// reservation whose request died before completing it
+	if err := r.db.GetDB().Where("scope = ? AND key = ? AND (expires_at <= ? OR (completed = ? AND created_at <= ?))",
+		key.Scope, key.Key, now, false, staleBefore.UTC().Format(time.RFC3339)).
+		Delete(&entities.IdempotencyKey{}).Error; err != nil {
+		return false, err
+	}
+	res := r.db.GetDB().Clauses(clause.OnConflict{DoNothing: true}).Create(key)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+	err := r.db.GetDB().Where("scope = ? AND key = ?", key.Scope, key.Key).First(key).Error
+	return false, err
+}
+
+func (r *idempotencyKeyPgRepository) Complete(id string, statusCode int, response string) error {
+	return r.db.GetDB().Model(&entities.IdempotencyKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"completed":   true,
+		"status_code": statusCode,
+		"response":    response,
+	}).Error
+}
+
+func (r *idempotencyKeyPgRepository) Delete(id string) error {
+	return r.db.GetDB().Where("id = ?", id).Delete(&entities.IdempotencyKey{}).Error
+}
+
+func (r *idempotencyKeyPgRepository) DeleteExpired(now time.Time) (int64, error) {
+	res := r.db.GetDB().Where("expires_at <= ?", now.UTC().Format(time.RFC3339)).Delete(&entities.IdempotencyKey{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,91 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+)
+
+type macroPgRepository struct {
+	db db.Database
+}
+
+func NewMacroPgRepository(database db.Database) MacroRepository {
+	return &macroPgRepository{db: database}
+}
+
+func (r *macroPgRepository) Create(m *entities.Macro) error {
+	return r.db.GetDB().Create(m).Error
+}
+
+func (r *macroPgRepository) GetByID(id string) (*entities.Macro, error) {
+	var m entities.Macro
+	if err := r.db.GetDB().Where("id = ?", id).First(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *macroPgRepository) GetByUserID(userID string) ([]entities.Macro, error) {
+	var macros []entities.Macro
+	err := r.db.GetDB().Where("user_id = ?", userID).Order("created_at DESC").Find(&macros).Error
+	return macros, err
+}
+
+func (r *macroPgRepository) Update(m *entities.Macro) error {
+	m.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return r.db.GetDB().Model(&entities.Macro{}).Where("id = ?", m.ID).Updates(map[string]interface{}{
+		"name":        m.Name,
+		"description": m.Description,
+		"steps":       m.Steps,
+		"updated_at":  m.UpdatedAt,
+	}).Error
+}
+
+func (r *macroPgRepository) Delete(id string) error {
+	return r.db.GetDB().Where("id = ?", id).Delete(&entities.Macro{}).Error
+}
+
+func (r *macroPgRepository) CreateExecution(e *entities.MacroExecution) error {
+	return r.db.GetDB().Create(e).Error
+}
+
+// UpdateExecution saves progress of a running execution. It never overwrites
+// an execution that was already marked interrupted.
+func (r *macroPgRepository) UpdateExecution(e *entities.MacroExecution) error {
+	e.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return r.db.GetDB().Model(&entities.MacroExecution{}).
+		Where("id = ? AND status = ?", e.ID, entities.MacroExecutionRunning).
+		Updates(map[string]interface{}{
+			"status":      e.Status,
+			"steps":       e.Steps,
+			"finished_at": e.FinishedAt,
+			"updated_at":  e.UpdatedAt,
+		}).Error
+}
+
+func (r *macroPgRepository) GetExecution(id string) (*entities.MacroExecution, error) {
+	var e entities.MacroExecution
+	if err := r.db.GetDB().Where("id = ?", id).First(&e).Error; err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (r *macroPgRepository) GetExecutions(macroID string, limit int) ([]entities.MacroExecution, error) {
+	var execs []entities.MacroExecution
+	err := r.db.GetDB().Where("macro_id = ?", macroID).Order("started_at DESC").Limit(limit).Find(&execs).Error
+	return execs, err
+}
+
+func (r *macroPgRepository) InterruptStale(before time.Time) (int64, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	res := r.db.GetDB().Model(&entities.MacroExecution{}).
+		Where("status = ? AND updated_at < ?", entities.MacroExecutionRunning, before.UTC().Format(time.RFC3339)).
+		Updates(map[string]interface{}{
+			"status":      entities.MacroExecutionInterrupted,
+			"finished_at": now,
+			"updated_at":  now,
+		})
+	return res.RowsAffected, res.Error
+}
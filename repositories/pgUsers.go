@@ -0,0 +1,106 @@
+package repositories
+
+import (
+	"iot-server/db"
+	"iot-server/entities"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type userPgRepository struct {
+	db db.Database
+}
+
+func NewUserPgRepository(database db.Database) UserRepository {
+	return &userPgRepository{db: database}
+}
+
+func (r *userPgRepository) Create(user *entities.User) error {
+	return r.db.GetDB().Create(user).Error
+}
+
+func (r *userPgRepository) GetByID(id string) (*entities.User, error) {
+	var user entities.User
+	err := r.db.GetDB().Where("id = ?", id).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *userPgRepository) GetByUsername(username string) (*entities.User, error) {
+	var user entities.User
+	err := r.db.GetDB().Where("username = ?", username).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *userPgRepository) GetByEmail(email string) (*entities.User, error) {
+	var user entities.User
+	err := r.db.GetDB().Where("LOWER(email) = LOWER(?)", email).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdatePassword stores a new hash and bumps the token version, so sessions
+// issued with the old password stop working.
+func (r *userPgRepository) UpdatePassword(id, passwordHash string) error {
+	return r.db.GetDB().Model(&entities.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"password_hash": passwordHash,
+		"token_version": gorm.Expr("token_version + 1"),
+		"updated_at":    time.Now().UTC().Format(time.RFC3339),
+	}).Error
+}
+
+func (r *userPgRepository) MarkEmailVerified(id string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return r.db.GetDB().Model(&entities.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"email_verified":    true,
+		"email_verified_at": now,
+		"updated_at":        now,
+	}).Error
+}
+
+type userTokenPgRepository struct {
+	db db.Database
+}
+
+func NewUserTokenPgRepository(database db.Database) UserTokenRepository {
+	return &userTokenPgRepository{db: database}
+}
+
+func (r *userTokenPgRepository) Create(token *entities.UserToken) error {
+	return r.db.GetDB().Create(token).Error
+}
+
+func (r *userTokenPgRepository) GetByHash(purpose, tokenHash string) (*entities.UserToken, error) {
+	var token entities.UserToken
+	err := r.db.GetDB().Where("purpose = ? AND token_hash = ?", purpose, tokenHash).First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// MarkUsed flags the token as consumed; it fails if the token was already used.
+func (r *userTokenPgRepository) MarkUsed(id string) error {
+	res := r.db.GetDB().Model(&entities.UserToken{}).
+		Where("id = ? AND (used_at IS NULL OR used_at = '')", id).
+		Update("used_at", time.Now().UTC().Format(time.RFC3339))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *userTokenPgRepository) DeleteByUser(userID, purpose string) error {
+	return r.db.GetDB().Where("user_id = ? AND purpose = ?", userID, purpose).Delete(&entities.UserToken{}).Error
+}
@@ -1,6 +1,11 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"iot-server/auth"
+	"iot-server/cache"
+	"iot-server/confs"
 	"iot-server/db"
 	"iot-server/handlers"
 	httpHandler "iot-server/handlers/http"
@@ -8,9 +13,17 @@ import (
 	"iot-server/services"
 	"iot-server/usecases"
 	"iot-server/ws"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 type Server struct {
@@ -20,17 +33,24 @@ type Server struct {
 
 func NewServer(database db.Database) *Server {
 	return &Server{
-		app: gin.Default(),
+		app: newEngine(),
 		db:  database,
 	}
 }
 
+// newEngine is gin.Default with an access logger that redacts secret query params.
+func newEngine() *gin.Engine {
+	app := gin.New()
+	app.Use(httpHandler.RequestLogger(), gin.Recovery())
+	return app
+}
+
 func (s *Server) Start() {
 	// Setup CORS middleware
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true // Allow all origins for development
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", httpHandler.HeaderIdempotencyKey}
 	s.app.Use(cors.New(config))
 
 	// Setup healthcheck route
@@ -47,76 +67,265 @@ func (s *Server) Start() {
 
 	// Initialize use cases
 	deviceUseCase := usecases.NewDeviceUseCase(deviceRepo, deviceDataRepo, deviceModuleRepo)
-	commandsUseCase := usecases.NewCommandsUseCase(repositories.NewCommandPgRepository(s.db))
+	delivery := usecases.DefaultDeliveryPolicy()
+	delivery.AckTimeout = confs.GetDuration("COMMAND_ACK_TIMEOUT", delivery.AckTimeout)
+	delivery.MaxAttempts = confs.GetInt("COMMAND_MAX_ATTEMPTS", delivery.MaxAttempts)
+	delivery.RetryBackoff = confs.GetDuration("COMMAND_RETRY_BACKOFF", delivery.RetryBackoff)
+	delivery.MaxRetryBackoff = confs.GetDuration("COMMAND_RETRY_BACKOFF_MAX", delivery.MaxRetryBackoff)
+	delivery.TTL = confs.GetDuration("COMMAND_TTL", delivery.TTL)
+	delivery.UrgentCommands = confs.GetList("COMMAND_URGENT", delivery.UrgentCommands)
+	commandsUseCase := usecases.NewCommandsUseCase(repositories.NewCommandPgRepository(s.db), deviceModuleRepo, delivery)
+	deviceMemberRepo := repositories.NewDeviceMemberPgRepository(s.db)
+	userRepo := repositories.NewUserPgRepository(s.db)
+	authz := usecases.NewAuthorizer(deviceRepo, deviceModuleRepo, deviceDataRepo, deviceMemberRepo)
+	sharingUseCase := usecases.NewSharingUseCase(deviceMemberRepo, userRepo, deviceRepo)
 
-	// Initialize data processor (cache) without thresholds; store all cached points
-	processor := services.NewDataProcessor(s.db, 0, 0)
+	// Initialize data processor (cache) without thresholds; store all cached points.
+	// It flushes every DATA_FLUSH_INTERVAL, or early once DATA_FLUSH_MAX_POINTS are cached.
+	// TELEMETRY_CACHE_POLICY decides what happens once a cache limit is reached.
+	cachePolicy := cache.OverflowBackpressure
+	if v := os.Getenv("TELEMETRY_CACHE_POLICY"); v != "" {
+		if p, err := cache.ParseOverflowPolicy(v); err != nil {
+			log.Printf("warning: %v, using %s", err, cachePolicy)
+		} else {
+			cachePolicy = p
+		}
+	}
+	processor := services.NewDataProcessor(s.db,
+		confs.GetDuration("DATA_FLUSH_INTERVAL", 5*time.Minute),
+		confs.GetInt("DATA_FLUSH_MAX_POINTS", 1000),
+		cache.Limits{
+			MaxPoints:          confs.GetInt("TELEMETRY_CACHE_MAX_POINTS", 100000),
+			MaxPointsPerDevice: confs.GetInt("TELEMETRY_CACHE_MAX_POINTS_PER_DEVICE", 10000),
+			Policy:             cachePolicy,
+			RetryAfter:         confs.GetDuration("TELEMETRY_CACHE_RETRY_AFTER", 5*time.Second),
+		})
+	// Points are written to TELEMETRY_WAL_DIR before they are acknowledged; "off" disables the log
+	if walDir := os.Getenv("TELEMETRY_WAL_DIR"); walDir != "off" {
+		if walDir == "" {
+			walDir = "data/telemetry-wal"
+		}
+		if err := processor.EnableWAL(walDir, confs.GetBool("TELEMETRY_WAL_SYNC", true)); err != nil {
+			log.Fatalf("Failed to open telemetry WAL: %v", err)
+		}
+	} else {
+		log.Println("WARNING: TELEMETRY_WAL_DIR is off, cached telemetry is lost if the server stops")
+	}
+	processor.Start()
 
 	// Initialize handlers
-	deviceHandler := httpHandler.NewDeviceHandler(deviceUseCase)
-	deviceModuleHandler := httpHandler.NewDeviceModuleHandler(deviceUseCase)
+	deviceHandler := httpHandler.NewDeviceHandler(deviceUseCase, authz)
+	deviceModuleHandler := httpHandler.NewDeviceModuleHandler(deviceUseCase, authz)
+
+	// Devices registered before per-device secrets can be allowed in while they are re-provisioned
+	allowLegacyDevices := confs.GetBool("DEVICE_AUTH_ALLOW_LEGACY", false)
+	if allowLegacyDevices {
+		log.Println("WARNING: DEVICE_AUTH_ALLOW_LEGACY is set, device endpoints accept requests without credentials")
+	}
+	requireDevice := httpHandler.DeviceAuthMiddleware(deviceUseCase, allowLegacyDevices)
 
 	// WebSocket manager and handler
 	manager := ws.NewManager()
-	wsHandler := handlers.NewWSHandler(manager, deviceUseCase, processor)
+	wsHandler := handlers.NewWSHandler(manager, deviceUseCase, commandsUseCase, processor, allowLegacyDevices)
+
+	// Redeliver unacknowledged commands and expire stale ones
+	commandsUseCase.SetPusher(manager)
+	if confs.GetBool("COMMAND_EVENT_LOG", false) {
+		commandsUseCase.OnDeliveryEvent(func(ev usecases.DeliveryEvent) {
+			log.Printf("command %s %s for device %s: %s %s", ev.Command.ID, ev.Command.Command, ev.Command.DeviceID, ev.Kind, ev.Transport)
+		})
+	}
+	commandsUseCase.StartSweeper(confs.GetDuration("COMMAND_SWEEP_INTERVAL", 10*time.Second))
 
-	cmdHandler := httpHandler.NewCommandHandler(manager, commandsUseCase)
+	cmdHandler := httpHandler.NewCommandHandler(commandsUseCase, authz)
+	batchHandler := httpHandler.NewBatchHandler(usecases.NewBatchUseCase(repositories.NewCommandBatchPgRepository(s.db), commandsUseCase, deviceModuleRepo, authz))
+
+	// Retried requests carrying an Idempotency-Key get the original response
+	idempotencyUseCase := usecases.NewIdempotencyUseCase(repositories.NewIdempotencyKeyPgRepository(s.db),
+		confs.GetDuration("IDEMPOTENCY_RETENTION", 24*time.Hour))
+	idempotencyUseCase.SetLease(confs.GetDuration("IDEMPOTENCY_LEASE", 5*time.Minute))
+	idempotencyUseCase.StartCleanup(time.Hour)
+	wsHandler.SetIdempotency(idempotencyUseCase)
+	idemCommands := httpHandler.Idempotency(idempotencyUseCase, httpHandler.IdempotencyScopeCommands)
+	idemDeviceData := httpHandler.Idempotency(idempotencyUseCase, httpHandler.IdempotencyScopeDeviceData)
+	idemMacroRuns := httpHandler.Idempotency(idempotencyUseCase, httpHandler.IdempotencyScopeMacroRuns)
 	cacheHandler := handlers.NewCacheHandler(processor)
-	loginHandler := httpHandler.NewLoginHandler(s.db.GetDB())
+
+	// Session tokens
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" {
+		log.Println("WARNING: AUTH_SECRET not set, using a random secret; sessions will not survive a restart")
+		secret = auth.RandomSecret()
+	}
+	tokens := auth.NewTokenManager(secret,
+		confs.GetDuration("AUTH_ACCESS_TTL", 15*time.Minute),
+		confs.GetDuration("AUTH_REFRESH_TTL", 30*24*time.Hour))
+	// Changing or resetting a password revokes the sessions issued before it
+	tokens.SetTokenVersions(func(userID string) (int, error) {
+		user, err := userRepo.GetByID(userID)
+		if err != nil {
+			return 0, err
+		}
+		return user.TokenVersion, nil
+	})
+	apiKeyUseCase := usecases.NewAPIKeyUseCase(repositories.NewAPIKeyPgRepository(s.db), userRepo, authz)
+	apiKeyHandler := httpHandler.NewAPIKeyHandler(apiKeyUseCase)
+
+	// User sessions and API keys share the same middleware; API keys are further limited by scope
+	requireAuth := httpHandler.AuthMiddleware(tokens, apiKeyUseCase)
+	requireAdmin := httpHandler.RequireAdmin()
+	requireSession := httpHandler.RequireSession()
+	devicesRead := httpHandler.RequireScope(auth.ScopeDevicesRead)
+	devicesAdmin := httpHandler.RequireScope(auth.ScopeDevicesAdmin)
+	telemetryRead := httpHandler.RequireScope(auth.ScopeTelemetryRead)
+	commandsRead := httpHandler.RequireScope(auth.ScopeCommandsRead)
+	commandsWrite := httpHandler.RequireScope(auth.ScopeCommandsWrite)
+
+	loginHandler := httpHandler.NewLoginHandler(s.db.GetDB(), tokens)
+
+	// Accounts
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:3536"
+	}
+	userUseCase := usecases.NewUserUseCase(userRepo, repositories.NewUserTokenPgRepository(s.db), services.NewMailerFromEnv(), baseURL)
+	userHandler := httpHandler.NewUserHandler(userUseCase)
+	deviceHandler.SetPairing(userUseCase)
+
+	// Scheduled and recurring commands
+	scheduleUseCase := usecases.NewScheduleUseCase(repositories.NewCommandSchedulePgRepository(s.db), commandsUseCase, authz, userRepo,
+		confs.GetDuration("SCHEDULE_MISFIRE_GRACE", 5*time.Minute))
+	scheduleUseCase.Start(confs.GetDuration("SCHEDULER_INTERVAL", 15*time.Second))
+	scheduleHandler := httpHandler.NewScheduleHandler(scheduleUseCase)
+
+	// Multi-step macros
+	macroUseCase := usecases.NewMacroUseCase(repositories.NewMacroPgRepository(s.db), commandsUseCase, authz)
+	macroUseCase.StartCleanup(10 * time.Minute)
+	macroHandler := httpHandler.NewMacroHandler(macroUseCase)
+	sharingHandler := httpHandler.NewSharingHandler(sharingUseCase, authz)
 
 	// Setup API routes
 	api := s.app.Group("/api/v1")
+
+	// Device registration with a single-use pairing token; the response carries the device secret
+	api.POST("/devices", deviceHandler.CreateDevice)
+
+	// Device-facing routes used by the Pico firmware (device credentials, no user session)
+	deviceAPI := api.Group("", requireDevice)
+	{
+		deviceAPI.GET("/devices/:id/commands", cmdHandler.GetDeviceCommands) // Get pending commands for device
+		deviceAPI.POST("/device-data", idemDeviceData, deviceHandler.CreateDeviceData)
+		deviceAPI.POST("/device-modules", deviceModuleHandler.CreateDeviceModule) // Create device module
+		deviceAPI.GET("/commands/poll", cmdHandler.Poll)                          // Devices fetch pending commands
+		deviceAPI.POST("/command-responses", cmdHandler.Ack)                      // Devices acknowledge
+	}
+
+	// Auth routes
+	authGroup := api.Group("/auth")
+	{
+		authGroup.POST("/login", loginHandler.Login)     // Login endpoint for pico.exe
+		authGroup.POST("/refresh", loginHandler.Refresh) // Exchange a refresh token for a new pair
+		authGroup.POST("/register", userHandler.Register)
+		authGroup.GET("/verify-email", userHandler.VerifyEmail) // Link sent by email
+		authGroup.POST("/verify-email", userHandler.VerifyEmail)
+		authGroup.POST("/verify-email/resend", requireAuth, requireSession, userHandler.ResendVerification)
+		authGroup.POST("/password/forgot", userHandler.ForgotPassword) // Email a reset link
+		authGroup.POST("/password/reset", userHandler.ResetPassword)   // Set a new password with a reset token
+		authGroup.POST("/password/change", requireAuth, requireSession, userHandler.ChangePassword)
+	}
+
+	// Everything below requires a valid bearer token
+	protected := api.Group("", requireAuth)
 	{
 		// Device routes
-		devices := api.Group("/devices")
+		devices := protected.Group("/devices")
 		{
-			devices.POST("", deviceHandler.CreateDevice)
-			devices.GET("", deviceHandler.GetAllDevices)
-			devices.GET("/:id/data", deviceHandler.GetDeviceDataByDeviceID)
-			devices.GET("/:id/modules", deviceModuleHandler.GetDeviceModulesByDeviceID)
-			devices.GET("/:id/commands", cmdHandler.GetDeviceCommands)         // Get pending commands for device
-			devices.POST("/:id/change-wifi", cmdHandler.ChangeWiFiCredentials) // Change WiFi credentials
-			devices.GET("/:id", deviceHandler.GetDevice)
-			devices.PUT("/:id", deviceHandler.UpdateDevice)
-			devices.DELETE("/:id", deviceHandler.DeleteDevice)
+			devices.GET("", requireAdmin, deviceHandler.GetAllDevices)
+			devices.POST("/pairing-tokens", devicesAdmin, deviceHandler.CreatePairingToken) // Single-use token for registering a new device
+			devices.GET("/:id/data", telemetryRead, deviceHandler.GetDeviceDataByDeviceID)
+			devices.GET("/:id/modules", devicesRead, deviceModuleHandler.GetDeviceModulesByDeviceID)
+			devices.POST("/:id/change-wifi", devicesAdmin, cmdHandler.ChangeWiFiCredentials)     // Change WiFi credentials
+			devices.POST("/:id/secret", devicesAdmin, deviceHandler.RotateDeviceSecret)          // Issue a new device secret
+			devices.GET("/:id/members", devicesRead, sharingHandler.ListMembers)                 // Members and pending invitations
+			devices.POST("/:id/members", devicesAdmin, sharingHandler.InviteMember)              // Invite a user (owner only)
+			devices.PUT("/:id/members/:member_id", devicesAdmin, sharingHandler.UpdateMember)    // Change a member's role (owner only)
+			devices.DELETE("/:id/members/:member_id", devicesAdmin, sharingHandler.RevokeMember) // Revoke access or leave
+			devices.GET("/:id", devicesRead, deviceHandler.GetDevice)
+			devices.PUT("/:id", devicesAdmin, deviceHandler.UpdateDevice)
+			devices.DELETE("/:id", devicesAdmin, deviceHandler.DeleteDevice)
 		}
 
 		// Device data routes
-		deviceData := api.Group("/device-data")
+		deviceData := protected.Group("/device-data")
 		{
-			deviceData.POST("", deviceHandler.CreateDeviceData)
-			deviceData.GET("", deviceHandler.GetAllDeviceData)
-			deviceData.GET("/:id", deviceHandler.GetDeviceData)
-			deviceData.PUT("/:id", deviceHandler.UpdateDeviceData)
-			deviceData.DELETE("/:id", deviceHandler.DeleteDeviceData)
+			deviceData.GET("", requireAdmin, deviceHandler.GetAllDeviceData)
+			deviceData.GET("/:id", telemetryRead, deviceHandler.GetDeviceData)
+			deviceData.PUT("/:id", devicesAdmin, deviceHandler.UpdateDeviceData)
+			deviceData.DELETE("/:id", devicesAdmin, deviceHandler.DeleteDeviceData)
 		}
 
 		// Device module routes
-		deviceModules := api.Group("/device-modules")
+		deviceModules := protected.Group("/device-modules")
+		{
+			deviceModules.GET("", requireAdmin, deviceModuleHandler.GetAllDeviceModules)              // Get all device modules
+			deviceModules.GET("/:id", devicesRead, deviceModuleHandler.GetDeviceModule)               // Get device module by ID
+			deviceModules.GET("/:id/latest", telemetryRead, deviceModuleHandler.GetLatestReading)     // Get latest reading for module
+			deviceModules.GET("/:id/aggregate", telemetryRead, deviceModuleHandler.AggregateReadings) // Bucketed aggregates of one reading field
+			deviceModules.GET("/:id/commands", devicesRead, cmdHandler.GetModuleCommands)             // Declared commands and parameter schemas
+			deviceModules.PUT("/:id", devicesAdmin, deviceModuleHandler.UpdateDeviceModule)           // Update device module
+			deviceModules.DELETE("/:id", devicesAdmin, deviceModuleHandler.DeleteDeviceModule)        // Delete device module
+		}
+
+		// Invitations addressed to the caller
+		invitations := protected.Group("/invitations", requireSession)
+		{
+			invitations.GET("", sharingHandler.ListInvitations)
+			invitations.POST("/:id/accept", sharingHandler.AcceptInvitation)
+			invitations.POST("/:id/decline", sharingHandler.DeclineInvitation)
+		}
+
+		// User-specific routes (":user_id" must be the caller or "me")
+		users := protected.Group("/users")
 		{
-			deviceModules.POST("", deviceModuleHandler.CreateDeviceModule)         // Create device module
-			deviceModules.GET("", deviceModuleHandler.GetAllDeviceModules)         // Get all device modules
-			deviceModules.GET("/:id", deviceModuleHandler.GetDeviceModule)         // Get device module by ID
-			deviceModules.GET("/:id/latest", deviceModuleHandler.GetLatestReading) // Get latest reading for module
-			deviceModules.PUT("/:id", deviceModuleHandler.UpdateDeviceModule)      // Update device module
-			deviceModules.DELETE("/:id", deviceModuleHandler.DeleteDeviceModule)   // Delete device module
+			users.GET("/:user_id/devices", devicesRead, deviceModuleHandler.GetDevicesByUserID)              // Get all devices of the caller
+			users.GET("/:user_id/device-modules", devicesRead, deviceModuleHandler.GetDeviceModulesByUserID) // Get all device modules of the caller
 		}
 
-		// User-specific routes
-		users := api.Group("/users")
+		// API keys for third-party integrations (managed from a user session only)
+		apiKeys := protected.Group("/api-keys", requireSession)
 		{
-			users.GET("/:user_id/devices", deviceModuleHandler.GetDevicesByUserID)              // Get all devices by user_id
-			users.GET("/:user_id/device-modules", deviceModuleHandler.GetDeviceModulesByUserID) // Get all device modules by user_id
+			apiKeys.POST("", apiKeyHandler.CreateAPIKey)       // Create a key; the plain key is returned once
+			apiKeys.GET("", apiKeyHandler.GetAPIKeys)          // List the caller's keys
+			apiKeys.DELETE("/:id", apiKeyHandler.RevokeAPIKey) // Revoke a key
 		}
 
-		// Auth routes
-		auth := api.Group("/auth")
+		// Scheduled commands (owned by the creator)
+		schedules := protected.Group("/schedules")
 		{
-			auth.POST("/login", loginHandler.Login) // Login endpoint for pico.exe
+			schedules.POST("", commandsWrite, scheduleHandler.CreateSchedule)
+			schedules.GET("", commandsRead, scheduleHandler.GetSchedules)
+			schedules.GET("/:id", commandsRead, scheduleHandler.GetSchedule)
+			schedules.GET("/:id/runs", commandsRead, scheduleHandler.GetScheduleRuns) // Run history including missed runs
+			schedules.POST("/:id/pause", commandsWrite, scheduleHandler.PauseSchedule)
+			schedules.POST("/:id/resume", commandsWrite, scheduleHandler.ResumeSchedule)
+			schedules.DELETE("/:id", commandsWrite, scheduleHandler.DeleteSchedule)
 		}
 
+		// Macros: ordered command steps run one after another (owned by the creator)
+		macros := protected.Group("/macros")
+		{
+			macros.POST("", commandsWrite, macroHandler.CreateMacro)
+			macros.GET("", commandsRead, macroHandler.GetMacros)
+			macros.GET("/:id", commandsRead, macroHandler.GetMacro)
+			macros.PUT("/:id", commandsWrite, macroHandler.UpdateMacro)
+			macros.DELETE("/:id", commandsWrite, macroHandler.DeleteMacro)
+			macros.POST("/:id/run", commandsWrite, idemMacroRuns, macroHandler.RunMacro) // Start an execution in the background
+			macros.GET("/:id/executions", commandsRead, macroHandler.GetMacroExecutions) // Runs with per-step outcomes
+		}
+		protected.GET("/macro-executions/:id", commandsRead, macroHandler.GetMacroExecution)
+
 		// Cache management endpoints
-		cache := api.Group("/cache")
+		cache := protected.Group("/cache", requireAdmin)
 		{
 			cache.POST("/process", cacheHandler.ProcessCache) // Trigger cache processing
 			cache.GET("/data", cacheHandler.GetAllCachedData) // Get all cached data
@@ -124,16 +333,64 @@ func (s *Server) Start() {
 		}
 
 		// WebSocket-related HTTP endpoints
-		api.POST("/commands", cmdHandler.Enqueue)                    // Enqueue and try WS send
-		api.GET("/devices/connected", wsHandler.GetConnectedDevices) // List connected devices
-		api.GET("/commands/poll", cmdHandler.Poll)                   // Devices fetch pending commands
-		api.POST("/command-responses", cmdHandler.Ack)               // Devices acknowledge
-
+		protected.POST("/commands", commandsWrite, idemCommands, cmdHandler.Enqueue)    // Enqueue and try WS send
+		protected.GET("/commands", commandsRead, cmdHandler.ListCommands)               // Command history with filters
+		protected.GET("/commands/:id", commandsRead, cmdHandler.GetCommand)             // Single command with its response
+		protected.POST("/commands/:id/cancel", commandsWrite, cmdHandler.CancelCommand) // Withdraw a pending or sent command
+		protected.POST("/command-batches", commandsWrite, batchHandler.CreateBatch)     // Fan a command out to many devices
+		protected.GET("/command-batches/:id", commandsRead, batchHandler.GetBatch)      // Aggregate batch status
+		protected.GET("/devices/connected", devicesRead, wsHandler.GetConnectedDevices) // List connected devices
 	}
 
 	s.app.GET("/ws", wsHandler.HandleDeviceWS)
 
-	if err := s.app.Run("0.0.0.0:3536"); err != nil {
-		panic(err)
+	s.serve(manager, processor, commandsUseCase, scheduleUseCase, macroUseCase)
+}
+
+// serve runs the HTTP server until SIGINT or SIGTERM, then shuts down
+// gracefully: parked long-polls and ?wait= requests are released, the
+// scheduler, command sweeper and running macros are stopped, other in-flight
+// requests get SHUTDOWN_TIMEOUT to finish (and are cancelled only after
+// that), WebSocket devices are told the server is going away, and cached
+// telemetry is flushed to the database.
+func (s *Server) serve(manager *ws.Manager, processor *services.DataProcessor, commands *usecases.CommandsUseCase,
+	schedules *usecases.ScheduleUseCase, macros *usecases.MacroUseCase) {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := &http.Server{
+		Addr:        "0.0.0.0:3536",
+		Handler:     s.app,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	sig, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+		return
+	case <-sig.Done():
+	}
+
+	log.Println("Shutting down...")
+	// Long-polls and ?wait= requests answer now; everything else drains normally
+	commands.Shutdown()
+	// No new scheduled runs; running macros are saved as interrupted
+	schedules.Stop()
+	macros.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), confs.GetDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+		// Out of time: cancel whatever is still running
+		cancelRequests()
 	}
+	manager.CloseAll(websocket.CloseGoingAway, "server shutting down")
+	processor.Stop()
+	log.Println("Shutdown complete")
 }
@@ -5,54 +5,278 @@ import (
 	"iot-server/db"
 	"iot-server/entities"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
 )
 
+// DataProcessor buffers WebSocket telemetry in memory and writes it to the
+// database in bulk, every interval or as soon as maxPoints are cached. With a
+// write-ahead log enabled every point is on disk before AddDataPoint returns,
+// and stays there until its batch has been inserted.
 type DataProcessor struct {
-	cache    *cache.DeviceCache
-	database db.Database
-	interval time.Duration
+	cache     *cache.DeviceCache
+	database  db.Database
+	interval  time.Duration
+	maxPoints int // flush early once this many points are cached; 0 disables
+
+	walMu sync.Mutex // keeps WAL appends and cache drains in step
+	wal   *cache.WAL // nil when the log is disabled
+
+	flushMu sync.Mutex    // one flush at a time
+	pending []flushBatch  // drained batches not yet inserted, oldest first
+	trigger chan struct{} // size-based flush requests
+	stop    chan struct{}
+	done    chan struct{}
+
+	// Read by GetCacheStats without waiting for a running insert
+	pendingPoints atomic.Int64
+	failures      atomic.Int64 // consecutive failed inserts, drives the retry backoff
 }
 
-func NewDataProcessor(database db.Database, _ float64, _ float64) *DataProcessor {
+// flushBatch is a drained set of points together with the WAL segments that
+// hold them.
+type flushBatch struct {
+	data     []entities.DeviceData
+	segments []uint64
+}
+
+const (
+	flushRetryBackoff    = 5 * time.Second
+	maxFlushRetryBackoff = 5 * time.Minute
+	flushInsertBatchSize = 500
+)
+
+func NewDataProcessor(database db.Database, interval time.Duration, maxPoints int, limits cache.Limits) *DataProcessor {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
 	return &DataProcessor{
-		cache:    cache.NewDeviceCache(),
-		database: database,
-		interval: 5 * time.Minute,
+		cache:     cache.NewDeviceCache(limits),
+		database:  database,
+		interval:  interval,
+		maxPoints: maxPoints,
+		trigger:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// EnableWAL opens the write-ahead log in dir and queues the points left in it
+// by a previous run for the next flush. They go straight into a pending batch
+// rather than the cache, so the cache limits never evict points that were
+// already acknowledged. Call it before Start and before any point is added.
+func (dp *DataProcessor) EnableWAL(dir string, sync bool) error {
+	wal, replayed, err := cache.OpenWAL(dir, sync)
+	if err != nil {
+		return err
+	}
+	// Nothing has been appended yet, so this hands out exactly the old segments
+	segments, err := wal.Seal()
+	if err != nil {
+		wal.Close()
+		return err
 	}
+	if len(replayed) > 0 || len(segments) > 0 {
+		dp.pending = append(dp.pending, flushBatch{data: replayed, segments: segments})
+		dp.pendingPoints.Add(int64(len(replayed)))
+	}
+	if len(replayed) > 0 {
+		log.Printf("Replayed %d telemetry points from %s", len(replayed), dir)
+	}
+	dp.wal = wal
+	return nil
 }
 
+// Start flushes the cache in the background until Stop is called. After a
+// failed insert the flush is retried with exponential backoff.
 func (dp *DataProcessor) Start() {
 	ticker := time.NewTicker(dp.interval)
 	go func() {
-		for range ticker.C {
-			dp.ProcessCachedData()
+		defer close(dp.done)
+		defer ticker.Stop()
+		var retry <-chan time.Time
+		for {
+			select {
+			case <-ticker.C:
+			case <-dp.trigger:
+				if retry != nil {
+					continue // backing off after a failed insert
+				}
+			case <-retry:
+			case <-dp.stop:
+				return
+			}
+			retry = nil
+			if err := dp.ProcessCachedData(); err != nil {
+				retry = time.After(dp.retryDelay())
+			}
 		}
 	}()
 }
 
-func (dp *DataProcessor) ProcessCachedData() {
-	raw := dp.cache.GetAllCachedData()
-	var allData []entities.DeviceData
-	for _, points := range raw {
-		for _, p := range points {
-			allData = append(allData, p.Data)
+// Stop ends the background loop and flushes whatever is still cached.
+// Call it once, after Start, when no more data will be added. Points that
+// cannot be inserted stay in the WAL for the next start.
+func (dp *DataProcessor) Stop() {
+	close(dp.stop)
+	<-dp.done
+	if err := dp.ProcessCachedData(); err != nil {
+		if dp.wal != nil {
+			log.Printf("Unflushed telemetry is kept in the WAL and will be replayed on restart")
+		} else {
+			log.Printf("Dropping %d unflushed telemetry points", dp.pendingPoints.Load())
 		}
 	}
-	if len(allData) == 0 {
+	dp.walMu.Lock()
+	defer dp.walMu.Unlock()
+	if dp.wal != nil {
+		if err := dp.wal.Close(); err != nil {
+			log.Printf("Error closing telemetry WAL: %v", err)
+		}
+	}
+}
+
+// ProcessCachedData retries the batch left by a failed flush, then moves the
+// cache into a new batch and inserts it. A batch, and its WAL segments, is
+// only dropped once it has been stored. While a batch is failing the cache is
+// not drained, so the cache limits also bound memory during a database outage.
+func (dp *DataProcessor) ProcessCachedData() error {
+	dp.flushMu.Lock()
+	defer dp.flushMu.Unlock()
+
+	if err := dp.insertPending(); err != nil {
+		return err
+	}
+	if err := dp.collect(); err != nil {
+		log.Printf("Error sealing telemetry WAL: %v", err)
+		return err
+	}
+	if len(dp.pending) == 0 {
 		log.Printf("No cached data to process")
-		return
+		return nil
+	}
+	return dp.insertPending()
+}
+
+// insertPending inserts the queued batches, oldest first, stopping at the
+// first failure. The caller holds flushMu.
+func (dp *DataProcessor) insertPending() error {
+	for len(dp.pending) > 0 {
+		batch := dp.pending[0]
+		if len(batch.data) > 0 {
+			// Replayed points keep their IDs, so a batch stored just before a crash is not duplicated
+			err := dp.database.GetDB().Clauses(clause.OnConflict{DoNothing: true}).
+				CreateInBatches(&batch.data, flushInsertBatchSize).Error
+			if err != nil {
+				failures := dp.failures.Add(1)
+				log.Printf("Error bulk inserting %d data points (attempt %d, retrying in %s): %v",
+					len(batch.data), failures, dp.retryDelay(), err)
+				return err
+			}
+			log.Printf("Inserted %d cached data points (unfiltered)", len(batch.data))
+		}
+		if dp.wal != nil {
+			dp.walMu.Lock()
+			err := dp.wal.Remove(batch.segments)
+			dp.walMu.Unlock()
+			if err != nil {
+				log.Printf("Error truncating telemetry WAL: %v", err)
+			}
+		}
+		dp.pending = dp.pending[1:]
+		dp.pendingPoints.Add(-int64(len(batch.data)))
+		dp.failures.Store(0)
+	}
+	return nil
+}
+
+// collect drains the cache into a new pending batch. The WAL is sealed at the
+// same moment, so the sealed segments hold exactly the drained points.
+func (dp *DataProcessor) collect() error {
+	dp.walMu.Lock()
+	defer dp.walMu.Unlock()
+
+	var batch flushBatch
+	if dp.wal != nil {
+		segments, err := dp.wal.Seal()
+		if err != nil {
+			return err
+		}
+		batch.segments = segments
+	}
+	for _, points := range dp.cache.Drain() {
+		for _, p := range points {
+			batch.data = append(batch.data, p.Data)
+		}
+	}
+	if len(batch.data) > 0 || len(batch.segments) > 0 {
+		dp.pending = append(dp.pending, batch)
+		dp.pendingPoints.Add(int64(len(batch.data)))
+	}
+	return nil
+}
+
+// retryDelay doubles the backoff with every consecutive failure, up to maxFlushRetryBackoff.
+func (dp *DataProcessor) retryDelay() time.Duration {
+	delay := flushRetryBackoff
+	for i := int64(1); i < dp.failures.Load() && delay < maxFlushRetryBackoff; i++ {
+		delay *= 2
 	}
-	if err := dp.database.GetDB().Create(&allData).Error; err != nil {
-		log.Printf("Error bulk inserting %d data points: %v", len(allData), err)
-	} else {
-		log.Printf("Inserted %d cached data points (unfiltered)", len(allData))
+	if delay > maxFlushRetryBackoff {
+		delay = maxFlushRetryBackoff
 	}
-	dp.cache.ClearCache()
+	return delay
 }
 
-func (dp *DataProcessor) AddDataPoint(data entities.DeviceData) {
-	dp.cache.AddDataPoint(data)
+// AddDataPoint records a point in the WAL and caches it. The point must not
+// be acknowledged to the device if an error is returned; a full cache returns
+// cache.ErrCacheFull or a *cache.SlowDownError depending on its policy. Under
+// drop_oldest an acknowledged point can still be evicted later; the eviction
+// is logged so the WAL doesn't replay it.
+func (dp *DataProcessor) AddDataPoint(data entities.DeviceData) error {
+	if data.ID == "" {
+		data.ID = uuid.New().String()
+	}
+
+	dp.walMu.Lock()
+	// Refused points never reach the WAL, so they are not replayed later
+	if err := dp.cache.Admit(data.DeviceID); err != nil {
+		dp.walMu.Unlock()
+		dp.requestFlush()
+		return err
+	}
+	if dp.wal != nil {
+		if err := dp.wal.Append(data); err != nil {
+			dp.walMu.Unlock()
+			return err
+		}
+	}
+	n, evicted := dp.cache.AddDataPoint(data)
+	if dp.wal != nil {
+		// Evicted points must not come back on replay
+		for _, id := range evicted {
+			if err := dp.wal.AppendEviction(id); err != nil {
+				log.Printf("Error logging evicted point %s to the telemetry WAL: %v", id, err)
+			}
+		}
+	}
+	dp.walMu.Unlock()
+
+	if dp.maxPoints > 0 && n >= dp.maxPoints {
+		dp.requestFlush()
+	}
+	return nil
+}
+
+func (dp *DataProcessor) requestFlush() {
+	select {
+	case dp.trigger <- struct{}{}:
+	default: // a flush is already requested
+	}
 }
 
 func (dp *DataProcessor) GetAllCachedData() map[string][]cache.DeviceDataPoint {
@@ -60,5 +284,9 @@ func (dp *DataProcessor) GetAllCachedData() map[string][]cache.DeviceDataPoint {
 }
 
 func (dp *DataProcessor) GetCacheStats() map[string]interface{} {
-	return dp.cache.GetCacheStats()
+	stats := dp.cache.GetCacheStats()
+	stats["pending_retry_points"] = dp.pendingPoints.Load()
+	stats["failed_flushes"] = dp.failures.Load()
+	stats["wal_enabled"] = dp.wal != nil
+	return stats
 }
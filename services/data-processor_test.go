@@ -0,0 +1,55 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"iot-server/cache"
+	"iot-server/entities"
+)
+
+func TestEnableWALReplaysPastCacheLimits(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, err := cache.OpenWAL(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		data := entities.DeviceData{ID: fmt.Sprintf("p%d", i), DeviceID: "dev-1", Data: `{"t":1}`}
+		if err := wal.Append(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+
+	limits := cache.Limits{MaxPoints: 2, MaxPointsPerDevice: 2, Policy: cache.OverflowDropOldest}
+	dp := NewDataProcessor(nil, 0, 0, limits)
+	if err := dp.EnableWAL(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	defer dp.wal.Close()
+
+	if got := dp.pendingPoints.Load(); got != 10 {
+		t.Fatalf("pending points = %d, want all 10 replayed", got)
+	}
+	if len(dp.pending) != 1 || len(dp.pending[0].data) != 10 || len(dp.pending[0].segments) != 1 {
+		t.Fatalf("pending = %+v, want one batch of 10 points with the old segment", dp.pending)
+	}
+	if cached := dp.cache.GetAllCachedData(); len(cached) != 0 {
+		t.Errorf("replayed points went through the cache: %v", cached)
+	}
+
+	// New points still honour the limits and go to a fresh segment
+	for i := 0; i < 3; i++ {
+		dp.AddDataPoint(entities.DeviceData{DeviceID: "dev-1", Data: `{"t":2}`})
+	}
+	if n := len(dp.cache.GetAllCachedData()["dev-1"]); n != 2 {
+		t.Errorf("cached points = %d, want 2 after eviction", n)
+	}
+	if err := dp.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dp.pending) != 2 || dp.pending[1].segments[0] == dp.pending[0].segments[0] {
+		t.Errorf("new points share a segment with the replayed batch: %+v", dp.pending)
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends transactional email (verification, password reset, ...).
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailerFromEnv picks a mailer based on MAIL_DRIVER ("smtp" or "log", default "log").
+func NewMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@homenetai.local"
+	}
+
+	switch strings.ToLower(os.Getenv("MAIL_DRIVER")) {
+	case "smtp":
+		return NewSMTPMailer(os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		return NewLogMailer(os.Getenv("MAIL_LOG_FILE"), from)
+	}
+}
+
+// SMTPMailer delivers mail through an SMTP relay using PLAIN auth (STARTTLS when offered).
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	if port == "" {
+		port = "587"
+	}
+	var a smtp.Auth
+	if username != "" {
+		a = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr: host + ":" + port, auth: a, from: from}
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMessage(m.from, to, subject, body))
+}
+
+// LogMailer writes messages to the log, or appends them to a file when a path is set.
+// Useful for development and tests.
+type LogMailer struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func NewLogMailer(path, from string) *LogMailer {
+	return &LogMailer{path: path, from: from}
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	msg := buildMessage(m.from, to, subject, body)
+	if m.path == "" {
+		log.Printf("mail to %s:\n%s", to, msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(msg, []byte("\r\n.\r\n")...))
+	return err
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n\r\n")
+	b.WriteString(body)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
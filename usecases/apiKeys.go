@@ -0,0 +1,191 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+var ErrInvalidAPIKey = errors.New("invalid or expired api key")
+
+// lastUsedResolution limits how often last_used_at is written for a busy key.
+const lastUsedResolution = time.Minute
+
+type APIKeyUseCase struct {
+	keys  repositories.APIKeyRepository
+	users repositories.UserRepository
+	authz *Authorizer
+}
+
+func NewAPIKeyUseCase(keys repositories.APIKeyRepository, users repositories.UserRepository, authz *Authorizer) *APIKeyUseCase {
+	return &APIKeyUseCase{keys: keys, users: users, authz: authz}
+}
+
+// APIKeyView is an API key as returned to its owner, with scopes decoded.
+type APIKeyView struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	DeviceIDs  []string `json:"device_ids"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+// Create issues a new key for the user and returns the plain key once.
+// Every device in the allow-list must be readable by the user at creation time.
+func (uc *APIKeyUseCase) Create(p auth.Principal, name string, scopes, deviceIDs []string, ttl time.Duration) (*APIKeyView, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if !knownScope(s) {
+			return nil, "", fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	for _, id := range deviceIDs {
+		if _, err := uc.authz.Device(p, id, AccessRead); err != nil {
+			return nil, "", fmt.Errorf("device %s: %w", id, err)
+		}
+	}
+	if ttl < 0 {
+		return nil, "", errors.New("expiry must be in the future")
+	}
+
+	plain, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	scopesJSON, _ := json.Marshal(scopes)
+	if deviceIDs == nil {
+		deviceIDs = []string{}
+	}
+	devicesJSON, _ := json.Marshal(deviceIDs)
+
+	key := &entities.APIKey{
+		UserID:    p.UserID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    string(scopesJSON),
+		DeviceIDs: string(devicesJSON),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = time.Now().UTC().Add(ttl).Format(time.RFC3339)
+	}
+	if err := uc.keys.Create(key); err != nil {
+		return nil, "", err
+	}
+	return toAPIKeyView(key), plain, nil
+}
+
+// List returns the user's keys, including revoked and expired ones.
+func (uc *APIKeyUseCase) List(userID string) ([]APIKeyView, error) {
+	keys, err := uc.keys.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]APIKeyView, 0, len(keys))
+	for i := range keys {
+		views = append(views, *toAPIKeyView(&keys[i]))
+	}
+	return views, nil
+}
+
+// Revoke disables a key owned by the user.
+func (uc *APIKeyUseCase) Revoke(userID, keyID string) error {
+	key, err := uc.keys.GetByID(keyID)
+	if err != nil || key.UserID != userID {
+		return ErrNotFound
+	}
+	if key.RevokedAt != "" {
+		return nil
+	}
+	return uc.keys.Revoke(key.ID)
+}
+
+// Authenticate resolves a presented key to the principal it acts as.
+// Keys never carry the admin role, even when created by an admin.
+func (uc *APIKeyUseCase) Authenticate(plain string) (*auth.Principal, error) {
+	rest, ok := strings.CutPrefix(plain, auth.APIKeyPrefix)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := uc.keys.GetByPrefix(prefix)
+	if err != nil || !auth.VerifyAPIKey(key.KeyHash, plain) || key.RevokedAt != "" {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now().UTC()
+	if key.ExpiresAt != "" {
+		exp, err := time.Parse(time.RFC3339, key.ExpiresAt)
+		if err != nil || !now.Before(exp) {
+			return nil, ErrInvalidAPIKey
+		}
+	}
+	if _, err := uc.users.GetByID(key.UserID); err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if last, err := time.Parse(time.RFC3339, key.LastUsedAt); err != nil || now.Sub(last) >= lastUsedResolution {
+		if err := uc.keys.TouchLastUsed(key.ID, now); err != nil {
+			log.Printf("failed to update last_used_at for api key %s: %v", key.ID, err)
+		}
+	}
+
+	view := toAPIKeyView(key)
+	return &auth.Principal{
+		UserID:    key.UserID,
+		Role:      auth.RoleUser,
+		APIKeyID:  key.ID,
+		Scopes:    view.Scopes,
+		DeviceIDs: view.DeviceIDs,
+	}, nil
+}
+
+func toAPIKeyView(key *entities.APIKey) *APIKeyView {
+	view := &APIKeyView{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     []string{},
+		DeviceIDs:  []string{},
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+	if key.Scopes != "" {
+		_ = json.Unmarshal([]byte(key.Scopes), &view.Scopes)
+	}
+	if key.DeviceIDs != "" {
+		_ = json.Unmarshal([]byte(key.DeviceIDs), &view.DeviceIDs)
+	}
+	return view
+}
+
+func knownScope(scope string) bool {
+	for _, s := range auth.AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package usecases
+
+import (
+	"errors"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+var (
+	ErrForbidden = errors.New("you do not have access to this resource")
+	ErrNotFound  = errors.New("resource not found")
+)
+
+// Access is the kind of operation being authorized.
+type Access int
+
+const (
+	AccessRead   Access = iota // viewers and up
+	AccessWrite                // editors and up: updates, commands
+	AccessManage               // owner only: sharing, deletion of the device itself
+)
+
+// Authorizer checks that the acting principal may touch a device and
+// everything hanging off it (modules, telemetry, commands).
+type Authorizer struct {
+	devices repositories.DeviceRepository
+	modules repositories.DeviceModuleRepository
+	data    repositories.DeviceDataRepository
+	members repositories.DeviceMemberRepository
+}
+
+func NewAuthorizer(devices repositories.DeviceRepository, modules repositories.DeviceModuleRepository, data repositories.DeviceDataRepository, members repositories.DeviceMemberRepository) *Authorizer {
+	return &Authorizer{devices: devices, modules: modules, data: data, members: members}
+}
+
+// Device loads a device and checks access to it.
+func (a *Authorizer) Device(p auth.Principal, deviceID string, access Access) (*entities.Device, error) {
+	if deviceID == "" {
+		return nil, errors.New("device id is required")
+	}
+	if !p.AllowsDevice(deviceID) {
+		return nil, ErrForbidden
+	}
+	device, err := a.devices.GetByID(deviceID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if !a.canAccessDevice(p, device, access) {
+		return nil, ErrForbidden
+	}
+	return device, nil
+}
+
+// Module loads a device module and checks access to it. Access is granted
+// to the module's user or to whoever may access the parent device.
+func (a *Authorizer) Module(p auth.Principal, moduleID string, access Access) (*entities.DeviceModule, error) {
+	if moduleID == "" {
+		return nil, errors.New("module id is required")
+	}
+	module, err := a.modules.GetByID(moduleID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if !p.AllowsDevice(module.DeviceID) {
+		return nil, ErrForbidden
+	}
+	if p.IsAdmin() || (module.UserID != "" && module.UserID == p.UserID) {
+		return module, nil
+	}
+	if device, err := a.devices.GetByID(module.DeviceID); err == nil && a.canAccessDevice(p, device, access) {
+		return module, nil
+	}
+	return nil, ErrForbidden
+}
+
+// DeviceData loads a telemetry row and checks access to its device.
+func (a *Authorizer) DeviceData(p auth.Principal, dataID string, access Access) (*entities.DeviceData, error) {
+	if dataID == "" {
+		return nil, errors.New("data id is required")
+	}
+	data, err := a.data.GetByID(dataID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if p.IsAdmin() {
+		return data, nil
+	}
+	if _, err := a.Device(p, data.DeviceID, access); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// Orphaned rows are only visible to admins
+			return nil, ErrForbidden
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// CommandTarget checks that commands may be sent to the device and, when
+// given, that the module belongs to that device.
+func (a *Authorizer) CommandTarget(p auth.Principal, deviceID, moduleID string) error {
+	if _, err := a.Device(p, deviceID, AccessWrite); err != nil {
+		return err
+	}
+	if moduleID == "" {
+		return nil
+	}
+	module, err := a.modules.GetByID(moduleID)
+	if err != nil {
+		return ErrNotFound
+	}
+	if module.DeviceID != deviceID {
+		return errors.New("module does not belong to device")
+	}
+	return nil
+}
+
+// ReadableDeviceIDs lists the devices the principal may read. It returns nil
+// for admins, meaning every device.
+func (a *Authorizer) ReadableDeviceIDs(p auth.Principal) ([]string, error) {
+	if p.IsAdmin() {
+		return nil, nil
+	}
+	devices, err := a.devices.GetByUserID(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if p.AllowsDevice(d.ID) {
+			ids = append(ids, d.ID)
+		}
+	}
+	return ids, nil
+}
+
+// WritableDevices lists the devices the principal may send commands to.
+func (a *Authorizer) WritableDevices(p auth.Principal) ([]entities.Device, error) {
+	if p.IsAdmin() {
+		return a.devices.GetAll()
+	}
+	devices, err := a.devices.GetByUserID(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]entities.Device, 0, len(devices))
+	for _, d := range devices {
+		if p.AllowsDevice(d.ID) && (d.Role == entities.MemberRoleOwner || d.Role == entities.MemberRoleEditor) {
+			out = append(out, d.Device)
+		}
+	}
+	return out, nil
+}
+
+// Role returns the principal's role on a device, or "" when it has none.
+func (a *Authorizer) Role(p auth.Principal, device *entities.Device) string {
+	if p.UserID == "" {
+		return ""
+	}
+	if device.UserID == p.UserID {
+		return entities.MemberRoleOwner
+	}
+	member, err := a.members.GetByDeviceAndUser(device.ID, p.UserID)
+	if err != nil || member.Status != entities.MemberStatusAccepted {
+		return ""
+	}
+	return member.Role
+}
+
+func (a *Authorizer) canAccessDevice(p auth.Principal, device *entities.Device, access Access) bool {
+	if p.IsAdmin() {
+		return true
+	}
+	switch a.Role(p, device) {
+	case entities.MemberRoleOwner:
+		return true
+	case entities.MemberRoleEditor:
+		return access <= AccessWrite
+	case entities.MemberRoleViewer:
+		return access == AccessRead
+	}
+	return false
+}
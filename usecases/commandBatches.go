@@ -0,0 +1,194 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// maxBatchTargets bounds how many commands one fan-out may create.
+const maxBatchTargets = 500
+
+// BatchTarget is one device, optionally narrowed to a module.
+type BatchTarget struct {
+	DeviceID       string `json:"device_id"`
+	DeviceModuleID string `json:"device_module_id"`
+}
+
+// BatchSelector picks targets among the devices the caller may command.
+type BatchSelector struct {
+	Tags       []string `json:"tags"`        // devices carrying all of these tags
+	ModuleType string   `json:"module_type"` // target this module type on each device instead of the device itself
+}
+
+// BatchResult reports what happened for one target of a fan-out.
+type BatchResult struct {
+	DeviceID       string `json:"device_id"`
+	DeviceModuleID string `json:"device_module_id,omitempty"`
+	CommandID      string `json:"command_id,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// BatchStatus aggregates the commands of a batch by status.
+type BatchStatus struct {
+	Batch     *entities.CommandBatch `json:"batch"`
+	Total     int64                  `json:"total"`
+	Pending   int64                  `json:"pending"`
+	Sent      int64                  `json:"sent"`
+	Acked     int64                  `json:"acked"` // executed
+	Failed    int64                  `json:"failed"`
+	Expired   int64                  `json:"expired"`
+	Cancelled int64                  `json:"cancelled"`
+}
+
+// BatchUseCase fans a command out to many devices or modules.
+type BatchUseCase struct {
+	batches  repositories.CommandBatchRepository
+	commands *CommandsUseCase
+	modules  repositories.DeviceModuleRepository
+	authz    *Authorizer
+}
+
+func NewBatchUseCase(batches repositories.CommandBatchRepository, commands *CommandsUseCase, modules repositories.DeviceModuleRepository, authz *Authorizer) *BatchUseCase {
+	return &BatchUseCase{batches: batches, commands: commands, modules: modules, authz: authz}
+}
+
+// FanOut creates one command per target under a shared batch and pushes each
+// over WebSocket where the device is connected. Targets that fail
+// authorization or validation are reported without aborting the rest.
+func (uc *BatchUseCase) FanOut(p auth.Principal, targets []BatchTarget, selector *BatchSelector, command string, params map[string]interface{}, opts EnqueueOptions) (*entities.CommandBatch, []BatchResult, error) {
+	if command == "" {
+		return nil, nil, errors.New("command is required")
+	}
+	if selector != nil {
+		selected, err := uc.resolve(p, selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, selected...)
+	}
+	targets = dedupeTargets(targets)
+	if len(targets) == 0 {
+		return nil, nil, errors.New("no targets matched")
+	}
+	if len(targets) > maxBatchTargets {
+		return nil, nil, fmt.Errorf("a batch may target at most %d devices or modules", maxBatchTargets)
+	}
+
+	batch := &entities.CommandBatch{UserID: p.UserID, Command: command}
+	if err := uc.batches.Create(batch); err != nil {
+		return nil, nil, err
+	}
+	opts.BatchID = batch.ID
+
+	results := make([]BatchResult, 0, len(targets))
+	created := 0
+	for _, t := range targets {
+		res := BatchResult{DeviceID: t.DeviceID, DeviceModuleID: t.DeviceModuleID}
+		if err := uc.authz.CommandTarget(p, t.DeviceID, t.DeviceModuleID); err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		// Each command gets its own copy; validation fills in defaults per module
+		cmd, err := uc.commands.Dispatch(t.DeviceID, t.DeviceModuleID, command, copyParams(params), opts)
+		if err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		created++
+		res.CommandID, res.Status = cmd.ID, cmd.Status
+		results = append(results, res)
+	}
+	batch.TargetCount = created
+	if err := uc.batches.SetTargetCount(batch.ID, created); err != nil {
+		return nil, nil, err
+	}
+	return batch, results, nil
+}
+
+// Status returns the aggregate status of a batch owned by the caller.
+func (uc *BatchUseCase) Status(p auth.Principal, id string) (*BatchStatus, error) {
+	batch, err := uc.batches.GetByID(id)
+	if err != nil || (batch.UserID != p.UserID && !p.IsAdmin()) {
+		return nil, ErrNotFound
+	}
+	counts, err := uc.commands.repo.CountByBatch(batch.ID)
+	if err != nil {
+		return nil, err
+	}
+	st := &BatchStatus{
+		Batch:     batch,
+		Pending:   counts[entities.CommandStatusPending],
+		Sent:      counts[entities.CommandStatusSent],
+		Acked:     counts[entities.CommandStatusExecuted],
+		Failed:    counts[entities.CommandStatusFailed],
+		Expired:   counts[entities.CommandStatusExpired],
+		Cancelled: counts[entities.CommandStatusCancelled],
+	}
+	for _, n := range counts {
+		st.Total += n
+	}
+	return st, nil
+}
+
+func (uc *BatchUseCase) resolve(p auth.Principal, sel *BatchSelector) ([]BatchTarget, error) {
+	if len(sel.Tags) == 0 {
+		return nil, errors.New("selector needs at least one tag")
+	}
+	devices, err := uc.authz.WritableDevices(p)
+	if err != nil {
+		return nil, err
+	}
+	tags := normalizeTags(sel.Tags)
+	var targets []BatchTarget
+	for _, d := range devices {
+		if !d.Tags.Contains(tags...) {
+			continue
+		}
+		if sel.ModuleType == "" {
+			targets = append(targets, BatchTarget{DeviceID: d.ID})
+			continue
+		}
+		modules, err := uc.modules.GetByDeviceID(d.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range modules {
+			if strings.EqualFold(m.ModuleType, sel.ModuleType) {
+				targets = append(targets, BatchTarget{DeviceID: d.ID, DeviceModuleID: m.ID})
+			}
+		}
+	}
+	return targets, nil
+}
+
+func dedupeTargets(targets []BatchTarget) []BatchTarget {
+	seen := map[BatchTarget]bool{}
+	out := make([]BatchTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.DeviceID == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		out[k] = v
+	}
+	return out
+}
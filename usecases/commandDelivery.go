@@ -0,0 +1,146 @@
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"iot-server/entities"
+)
+
+// sweepBatchSize caps how many timed-out commands one sweep handles.
+const sweepBatchSize = 100
+
+// DeliveryPolicy controls acknowledgement deadlines, redelivery and expiry of commands.
+type DeliveryPolicy struct {
+	AckTimeout      time.Duration // how long a device has to ack a delivered command
+	MaxAttempts     int           // deliveries before a command is marked failed
+	RetryBackoff    time.Duration // delay before the first redelivery, doubled per attempt
+	MaxRetryBackoff time.Duration
+	TTL             time.Duration // commands not acked within this are expired; 0 disables
+	// UrgentCommands are enqueued with CommandPriorityUrgent unless the caller sets a priority
+	UrgentCommands []string
+}
+
+// DefaultDeliveryPolicy is used when nothing is configured.
+func DefaultDeliveryPolicy() DeliveryPolicy {
+	return DeliveryPolicy{
+		AckTimeout:      30 * time.Second,
+		MaxAttempts:     5,
+		RetryBackoff:    10 * time.Second,
+		MaxRetryBackoff: 5 * time.Minute,
+		TTL:             24 * time.Hour,
+		UrgentCommands:  []string{"CLOSE_DOOR"},
+	}
+}
+
+// priorityFor returns the default priority of a command.
+func (p DeliveryPolicy) priorityFor(command string) int {
+	for _, c := range p.UrgentCommands {
+		if strings.EqualFold(c, command) {
+			return entities.CommandPriorityUrgent
+		}
+	}
+	return entities.CommandPriorityNormal
+}
+
+// backoff returns the delay before redelivering a command delivered attempts times.
+func (p DeliveryPolicy) backoff(attempts int) time.Duration {
+	d := p.RetryBackoff
+	for i := 1; i < attempts && d < p.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxRetryBackoff > 0 && d > p.MaxRetryBackoff {
+		d = p.MaxRetryBackoff
+	}
+	return d
+}
+
+// CommandPusher is the WebSocket transport to devices holding a live connection.
+type CommandPusher interface {
+	List() []string // connected device ids
+	IsConnected(deviceID string) bool
+	SendToDevice(deviceID string, payload []byte) error
+}
+
+// SetPusher enables WebSocket delivery: Dispatch and the sweeper push to
+// connected devices instead of waiting for them to poll.
+func (uc *CommandsUseCase) SetPusher(p CommandPusher) {
+	uc.pusher = p
+}
+
+// StartSweeper runs Sweep every interval in the background until Shutdown.
+func (uc *CommandsUseCase) StartSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	uc.sweeper.Add(1)
+	go func() {
+		defer uc.sweeper.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				uc.Sweep(time.Now())
+			case <-uc.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Sweep expires commands past their TTL, returns timed-out deliveries to the
+// queue (or fails them after MaxAttempts) and pushes due commands to connected
+// devices. Every transition is conditional on the current status, so running
+// several server instances at once is safe.
+func (uc *CommandsUseCase) Sweep(now time.Time) {
+	expired, _ := json.Marshal(map[string]string{"error": "command expired before it was acknowledged"})
+	if cmds, err := uc.repo.ExpireBefore(now, string(expired)); err != nil {
+		log.Printf("command sweep: expiring commands failed: %v", err)
+	} else if len(cmds) > 0 {
+		log.Printf("command sweep: expired %d command(s)", len(cmds))
+		for i := range cmds {
+			uc.emit(DeliveryExpired, &cmds[i], "")
+		}
+	}
+
+	timedOut, err := uc.repo.GetTimedOut(now, sweepBatchSize)
+	if err != nil {
+		log.Printf("command sweep: loading timed-out commands failed: %v", err)
+		return
+	}
+	for _, cmd := range timedOut {
+		if uc.policy.MaxAttempts > 0 && cmd.Attempts >= uc.policy.MaxAttempts {
+			resp, _ := json.Marshal(map[string]string{
+				"error": fmt.Sprintf("no acknowledgement after %d attempts", cmd.Attempts),
+			})
+			if ok, err := uc.repo.FailDelivery(cmd.ID, string(resp)); err != nil {
+				log.Printf("command sweep: failing command %s: %v", cmd.ID, err)
+			} else if ok {
+				log.Printf("command sweep: command %s failed after %d attempts", cmd.ID, cmd.Attempts)
+				cmd.Status, cmd.Response = entities.CommandStatusFailed, string(resp)
+				uc.emit(DeliveryFailed, &cmd, "")
+			}
+			continue
+		}
+		next := now.Add(uc.policy.backoff(cmd.Attempts))
+		if ok, err := uc.repo.Requeue(cmd.ID, next); err != nil {
+			log.Printf("command sweep: requeueing command %s: %v", cmd.ID, err)
+		} else if ok {
+			cmd.Status, cmd.NextAttemptAt = entities.CommandStatusPending, next.UTC().Format(time.RFC3339)
+			uc.emit(DeliveryRequeued, &cmd, "")
+		}
+	}
+
+	uc.pushPending()
+}
+
+// pushPending delivers queued commands to devices that are connected over WebSocket.
+func (uc *CommandsUseCase) pushPending() {
+	if uc.pusher == nil {
+		return
+	}
+	for _, deviceID := range uc.pusher.List() {
+		uc.pushDevice(deviceID)
+	}
+}
@@ -0,0 +1,182 @@
+package usecases
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"iot-server/entities"
+)
+
+// Delivery event kinds
+const (
+	DeliveryEnqueued  = "enqueued"
+	DeliverySent      = "sent"
+	DeliveryAcked     = "acked" // the device answered; see Command.Status for executed or failed
+	DeliveryRequeued  = "requeued"
+	DeliveryFailed    = "failed" // no acknowledgement after the last attempt
+	DeliveryExpired   = "expired"
+	DeliveryCancelled = "cancelled"
+)
+
+// Transports a command can be delivered over
+const (
+	TransportWebSocket = "websocket"
+	TransportPoll      = "poll"
+)
+
+// DeliveryEvent describes one step in a command's delivery.
+type DeliveryEvent struct {
+	Kind      string
+	Command   entities.Command
+	Transport string // set for DeliverySent
+	At        time.Time
+}
+
+// DeliveryHook observes delivery events. Hooks run synchronously on the
+// delivering goroutine and must not block.
+type DeliveryHook func(DeliveryEvent)
+
+// OnDeliveryEvent registers a hook. Register hooks before serving requests.
+func (uc *CommandsUseCase) OnDeliveryEvent(h DeliveryHook) {
+	uc.hooks = append(uc.hooks, h)
+}
+
+// emit wakes whoever waits on the command or the device and runs the hooks.
+func (uc *CommandsUseCase) emit(kind string, cmd *entities.Command, transport string) {
+	uc.waiters.notify(cmd.ID)
+	if kind != DeliverySent {
+		// A new command, or one that stopped blocking its module
+		uc.pollers.notify(cmd.DeviceID)
+	}
+	ev := DeliveryEvent{Kind: kind, Command: *cmd, Transport: transport, At: time.Now()}
+	for _, h := range uc.hooks {
+		h(ev)
+	}
+}
+
+// CommandEnvelope is a command as delivered to a device, identical over
+// WebSocket and HTTP polling.
+type CommandEnvelope struct {
+	Type           string          `json:"type"` // always "command"
+	CommandID      string          `json:"command_id"`
+	ID             string          `json:"id"` // same as command_id, for poll clients that read "id"
+	DeviceModuleID string          `json:"device_module_id"`
+	Command        string          `json:"command"`
+	Params         json.RawMessage `json:"params"`
+	Seq            int64           `json:"seq"`
+	Priority       int             `json:"priority"`
+	Attempt        int             `json:"attempt"`
+	Timestamp      string          `json:"timestamp"`
+}
+
+// NewCommandEnvelope builds the envelope for delivering cmd now.
+func NewCommandEnvelope(cmd *entities.Command) CommandEnvelope {
+	return CommandEnvelope{
+		Type:           "command",
+		CommandID:      cmd.ID,
+		ID:             cmd.ID,
+		DeviceModuleID: cmd.DeviceModuleID,
+		Command:        cmd.Command,
+		Params:         rawJSON(cmd.Params, "{}"),
+		Seq:            cmd.Seq,
+		Priority:       cmd.Priority,
+		Attempt:        cmd.Attempts + 1,
+		Timestamp:      time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// Dispatch is the single way commands reach devices; every endpoint that
+// produces one goes through it. It stores the command and pushes it over
+// WebSocket if the device is connected and nothing it must wait behind is
+// outstanding. Otherwise it stays pending for the sweeper or the device's
+// next Poll, which delivers the same CommandEnvelope. The returned command's
+// Status tells which happened.
+func (uc *CommandsUseCase) Dispatch(deviceID, deviceModuleID, command string, params map[string]interface{}, opts EnqueueOptions) (*entities.Command, error) {
+	cmd, err := uc.enqueue(deviceID, deviceModuleID, command, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	uc.deliver(cmd)
+	return cmd, nil
+}
+
+// deliver pushes the device's due commands and reports whether cmd was among them.
+func (uc *CommandsUseCase) deliver(cmd *entities.Command) bool {
+	if uc.pusher == nil {
+		return false
+	}
+	for _, id := range uc.pushDevice(cmd.DeviceID) {
+		if id == cmd.ID {
+			cmd.Status = entities.CommandStatusSent
+			return true
+		}
+	}
+	return false
+}
+
+// pushDevice pushes the device's due commands in delivery order and returns
+// the ids that were sent. Commands are claimed before anything is written, as
+// in Poll, so concurrent dispatches, sweeps, polls and other instances never
+// push the same command twice. Claimed commands that could not be written are
+// requeued at once.
+func (uc *CommandsUseCase) pushDevice(deviceID string) []string {
+	cmds, err := uc.repo.GetPendingByDeviceID(deviceID, 10)
+	if err != nil {
+		log.Printf("loading pending commands for %s: %v", deviceID, err)
+		return nil
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		ids = append(ids, cmd.ID)
+	}
+	now := time.Now()
+	claimed, err := uc.repo.ClaimPending(ids, now)
+	if err != nil {
+		log.Printf("claiming commands for %s: %v", deviceID, err)
+		return nil
+	}
+
+	sent := make([]string, 0, len(claimed))
+	failed := false
+	for i := range cmds {
+		if !slices.Contains(claimed, cmds[i].ID) {
+			continue
+		}
+		if !failed {
+			b, _ := json.Marshal(NewCommandEnvelope(&cmds[i]))
+			if err := uc.pusher.SendToDevice(deviceID, b); err == nil {
+				sent = append(sent, cmds[i].ID)
+				cmds[i].Status = entities.CommandStatusSent
+				uc.emit(DeliverySent, &cmds[i], TransportWebSocket)
+				continue
+			}
+			failed = true
+		}
+		if _, err := uc.repo.Requeue(cmds[i].ID, now); err != nil {
+			log.Printf("requeueing unsent command %s: %v", cmds[i].ID, err)
+		}
+	}
+	return sent
+}
+
+// notifyCancelled tells a connected device to drop a command it may have received.
+func (uc *CommandsUseCase) notifyCancelled(cmd *entities.Command) {
+	if uc.pusher == nil || !uc.pusher.IsConnected(cmd.DeviceID) {
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":             "command_cancelled",
+		"command_id":       cmd.ID,
+		"device_module_id": cmd.DeviceModuleID,
+		"command":          cmd.Command,
+		"timestamp":        time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err := uc.pusher.SendToDevice(cmd.DeviceID, b); err != nil {
+		log.Printf("could not notify device %s of cancelled command %s: %v", cmd.DeviceID, cmd.ID, err)
+	}
+}
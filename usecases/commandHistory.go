@@ -0,0 +1,227 @@
+package usecases
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+const (
+	defaultCommandPageSize = 50
+	maxCommandPageSize     = 200
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sensitiveParams are command params that are delivered to the device but
+// masked whenever a command is shown to users, e.g. the CHANGE_WIFI password.
+var sensitiveParams = map[string]bool{
+	"password":   true,
+	"passphrase": true,
+	"psk":        true,
+	"secret":     true,
+	"token":      true,
+}
+
+const redactedValue = "[redacted]"
+
+// CommandView is a command as returned by the history API, with params and
+// response decoded so clients don't have to parse JSON strings. Sensitive
+// params are masked.
+type CommandView struct {
+	ID             string          `json:"id"`
+	DeviceID       string          `json:"device_id"`
+	DeviceModuleID string          `json:"device_module_id"`
+	Command        string          `json:"command"`
+	Seq            int64           `json:"seq"`
+	Priority       int             `json:"priority"`
+	Params         json.RawMessage `json:"params"`
+	Status         string          `json:"status"`
+	Response       json.RawMessage `json:"response"`
+	Attempts       int             `json:"attempts"`
+	AckDeadline    string          `json:"ack_deadline,omitempty"`
+	NextAttemptAt  string          `json:"next_attempt_at,omitempty"`
+	ExpiresAt      string          `json:"expires_at,omitempty"`
+	BatchID        string          `json:"batch_id,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+	UpdatedAt      string          `json:"updated_at"`
+}
+
+// CommandQuery is the caller-facing form of a history query.
+type CommandQuery struct {
+	DeviceID       string
+	DeviceModuleID string
+	BatchID        string
+	Statuses       []string
+	Command        string
+	From           time.Time // zero means unbounded
+	To             time.Time
+	Cursor         string
+	Limit          int
+}
+
+// ListCommands returns one page of command history, newest first, limited to
+// deviceIDs unless it is nil. The returned cursor is "" on the last page.
+func (uc *CommandsUseCase) ListCommands(deviceIDs []string, q CommandQuery) ([]CommandView, string, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultCommandPageSize
+	}
+	if limit > maxCommandPageSize {
+		limit = maxCommandPageSize
+	}
+	f := repositories.CommandFilter{
+		DeviceIDs:      deviceIDs,
+		DeviceID:       q.DeviceID,
+		DeviceModuleID: q.DeviceModuleID,
+		BatchID:        q.BatchID,
+		Statuses:       q.Statuses,
+		Command:        q.Command,
+		Limit:          limit + 1, // one extra row tells us whether there is a next page
+	}
+	if !q.From.IsZero() {
+		f.CreatedFrom = q.From.UTC().Format(time.RFC3339)
+	}
+	if !q.To.IsZero() {
+		f.CreatedTo = q.To.UTC().Format(time.RFC3339)
+	}
+	if q.Cursor != "" {
+		createdAt, id, err := decodeCommandCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		f.AfterCreatedAt, f.AfterID = createdAt, id
+	}
+
+	cmds, err := uc.repo.List(f)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(cmds) > limit {
+		cmds = cmds[:limit]
+		last := cmds[limit-1]
+		next = encodeCommandCursor(last.CreatedAt, last.ID)
+	}
+	views := make([]CommandView, 0, len(cmds))
+	for i := range cmds {
+		views = append(views, ToCommandView(&cmds[i]))
+	}
+	return views, next, nil
+}
+
+// GetCommand loads a single command.
+func (uc *CommandsUseCase) GetCommand(id string) (*entities.Command, error) {
+	cmd, err := uc.repo.GetByID(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return cmd, nil
+}
+
+func ToCommandView(cmd *entities.Command) CommandView {
+	return CommandView{
+		ID:             cmd.ID,
+		DeviceID:       cmd.DeviceID,
+		DeviceModuleID: cmd.DeviceModuleID,
+		Command:        cmd.Command,
+		Seq:            cmd.Seq,
+		Priority:       cmd.Priority,
+		Params:         redactParams(rawJSON(cmd.Params, "{}")),
+		Status:         cmd.Status,
+		Response:       rawJSON(cmd.Response, "null"),
+		Attempts:       cmd.Attempts,
+		AckDeadline:    cmd.AckDeadline,
+		NextAttemptAt:  cmd.NextAttemptAt,
+		ExpiresAt:      cmd.ExpiresAt,
+		BatchID:        cmd.BatchID,
+		CreatedAt:      cmd.CreatedAt,
+		UpdatedAt:      cmd.UpdatedAt,
+	}
+}
+
+// rawJSON passes stored JSON through as-is, falling back to def for empty or invalid values.
+func rawJSON(s, def string) json.RawMessage {
+	if s == "" || !json.Valid([]byte(s)) {
+		return json.RawMessage(def)
+	}
+	return json.RawMessage(s)
+}
+
+// redactParams masks the values of sensitiveParams, at any depth.
+func redactParams(params json.RawMessage) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(params, &v); err != nil {
+		return params
+	}
+	if !redactValue(v) {
+		return params
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return b
+}
+
+// redactParamsMap returns a copy of params with sensitiveParams masked.
+func redactParamsMap(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(redactParams(raw), &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// redactValue masks sensitive keys in place and reports whether it changed anything.
+func redactValue(v interface{}) bool {
+	changed := false
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if sensitiveParams[strings.ToLower(k)] {
+				t[k] = redactedValue
+				changed = true
+				continue
+			}
+			if redactValue(child) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range t {
+			if redactValue(child) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func encodeCommandCursor(createdAt, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt + "|" + id))
+}
+
+func decodeCommandCursor(cursor string) (string, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", ErrInvalidCursor
+	}
+	createdAt, id, ok := strings.Cut(string(b), "|")
+	if !ok || createdAt == "" || id == "" {
+		return "", "", ErrInvalidCursor
+	}
+	return createdAt, id, nil
+}
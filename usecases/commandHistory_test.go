@@ -0,0 +1,88 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"iot-server/entities"
+)
+
+func TestToCommandViewRedactsSensitiveParams(t *testing.T) {
+	cmd := &entities.Command{
+		ID:      "c1",
+		Command: "CHANGE_WIFI",
+		Params:  `{"ssid":"home","password":"hunter22","nested":{"Token":"abc"},"list":[{"psk":"x"}]}`,
+	}
+	view := ToCommandView(cmd)
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(view.Params, &params); err != nil {
+		t.Fatalf("params are not JSON: %v", err)
+	}
+	if params["ssid"] != "home" {
+		t.Errorf("ssid = %v, want home", params["ssid"])
+	}
+	if params["password"] != redactedValue {
+		t.Errorf("password = %v, want redacted", params["password"])
+	}
+	if nested := params["nested"].(map[string]interface{}); nested["Token"] != redactedValue {
+		t.Errorf("nested token = %v, want redacted", nested["Token"])
+	}
+	if item := params["list"].([]interface{})[0].(map[string]interface{}); item["psk"] != redactedValue {
+		t.Errorf("psk in list = %v, want redacted", item["psk"])
+	}
+	if cmd.Params == string(view.Params) {
+		t.Error("stored params were returned verbatim")
+	}
+}
+
+func TestToCommandViewKeepsPlainParams(t *testing.T) {
+	raw := `{"n": 3}`
+	view := ToCommandView(&entities.Command{Params: raw})
+	if string(view.Params) != raw {
+		t.Errorf("params = %s, want %s unchanged", view.Params, raw)
+	}
+	if got := string(ToCommandView(&entities.Command{}).Params); got != "{}" {
+		t.Errorf("empty params = %s, want {}", got)
+	}
+}
+
+func TestCommandCursorRoundTrip(t *testing.T) {
+	cursor := encodeCommandCursor("2026-01-02T03:04:05Z", "cmd-1")
+	createdAt, id, err := decodeCommandCursor(cursor)
+	if err != nil || createdAt != "2026-01-02T03:04:05Z" || id != "cmd-1" {
+		t.Errorf("decoded %q, %q, %v", createdAt, id, err)
+	}
+	for _, bad := range []string{"%%%", encodeCommandCursor("", "cmd-1"), encodeCommandCursor("2026-01-02T03:04:05Z", "")} {
+		if _, _, err := decodeCommandCursor(bad); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeCommandCursor(%q) err = %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+}
+
+func TestRedactScheduleAndMacro(t *testing.T) {
+	s := entities.CommandSchedule{Command: "CHANGE_WIFI", Params: `{"ssid":"home","password":"hunter22"}`}
+	shown := RedactSchedule(s)
+	if shown.Params != `{"password":"[redacted]","ssid":"home"}` {
+		t.Errorf("schedule params = %s", shown.Params)
+	}
+	if s.Params != `{"ssid":"home","password":"hunter22"}` {
+		t.Error("RedactSchedule changed the stored schedule")
+	}
+
+	m := entities.Macro{Steps: entities.MacroSteps{
+		{Command: "CHANGE_WIFI", Params: map[string]interface{}{"ssid": "home", "psk": "x"}},
+		{Command: "REBOOT"},
+	}}
+	shownMacro := RedactMacro(m)
+	if p := shownMacro.Steps[0].Params; p["psk"] != redactedValue || p["ssid"] != "home" {
+		t.Errorf("macro step params = %v", p)
+	}
+	if shownMacro.Steps[1].Params != nil {
+		t.Errorf("empty params became %v", shownMacro.Steps[1].Params)
+	}
+	if m.Steps[0].Params["psk"] != "x" {
+		t.Error("RedactMacro changed the stored macro")
+	}
+}
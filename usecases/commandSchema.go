@@ -0,0 +1,213 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Parameter types a module may declare
+const (
+	ParamTypeString  = "string"
+	ParamTypeInteger = "integer"
+	ParamTypeNumber  = "number"
+	ParamTypeBoolean = "boolean"
+)
+
+// CommandSpec describes a command a module accepts. Modules declare them in
+// DeviceModule.Commands, either as plain names ("OPEN_DOOR"), which accept any
+// params, or as objects with a typed parameter schema:
+//
+//	{"name": "BLINK", "params": {"n": {"type": "integer", "min": 1, "max": 20, "default": 3}}}
+type CommandSpec struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description,omitempty"`
+	Params      map[string]ParamSpec `json:"params,omitempty"`
+	// Typed is false for commands declared by name only; their params are not checked.
+	Typed bool `json:"typed"`
+}
+
+// ParamSpec constrains a single command parameter.
+type ParamSpec struct {
+	Type        string        `json:"type"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Default     interface{}   `json:"default,omitempty"`
+	Min         *float64      `json:"min,omitempty"` // numbers: value range, strings: length range
+	Max         *float64      `json:"max,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+}
+
+// FieldError is a single problem with a command or one of its params.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// CommandValidationError lists everything wrong with an enqueued command.
+type CommandValidationError struct {
+	Errors []FieldError
+}
+
+func (e *CommandValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return "invalid command: " + strings.Join(msgs, "; ")
+}
+
+// ParseCommandSpecs decodes a module's declared commands. The second return
+// value is false when the module never declared any, in which case commands
+// sent to it are not validated.
+func ParseCommandSpecs(raw string) ([]CommandSpec, bool, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "null" {
+		return nil, false, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		return nil, false, errors.New("commands must be a JSON array")
+	}
+	specs := make([]CommandSpec, 0, len(items))
+	seen := map[string]bool{}
+	for i, item := range items {
+		var spec CommandSpec
+		var name string
+		if err := json.Unmarshal(item, &name); err == nil {
+			spec = CommandSpec{Name: name}
+		} else if err := json.Unmarshal(item, &spec); err != nil {
+			return nil, false, fmt.Errorf("commands[%d]: must be a name or an object", i)
+		} else {
+			spec.Typed = true
+		}
+		if spec.Name == "" {
+			return nil, false, fmt.Errorf("commands[%d]: name is required", i)
+		}
+		if seen[spec.Name] {
+			return nil, false, fmt.Errorf("commands[%d]: duplicate command %s", i, spec.Name)
+		}
+		seen[spec.Name] = true
+		for pname, p := range spec.Params {
+			if err := p.check(); err != nil {
+				return nil, false, fmt.Errorf("commands[%d].params.%s: %v", i, pname, err)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, true, nil
+}
+
+func (p ParamSpec) check() error {
+	switch p.Type {
+	case ParamTypeString, ParamTypeInteger, ParamTypeNumber, ParamTypeBoolean:
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return errors.New("min is greater than max")
+	}
+	if p.Default != nil {
+		if msg := p.validate(p.Default); msg != "" {
+			return errors.New("default " + msg)
+		}
+	}
+	return nil
+}
+
+// ValidateCommand checks a command and its params against the module's
+// specs and fills in defaults. It returns the params to store.
+func ValidateCommand(specs []CommandSpec, command string, params map[string]interface{}) (map[string]interface{}, error) {
+	var spec *CommandSpec
+	for i := range specs {
+		if specs[i].Name == command {
+			spec = &specs[i]
+			break
+		}
+	}
+	if spec == nil {
+		return nil, &CommandValidationError{Errors: []FieldError{{Field: "command", Message: fmt.Sprintf("module does not support %s", command)}}}
+	}
+	if !spec.Typed {
+		return params, nil
+	}
+
+	out := make(map[string]interface{}, len(spec.Params))
+	var errs []FieldError
+	for name, v := range params {
+		p, ok := spec.Params[name]
+		if !ok {
+			errs = append(errs, FieldError{Field: "params." + name, Message: "unknown parameter"})
+			continue
+		}
+		if msg := p.validate(v); msg != "" {
+			errs = append(errs, FieldError{Field: "params." + name, Message: msg})
+			continue
+		}
+		out[name] = v
+	}
+	for name, p := range spec.Params {
+		if _, ok := params[name]; ok {
+			continue
+		}
+		switch {
+		case p.Default != nil:
+			out[name] = p.Default
+		case p.Required:
+			errs = append(errs, FieldError{Field: "params." + name, Message: "is required"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return nil, &CommandValidationError{Errors: errs}
+	}
+	return out, nil
+}
+
+// validate returns a description of what is wrong with v, or "" if it is acceptable.
+func (p ParamSpec) validate(v interface{}) string {
+	switch p.Type {
+	case ParamTypeString:
+		s, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+		n := float64(len([]rune(s)))
+		if p.Min != nil && n < *p.Min {
+			return fmt.Sprintf("must be at least %g characters", *p.Min)
+		}
+		if p.Max != nil && n > *p.Max {
+			return fmt.Sprintf("must be at most %g characters", *p.Max)
+		}
+	case ParamTypeInteger, ParamTypeNumber:
+		f, ok := v.(float64)
+		if p.Type == ParamTypeInteger && (!ok || f != math.Trunc(f)) {
+			return "must be an integer"
+		}
+		if !ok {
+			return "must be a number"
+		}
+		if p.Min != nil && f < *p.Min {
+			return fmt.Sprintf("must be >= %g", *p.Min)
+		}
+		if p.Max != nil && f > *p.Max {
+			return fmt.Sprintf("must be <= %g", *p.Max)
+		}
+	case ParamTypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return "must be a boolean"
+		}
+	}
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if e == v {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %v", p.Enum)
+	}
+	return ""
+}
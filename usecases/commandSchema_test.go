@@ -0,0 +1,110 @@
+package usecases
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const blinkSpecs = `[
+	"REBOOT",
+	{"name": "BLINK", "params": {
+		"n": {"type": "integer", "min": 1, "max": 20, "default": 3},
+		"color": {"type": "string", "enum": ["red", "green"], "required": true},
+		"label": {"type": "string", "max": 4},
+		"level": {"type": "number", "min": 0, "max": 1},
+		"fast": {"type": "boolean"}
+	}}
+]`
+
+func TestParseCommandSpecs(t *testing.T) {
+	specs, declared, err := ParseCommandSpecs(blinkSpecs)
+	if err != nil || !declared {
+		t.Fatalf("ParseCommandSpecs = %v, %v", declared, err)
+	}
+	if len(specs) != 2 || specs[0].Name != "REBOOT" || specs[0].Typed || !specs[1].Typed || len(specs[1].Params) != 5 {
+		t.Errorf("specs = %+v", specs)
+	}
+
+	for _, raw := range []string{"", "  ", "null"} {
+		if specs, declared, err := ParseCommandSpecs(raw); err != nil || declared || specs != nil {
+			t.Errorf("ParseCommandSpecs(%q) = %v, %v, %v; want undeclared", raw, specs, declared, err)
+		}
+	}
+
+	bad := map[string]string{
+		"not an array":   `{"name": "X"}`,
+		"not a spec":     `[42]`,
+		"missing name":   `[{"params": {}}]`,
+		"duplicate":      `["X", {"name": "X"}]`,
+		"unknown type":   `[{"name": "X", "params": {"p": {"type": "date"}}}]`,
+		"min above max":  `[{"name": "X", "params": {"p": {"type": "number", "min": 5, "max": 1}}}]`,
+		"bad default":    `[{"name": "X", "params": {"p": {"type": "integer", "default": 1.5}}}]`,
+		"default not in": `[{"name": "X", "params": {"p": {"type": "string", "enum": ["a"], "default": "b"}}}]`,
+	}
+	for name, raw := range bad {
+		if _, _, err := ParseCommandSpecs(raw); err == nil {
+			t.Errorf("%s: accepted %s", name, raw)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	specs, _, err := ParseCommandSpecs(blinkSpecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Untyped commands pass params through untouched
+	anything := map[string]interface{}{"whatever": true}
+	if out, err := ValidateCommand(specs, "REBOOT", anything); err != nil || !reflect.DeepEqual(out, anything) {
+		t.Errorf("REBOOT = %v, %v", out, err)
+	}
+
+	out, err := ValidateCommand(specs, "BLINK", map[string]interface{}{"color": "red", "level": 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"color": "red", "level": 0.5, "n": float64(3)}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("BLINK params = %v, want %v with the default filled in", out, want)
+	}
+
+	_, err = ValidateCommand(specs, "BLINK", map[string]interface{}{
+		"n":     float64(2.5),
+		"label": "too long",
+		"level": float64(2),
+		"fast":  "yes",
+		"extra": 1,
+	})
+	var verr *CommandValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("err = %v, want a CommandValidationError", err)
+	}
+	var fields []string
+	for _, fe := range verr.Errors {
+		fields = append(fields, fe.Field)
+	}
+	wantFields := []string{"params.color", "params.extra", "params.fast", "params.label", "params.level", "params.n"}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("error fields = %v, want %v (sorted)", fields, wantFields)
+	}
+	if !strings.HasPrefix(err.Error(), "invalid command: params.color: is required") {
+		t.Errorf("message = %q", err.Error())
+	}
+
+	for name, params := range map[string]map[string]interface{}{
+		"not in enum":       {"color": "blue"},
+		"integer as string": {"color": "red", "n": "3"},
+		"below min":         {"color": "red", "n": float64(0)},
+	} {
+		if _, err := ValidateCommand(specs, "BLINK", params); !errors.As(err, &verr) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	if _, err := ValidateCommand(specs, "SELF_DESTRUCT", nil); !errors.As(err, &verr) || verr.Errors[0].Field != "command" {
+		t.Errorf("unsupported command: err = %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"iot-server/entities"
+)
+
+const (
+	// MaxCommandWait caps how long a request may block waiting for a device.
+	MaxCommandWait = 60 * time.Second
+	// waitRecheckInterval re-reads the command in case it was acked through another server instance.
+	waitRecheckInterval = 2 * time.Second
+	// pollRecheckInterval re-checks a parked poll for commands enqueued through another server instance.
+	pollRecheckInterval = 5 * time.Second
+)
+
+var (
+	ErrWaitTimeout  = errors.New("timed out waiting for the device to acknowledge the command")
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
+// Shutdown releases every parked WaitForResult and WaitForCommands call, and
+// any started later, so they don't hold up a graceful server shutdown. It
+// also stops the sweeper, waiting for a sweep in progress to finish.
+func (uc *CommandsUseCase) Shutdown() {
+	uc.shutdownOnce.Do(func() { close(uc.shutdown) })
+	uc.sweeper.Wait()
+}
+
+// commandWaiters wakes requests blocked on a key: a command id whose status
+// changes, or a device id that may have new commands.
+type commandWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+func (w *commandWaiters) add(id string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	if w.waiters == nil {
+		w.waiters = map[string][]chan struct{}{}
+	}
+	w.waiters[id] = append(w.waiters[id], ch)
+	w.mu.Unlock()
+	return ch
+}
+
+func (w *commandWaiters) remove(id string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := w.waiters[id]
+	for i, c := range list {
+		if c == ch {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(w.waiters, id)
+	} else {
+		w.waiters[id] = list
+	}
+}
+
+func (w *commandWaiters) notify(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.waiters[id] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IsFinal reports whether a command has reached a status it will not leave on its own.
+func IsFinal(status string) bool {
+	switch status {
+	case entities.CommandStatusExecuted, entities.CommandStatusFailed,
+		entities.CommandStatusExpired, entities.CommandStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// WaitForResult blocks until the command reaches a final status, the timeout
+// elapses (ErrWaitTimeout), the server shuts down (ErrShuttingDown) or ctx is
+// done. It returns the latest stored command.
+func (uc *CommandsUseCase) WaitForResult(ctx context.Context, id string, timeout time.Duration) (*entities.Command, error) {
+	if timeout > MaxCommandWait {
+		timeout = MaxCommandWait
+	}
+	ch := uc.waiters.add(id)
+	defer uc.waiters.remove(id, ch)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+	for {
+		// Check after registering so an ack that lands in between isn't missed
+		cmd, err := uc.repo.GetByID(id)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		if IsFinal(cmd.Status) {
+			return cmd, nil
+		}
+		select {
+		case <-ch:
+		case <-recheck.C:
+		case <-timer.C:
+			return cmd, ErrWaitTimeout
+		case <-uc.shutdown:
+			return cmd, ErrShuttingDown
+		case <-ctx.Done():
+			return cmd, ctx.Err()
+		}
+	}
+}
+
+// WaitForCommands is Poll that parks until the device has due commands, the
+// timeout elapses, the server shuts down or ctx is done (the client went
+// away). It is woken as soon as a command is enqueued for the device, or one
+// it was waiting behind is acknowledged. On timeout or shutdown it returns no
+// commands and no error, so the device simply polls again.
+func (uc *CommandsUseCase) WaitForCommands(ctx context.Context, deviceID string, limit int, timeout time.Duration) ([]CommandEnvelope, error) {
+	if timeout > MaxCommandWait {
+		timeout = MaxCommandWait
+	}
+	ch := uc.pollers.add(deviceID)
+	defer uc.pollers.remove(deviceID, ch)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	recheck := time.NewTicker(pollRecheckInterval)
+	defer recheck.Stop()
+	for {
+		// Poll after registering so a command enqueued in between isn't missed
+		cmds, err := uc.Poll(deviceID, limit)
+		if err != nil || len(cmds) > 0 {
+			return cmds, err
+		}
+		select {
+		case <-ch:
+		case <-recheck.C:
+		case <-timer.C:
+			return []CommandEnvelope{}, nil
+		case <-uc.shutdown:
+			return []CommandEnvelope{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
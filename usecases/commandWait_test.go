@@ -0,0 +1,73 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// idleCommandRepo has nothing to deliver and never changes a command's status.
+type idleCommandRepo struct {
+	repositories.CommandRepository
+}
+
+func (idleCommandRepo) GetPendingByDeviceID(string, int) ([]entities.Command, error) {
+	return nil, nil
+}
+
+func (idleCommandRepo) GetByID(id string) (*entities.Command, error) {
+	return &entities.Command{ID: id, Status: entities.CommandStatusSent}, nil
+}
+
+func TestShutdownReleasesWaits(t *testing.T) {
+	uc := NewCommandsUseCase(idleCommandRepo{}, nil, DeliveryPolicy{})
+
+	type result struct {
+		err   error
+		count int
+	}
+	polls := make(chan result, 1)
+	results := make(chan result, 1)
+	go func() {
+		cmds, err := uc.WaitForCommands(context.Background(), "dev-1", 10, MaxCommandWait)
+		polls <- result{err, len(cmds)}
+	}()
+	go func() {
+		_, err := uc.WaitForResult(context.Background(), "cmd-1", MaxCommandWait)
+		results <- result{err: err}
+	}()
+
+	time.Sleep(20 * time.Millisecond) // let both park
+	uc.Shutdown()
+	uc.Shutdown() // idempotent
+
+	select {
+	case r := <-polls:
+		if r.err != nil || r.count != 0 {
+			t.Errorf("WaitForCommands = %d commands, %v; want an empty answer", r.count, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCommands still parked after Shutdown")
+	}
+	select {
+	case r := <-results:
+		if !errors.Is(r.err, ErrShuttingDown) {
+			t.Errorf("WaitForResult err = %v, want ErrShuttingDown", r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForResult still parked after Shutdown")
+	}
+
+	// Waits started during shutdown return straight away
+	start := time.Now()
+	if _, err := uc.WaitForResult(context.Background(), "cmd-2", MaxCommandWait); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("late WaitForResult err = %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("late wait blocked")
+	}
+}
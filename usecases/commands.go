@@ -3,22 +3,80 @@ package usecases
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"iot-server/entities"
 	"iot-server/repositories"
+	"log"
+	"slices"
+	"sync"
+	"time"
 )
 
+var ErrNotCancellable = errors.New("only pending or sent commands can be cancelled")
+
+// ErrCommandFinished is returned when a response arrives for a command that
+// already reached a different final status.
+var ErrCommandFinished = errors.New("command is no longer awaiting a response")
+
 type CommandsUseCase struct {
-	repo repositories.CommandRepository
+	repo    repositories.CommandRepository
+	modules repositories.DeviceModuleRepository
+	policy  DeliveryPolicy
+	pusher  CommandPusher
+	waiters commandWaiters
+	pollers commandWaiters // keyed by device id, woken when it may have new commands
+	hooks   []DeliveryHook
+
+	shutdown     chan struct{} // closed by Shutdown to release parked waits and stop the sweeper
+	shutdownOnce sync.Once
+	sweeper      sync.WaitGroup
 }
 
-func NewCommandsUseCase(r repositories.CommandRepository) *CommandsUseCase {
-	return &CommandsUseCase{repo: r}
+func NewCommandsUseCase(r repositories.CommandRepository, modules repositories.DeviceModuleRepository, policy DeliveryPolicy) *CommandsUseCase {
+	return &CommandsUseCase{repo: r, modules: modules, policy: policy, shutdown: make(chan struct{})}
 }
 
-func (uc *CommandsUseCase) Enqueue(deviceID, deviceModuleID, command string, params map[string]interface{}) (*entities.Command, error) {
+// EnqueueOptions override the delivery policy for a single command.
+type EnqueueOptions struct {
+	AckTimeout time.Duration // 0 uses the policy default
+	TTL        time.Duration // 0 uses the policy default
+	// SupersedeKey cancels older pending commands for the same module with the same key
+	SupersedeKey string
+	BatchID      string
+	// Priority overrides the default; higher is delivered first (see entities.CommandPriority*)
+	Priority *int
+}
+
+// enqueue validates and stores a command; Dispatch is the public entry point.
+func (uc *CommandsUseCase) enqueue(deviceID, deviceModuleID, command string, params map[string]interface{}, opts EnqueueOptions) (*entities.Command, error) {
 	if deviceID == "" || command == "" {
 		return nil, errors.New("device_id and command are required")
 	}
+	if opts.AckTimeout < 0 || opts.TTL < 0 {
+		return nil, errors.New("ack timeout and ttl must not be negative")
+	}
+	priority := uc.policy.priorityFor(command)
+	if opts.Priority != nil {
+		priority = *opts.Priority
+		if priority < entities.CommandPriorityLow || priority > entities.CommandPriorityUrgent {
+			return nil, fmt.Errorf("priority must be between %d and %d", entities.CommandPriorityLow, entities.CommandPriorityUrgent)
+		}
+	}
+	ackTimeout := opts.AckTimeout
+	if ackTimeout == 0 {
+		ackTimeout = uc.policy.AckTimeout
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = uc.policy.TTL
+	}
+	if deviceModuleID != "" {
+		validated, err := uc.validateForModule(deviceID, deviceModuleID, command, params)
+		if err != nil {
+			return nil, err
+		}
+		params = validated
+	}
 	var paramsStr string
 	if params != nil {
 		b, _ := json.Marshal(params)
@@ -31,31 +89,189 @@ func (uc *CommandsUseCase) Enqueue(deviceID, deviceModuleID, command string, par
 		DeviceModuleID: deviceModuleID,
 		Command:        command,
 		Params:         paramsStr,
-		Status:         "pending",
+		Status:         entities.CommandStatusPending,
+		Priority:       priority,
+		AckTimeout:     int(ackTimeout / time.Second),
+		SupersedeKey:   opts.SupersedeKey,
+		BatchID:        opts.BatchID,
+	}
+	if ttl > 0 {
+		cmd.ExpiresAt = time.Now().UTC().Add(ttl).Format(time.RFC3339)
 	}
 	if err := uc.repo.Enqueue(cmd); err != nil {
 		return nil, err
 	}
+	if cmd.SupersedeKey != "" {
+		uc.cancelSuperseded(cmd)
+	}
+	uc.emit(DeliveryEnqueued, cmd, "")
+	return cmd, nil
+}
+
+// validateForModule checks the command against the schema the module
+// declared, if any, and returns the params with defaults applied.
+func (uc *CommandsUseCase) validateForModule(deviceID, moduleID, command string, params map[string]interface{}) (map[string]interface{}, error) {
+	module, err := uc.modules.GetByID(moduleID)
+	if err != nil {
+		return nil, errors.New("device module not found")
+	}
+	if module.DeviceID != deviceID {
+		return nil, errors.New("module does not belong to device")
+	}
+	specs, declared, err := ParseCommandSpecs(module.Commands)
+	if err != nil {
+		return nil, fmt.Errorf("module has an invalid command schema: %w", err)
+	}
+	if !declared {
+		return params, nil
+	}
+	return ValidateCommand(specs, command, params)
+}
+
+// ModuleCommands returns the commands a module declares, for clients building UIs.
+func (uc *CommandsUseCase) ModuleCommands(module *entities.DeviceModule) ([]CommandSpec, error) {
+	specs, _, err := ParseCommandSpecs(module.Commands)
+	if err != nil {
+		return nil, err
+	}
+	if specs == nil {
+		specs = []CommandSpec{}
+	}
+	return specs, nil
+}
+
+// Cancel withdraws a pending or sent command and tells the device, if connected.
+func (uc *CommandsUseCase) Cancel(id string) (*entities.Command, error) {
+	cmd, err := uc.repo.GetByID(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	resp, _ := json.Marshal(map[string]string{"error": "cancelled by user"})
+	ok, err := uc.repo.Cancel(cmd.ID, string(resp))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: command is %s", ErrNotCancellable, cmd.Status)
+	}
+	uc.notifyCancelled(cmd)
+	cmd.Status = entities.CommandStatusCancelled
+	cmd.Response = string(resp)
+	uc.emit(DeliveryCancelled, cmd, "")
 	return cmd, nil
 }
 
-func (uc *CommandsUseCase) Poll(deviceID string, limit int) ([]entities.Command, error) {
+func (uc *CommandsUseCase) cancelSuperseded(cmd *entities.Command) {
+	resp, _ := json.Marshal(map[string]string{"error": "superseded by command " + cmd.ID})
+	cancelled, err := uc.repo.CancelSuperseded(cmd, string(resp))
+	if err != nil {
+		log.Printf("failed to cancel commands superseded by %s: %v", cmd.ID, err)
+		return
+	}
+	for i := range cancelled {
+		// Requeued commands may already have reached the device once
+		if cancelled[i].Attempts > 0 {
+			uc.notifyCancelled(&cancelled[i])
+		}
+		uc.emit(DeliveryCancelled, &cancelled[i], "")
+	}
+}
+
+// Poll is the HTTP fallback of Dispatch. It claims the device's due commands
+// and returns them highest priority first, in sequence order within a
+// priority. Claimed commands are marked sent, so a concurrent poll never gets
+// the same ones.
+func (uc *CommandsUseCase) Poll(deviceID string, limit int) ([]CommandEnvelope, error) {
 	if deviceID == "" {
 		return nil, errors.New("device_id required")
 	}
-	return uc.repo.GetPendingByDeviceID(deviceID, limit)
+	cmds, err := uc.repo.GetPendingByDeviceID(deviceID, limit)
+	if err != nil || len(cmds) == 0 {
+		return []CommandEnvelope{}, err
+	}
+	ids := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		ids = append(ids, cmd.ID)
+	}
+	claimed, err := uc.repo.ClaimPending(ids, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]CommandEnvelope, 0, len(claimed))
+	for i := range cmds {
+		if slices.Contains(claimed, cmds[i].ID) {
+			out = append(out, NewCommandEnvelope(&cmds[i]))
+			cmds[i].Status = entities.CommandStatusSent
+			uc.emit(DeliverySent, &cmds[i], TransportPoll)
+		}
+	}
+	return out, nil
 }
 
-func (uc *CommandsUseCase) MarkSent(ids []string) error {
-	return uc.repo.MarkSent(ids)
+// CommandResponse is what a device reports back for a command, over WS
+// ("type": "command_response") or POST /api/v1/command-responses.
+type CommandResponse struct {
+	CommandID string          `json:"command_id"`
+	Status    string          `json:"status"`           // executed | failed (default executed)
+	Result    json.RawMessage `json:"result,omitempty"` // arbitrary JSON produced by the device
+	Error     string          `json:"error,omitempty"`  // failure reason when status=failed
 }
 
-func (uc *CommandsUseCase) Ack(commandID, status, response string) error {
+// Respond validates a device response and persists it as the command's status and response payload.
+func (uc *CommandsUseCase) Respond(deviceID string, resp CommandResponse) error {
+	if resp.Status == "" {
+		resp.Status = entities.CommandStatusExecuted
+		if resp.Error != "" {
+			resp.Status = entities.CommandStatusFailed
+		}
+	}
+	if len(resp.Result) > 0 && !json.Valid(resp.Result) {
+		return errors.New("result must be valid JSON")
+	}
+	payload := map[string]interface{}{}
+	if len(resp.Result) > 0 {
+		payload["result"] = resp.Result
+	}
+	if resp.Error != "" {
+		payload["error"] = resp.Error
+	}
+	b, _ := json.Marshal(payload)
+	return uc.Ack(deviceID, resp.CommandID, resp.Status, string(b))
+}
+
+// Ack records a device's response to a command, which must belong to deviceID.
+func (uc *CommandsUseCase) Ack(deviceID, commandID, status, response string) error {
 	if commandID == "" {
 		return errors.New("command_id required")
 	}
 	if status == "" {
-		status = "executed"
+		status = entities.CommandStatusExecuted
+	}
+	if status != entities.CommandStatusExecuted && status != entities.CommandStatusFailed {
+		return errors.New("status must be executed or failed")
+	}
+	if deviceID == "" {
+		return errors.New("device_id required")
+	}
+	cmd, err := uc.repo.GetByID(commandID)
+	if err != nil {
+		return errors.New("command not found")
+	}
+	if cmd.DeviceID != deviceID {
+		return errors.New("command does not belong to this device")
+	}
+	updated, err := uc.repo.UpdateStatus(commandID, status, response)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// A retried ack of the same outcome is fine; anything else lost the race
+		if current, err := uc.repo.GetByID(commandID); err == nil && current.Status == status {
+			return nil
+		}
+		return ErrCommandFinished
 	}
-	return uc.repo.UpdateStatus(commandID, status, response)
+	cmd.Status, cmd.Response = status, response
+	uc.emit(DeliveryAcked, cmd, "")
+	return nil
 }
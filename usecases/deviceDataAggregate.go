@@ -0,0 +1,109 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"iot-server/repositories"
+)
+
+const (
+	defaultAggregateRange = 24 * time.Hour
+	maxAggregateBuckets   = 10000
+)
+
+var ErrInvalidAggregation = errors.New("invalid aggregation")
+
+// DefaultBucketOrigin anchors buckets when the caller gives no origin. It is a
+// UTC midnight, so buckets that divide a day start on UTC day boundaries, and
+// a Monday, so week buckets run Monday to Monday like date_trunc('week').
+var DefaultBucketOrigin = time.Date(1970, time.January, 5, 0, 0, 0, 0, time.UTC)
+
+// fieldKeyPattern limits JSON path segments to plain keys, which keeps them
+// safe inside a Postgres text[] literal.
+var fieldKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// AggregateQuery is the caller-facing form of a telemetry aggregation.
+type AggregateQuery struct {
+	DeviceModuleID string
+	FieldPath      []string
+	Bucket         time.Duration
+	Origin         time.Time // buckets start at Origin + k*Bucket; zero means DefaultBucketOrigin
+	Functions      []string  // defaults to avg
+	From           time.Time
+	To             time.Time // zero means now
+	FillGaps       bool
+}
+
+// AggregateDeviceData buckets one numeric field of a module's readings. The
+// range defaults to the 24 hours before To. Buckets longer than a day must be
+// whole days, so they stay aligned to midnight of the origin.
+func (uc *DeviceUseCase) AggregateDeviceData(q AggregateQuery) ([]repositories.DeviceDataBucket, AggregateQuery, error) {
+	if len(q.FieldPath) == 0 {
+		return nil, q, fmt.Errorf("%w: field is required", ErrInvalidAggregation)
+	}
+	for _, key := range q.FieldPath {
+		if !fieldKeyPattern.MatchString(key) {
+			return nil, q, fmt.Errorf("%w: field keys may only contain letters, digits, _ and -", ErrInvalidAggregation)
+		}
+	}
+	if q.Bucket < time.Second || q.Bucket%time.Second != 0 {
+		return nil, q, fmt.Errorf("%w: bucket must be a whole number of seconds", ErrInvalidAggregation)
+	}
+	if q.Bucket > 24*time.Hour && q.Bucket%(24*time.Hour) != 0 {
+		return nil, q, fmt.Errorf("%w: buckets longer than a day must be a whole number of days", ErrInvalidAggregation)
+	}
+	if q.Origin.IsZero() {
+		q.Origin = DefaultBucketOrigin
+	}
+	q.Origin = q.Origin.UTC()
+	if len(q.Functions) == 0 {
+		q.Functions = []string{repositories.AggregateAvg}
+	}
+	seen := make(map[string]bool, len(q.Functions))
+	for _, fn := range q.Functions {
+		switch fn {
+		case repositories.AggregateAvg, repositories.AggregateMin, repositories.AggregateMax,
+			repositories.AggregateCount, repositories.AggregateFirst, repositories.AggregateLast:
+		default:
+			return nil, q, fmt.Errorf("%w: unsupported function %q", ErrInvalidAggregation, fn)
+		}
+		if seen[fn] {
+			return nil, q, fmt.Errorf("%w: function %q requested twice", ErrInvalidAggregation, fn)
+		}
+		seen[fn] = true
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-defaultAggregateRange)
+	}
+	q.From, q.To = q.From.UTC(), q.To.UTC()
+	if !q.From.Before(q.To) {
+		return nil, q, fmt.Errorf("%w: from must be before to", ErrInvalidAggregation)
+	}
+	if q.To.Sub(q.From)/q.Bucket > maxAggregateBuckets {
+		return nil, q, fmt.Errorf("%w: more than %d buckets, use a larger bucket or a shorter range", ErrInvalidAggregation, maxAggregateBuckets)
+	}
+
+	buckets, err := uc.DeviceDataRepo.Aggregate(repositories.DeviceDataAggregation{
+		DeviceModuleID: q.DeviceModuleID,
+		FieldPath:      q.FieldPath,
+		Bucket:         q.Bucket,
+		Origin:         q.Origin,
+		From:           q.From,
+		To:             q.To,
+		Functions:      q.Functions,
+		FillGaps:       q.FillGaps,
+	})
+	if err != nil {
+		return nil, q, err
+	}
+	if buckets == nil {
+		buckets = []repositories.DeviceDataBucket{}
+	}
+	return buckets, q, nil
+}
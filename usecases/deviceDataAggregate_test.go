@@ -0,0 +1,88 @@
+package usecases
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"iot-server/repositories"
+)
+
+// recordingDataRepo records the aggregation it is asked for.
+type recordingDataRepo struct {
+	repositories.DeviceDataRepository
+	got *repositories.DeviceDataAggregation
+}
+
+func (r *recordingDataRepo) Aggregate(a repositories.DeviceDataAggregation) ([]repositories.DeviceDataBucket, error) {
+	r.got = &a
+	return nil, nil
+}
+
+func TestAggregateDeviceDataValidation(t *testing.T) {
+	to := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	base := AggregateQuery{DeviceModuleID: "m1", FieldPath: []string{"env", "temperature"}, Bucket: time.Hour, To: to}
+
+	cases := map[string]func(q *AggregateQuery){
+		"no field":           func(q *AggregateQuery) { q.FieldPath = nil },
+		"unsafe field key":   func(q *AggregateQuery) { q.FieldPath = []string{"a}", "b"} },
+		"sub-second bucket":  func(q *AggregateQuery) { q.Bucket = 500 * time.Millisecond },
+		"fractional seconds": func(q *AggregateQuery) { q.Bucket = 1500 * time.Millisecond },
+		"36h bucket":         func(q *AggregateQuery) { q.Bucket = 36 * time.Hour; q.From = to.AddDate(0, -1, 0) },
+		"unknown function":   func(q *AggregateQuery) { q.Functions = []string{"median"} },
+		"repeated function":  func(q *AggregateQuery) { q.Functions = []string{"avg", "avg"} },
+		"empty range":        func(q *AggregateQuery) { q.From = to },
+		"too many buckets":   func(q *AggregateQuery) { q.Bucket = time.Second; q.From = to.AddDate(0, 0, -1) },
+	}
+	for name, mutate := range cases {
+		repo := &recordingDataRepo{}
+		uc := &DeviceUseCase{DeviceDataRepo: repo}
+		q := base
+		mutate(&q)
+		if _, _, err := uc.AggregateDeviceData(q); !errors.Is(err, ErrInvalidAggregation) {
+			t.Errorf("%s: err = %v, want ErrInvalidAggregation", name, err)
+		}
+		if repo.got != nil {
+			t.Errorf("%s: invalid query reached the repository", name)
+		}
+	}
+}
+
+func TestAggregateDeviceDataDefaults(t *testing.T) {
+	repo := &recordingDataRepo{}
+	uc := &DeviceUseCase{DeviceDataRepo: repo}
+	to := time.Date(2026, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	buckets, q, err := uc.AggregateDeviceData(AggregateQuery{
+		DeviceModuleID: "m1", FieldPath: []string{"t"}, Bucket: 7 * 24 * time.Hour, To: to,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets == nil {
+		t.Error("buckets = nil, want an empty slice")
+	}
+	a := repo.got
+	if a.Origin != DefaultBucketOrigin || a.Origin.Weekday() != time.Monday {
+		t.Errorf("origin = %v, want the default Monday", a.Origin)
+	}
+	if len(a.Functions) != 1 || a.Functions[0] != repositories.AggregateAvg {
+		t.Errorf("functions = %v, want [avg]", a.Functions)
+	}
+	if a.To != to.UTC() || a.From != to.UTC().Add(-defaultAggregateRange) || a.To.Location() != time.UTC {
+		t.Errorf("range = %v .. %v", a.From, a.To)
+	}
+	if q.Origin != a.Origin {
+		t.Errorf("returned origin %v differs from the queried one %v", q.Origin, a.Origin)
+	}
+
+	origin := time.Date(2026, 1, 1, 6, 0, 0, 0, time.UTC)
+	if _, _, err := uc.AggregateDeviceData(AggregateQuery{
+		DeviceModuleID: "m1", FieldPath: []string{"t"}, Bucket: 2 * 24 * time.Hour, Origin: origin, To: to,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if repo.got.Origin != origin {
+		t.Errorf("origin = %v, want the explicit %v", repo.got.Origin, origin)
+	}
+}
@@ -0,0 +1,83 @@
+package usecases
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+const (
+	defaultDeviceDataPageSize = 100
+	maxDeviceDataPageSize     = 1000
+)
+
+// DeviceDataQuery is the caller-facing form of a telemetry query.
+type DeviceDataQuery struct {
+	DeviceID       string
+	DeviceModuleID string
+	From           time.Time // zero means unbounded
+	To             time.Time
+	Cursor         string
+	Limit          int
+}
+
+// ListDeviceData returns one page of telemetry, newest device timestamp
+// first. The returned cursor is "" on the last page.
+func (uc *DeviceUseCase) ListDeviceData(q DeviceDataQuery) ([]entities.DeviceData, string, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultDeviceDataPageSize
+	}
+	if limit > maxDeviceDataPageSize {
+		limit = maxDeviceDataPageSize
+	}
+	f := repositories.DeviceDataFilter{
+		DeviceID:       q.DeviceID,
+		DeviceModuleID: q.DeviceModuleID,
+		From:           q.From,
+		To:             q.To,
+		Limit:          limit + 1, // one extra row tells us whether there is a next page
+	}
+	if q.Cursor != "" {
+		recordedAt, id, err := decodeDeviceDataCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		f.AfterRecordedAt, f.AfterID = recordedAt, id
+	}
+
+	data, err := uc.DeviceDataRepo.List(f)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(data) > limit {
+		data = data[:limit]
+		last := data[limit-1]
+		next = encodeDeviceDataCursor(last.RecordedAt, last.ID)
+	}
+	return data, next, nil
+}
+
+func encodeDeviceDataCursor(recordedAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(recordedAt.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeDeviceDataCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(b), "|")
+	if !ok || id == "" {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	recordedAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return recordedAt, id, nil
+}
@@ -0,0 +1,35 @@
+package usecases
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceDataCursorRoundTrip(t *testing.T) {
+	at := time.Date(2026, 5, 6, 7, 8, 9, 123456789, time.FixedZone("X", 2*3600))
+	cursor := encodeDeviceDataCursor(at, "id-1")
+	gotAt, gotID, err := decodeDeviceDataCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotAt.Equal(at) || gotID != "id-1" {
+		t.Errorf("decoded %v, %q; want %v, id-1", gotAt, gotID, at)
+	}
+}
+
+func TestDeviceDataCursorRejectsGarbage(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	for name, cursor := range map[string]string{
+		"not base64":    "%%%",
+		"no separator":  enc([]byte("2026-01-01T00:00:00Z")),
+		"empty id":      enc([]byte("2026-01-01T00:00:00Z|")),
+		"bad timestamp": enc([]byte("yesterday|id-1")),
+		"padded base64": base64.URLEncoding.EncodeToString([]byte("2026-01-01T00:00:00Z|id-1")),
+	} {
+		if _, _, err := decodeDeviceDataCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: err = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package usecases
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	// defaultIdempotencyLease outlasts the slowest request (a command ?wait)
+	defaultIdempotencyLease = 5 * time.Minute
+)
+
+var (
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+	ErrIdempotencyMismatch   = errors.New("idempotency key was already used with a different request")
+)
+
+// IdempotencyUseCase stores request outcomes under client-chosen keys for a retention window.
+type IdempotencyUseCase struct {
+	repo      repositories.IdempotencyKeyRepository
+	retention time.Duration
+	lease     time.Duration
+}
+
+func NewIdempotencyUseCase(repo repositories.IdempotencyKeyRepository, retention time.Duration) *IdempotencyUseCase {
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	return &IdempotencyUseCase{repo: repo, retention: retention, lease: defaultIdempotencyLease}
+}
+
+// SetLease sets how long an uncompleted reservation blocks retries. After
+// that its request is presumed dead (crash, lost connection) and the key can
+// be claimed again.
+func (uc *IdempotencyUseCase) SetLease(lease time.Duration) {
+	if lease > 0 {
+		uc.lease = lease
+	}
+}
+
+// Begin claims key within scope for a request with the given body. When the
+// key is new it returns the reservation and fresh=true; the caller must then
+// Complete or Abandon it. Otherwise it returns the stored outcome to replay.
+// A record made by Claim has no stored response (StatusCode 0).
+func (uc *IdempotencyUseCase) Begin(scope, key string, body []byte) (rec *entities.IdempotencyKey, fresh bool, err error) {
+	sum := sha256.Sum256(body)
+	return uc.reserve(scope, key, hex.EncodeToString(sum[:]))
+}
+
+// reserve claims key for a request fingerprinted by hash. An empty hash
+// stands for a message id that carries no request to compare, so it matches
+// any request in the scope.
+func (uc *IdempotencyUseCase) reserve(scope, key, hash string) (rec *entities.IdempotencyKey, fresh bool, err error) {
+	key = strings.TrimSpace(key)
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return nil, false, errors.New("idempotency key must be 1-255 characters")
+	}
+	now := time.Now()
+	rec = &entities.IdempotencyKey{
+		Scope:       scope,
+		Key:         key,
+		RequestHash: hash,
+		ExpiresAt:   now.UTC().Add(uc.retention).Format(time.RFC3339),
+	}
+	created, err := uc.repo.Reserve(rec, now.Add(-uc.lease))
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		return rec, true, nil
+	}
+	if rec.RequestHash != hash && rec.RequestHash != "" && hash != "" {
+		return nil, false, ErrIdempotencyMismatch
+	}
+	if !rec.Completed {
+		return nil, false, ErrIdempotencyInProgress
+	}
+	return rec, false, nil
+}
+
+// Complete stores the response for a reservation made by Begin.
+func (uc *IdempotencyUseCase) Complete(rec *entities.IdempotencyKey, statusCode int, response []byte) {
+	if err := uc.repo.Complete(rec.ID, statusCode, string(response)); err != nil {
+		log.Printf("failed to store idempotent response for key %s: %v", rec.Key, err)
+	}
+}
+
+// Abandon releases a reservation so the request can be retried.
+func (uc *IdempotencyUseCase) Abandon(rec *entities.IdempotencyKey) {
+	if err := uc.repo.Delete(rec.ID); err != nil {
+		log.Printf("failed to release idempotency key %s: %v", rec.Key, err)
+	}
+}
+
+// Claim reserves a message id that has no response to replay, such as
+// telemetry sent over WebSocket. It returns false for a duplicate. A fresh
+// reservation must be passed to Complete once the message is stored, or to
+// Abandon so the sender can retry it. ErrIdempotencyInProgress means another
+// attempt holds the id and has not stored the message yet; the sender must
+// retry rather than treat the message as delivered, since that attempt may
+// still fail. A claimed id matches any request in the scope, so the same
+// message retried over HTTP (or the other way round) is recognised.
+func (uc *IdempotencyUseCase) Claim(scope, key string) (*entities.IdempotencyKey, bool, error) {
+	rec, fresh, err := uc.reserve(scope, key, "")
+	if err != nil || !fresh {
+		return nil, false, err
+	}
+	return rec, true, nil
+}
+
+// StartCleanup deletes expired keys every interval in the background.
+func (uc *IdempotencyUseCase) StartCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if n, err := uc.repo.DeleteExpired(time.Now()); err != nil {
+				log.Printf("idempotency cleanup failed: %v", err)
+			} else if n > 0 {
+				log.Printf("idempotency cleanup: removed %d expired key(s)", n)
+			}
+		}
+	}()
+}
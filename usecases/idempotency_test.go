@@ -0,0 +1,157 @@
+package usecases
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"iot-server/entities"
+)
+
+// memIdempotencyRepo keeps keys in memory, keyed by scope and key.
+type memIdempotencyRepo struct {
+	keys   map[string]*entities.IdempotencyKey
+	nextID int
+}
+
+func newMemIdempotencyRepo() *memIdempotencyRepo {
+	return &memIdempotencyRepo{keys: map[string]*entities.IdempotencyKey{}}
+}
+
+func (r *memIdempotencyRepo) Reserve(key *entities.IdempotencyKey, staleBefore time.Time) (bool, error) {
+	if existing, ok := r.keys[key.Scope+"|"+key.Key]; ok {
+		if existing.Completed || existing.CreatedAt > staleBefore.UTC().Format(time.RFC3339) {
+			*key = *existing
+			return false, nil
+		}
+	}
+	r.nextID++
+	key.ID = strconv.Itoa(r.nextID)
+	key.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	stored := *key
+	r.keys[key.Scope+"|"+key.Key] = &stored
+	return true, nil
+}
+
+func (r *memIdempotencyRepo) Complete(id string, statusCode int, response string) error {
+	for _, k := range r.keys {
+		if k.ID == id {
+			k.Completed, k.StatusCode, k.Response = true, statusCode, response
+		}
+	}
+	return nil
+}
+
+func (r *memIdempotencyRepo) Delete(id string) error {
+	for name, k := range r.keys {
+		if k.ID == id {
+			delete(r.keys, name)
+		}
+	}
+	return nil
+}
+
+func (r *memIdempotencyRepo) DeleteExpired(time.Time) (int64, error) { return 0, nil }
+
+func TestClaim(t *testing.T) {
+	uc := NewIdempotencyUseCase(newMemIdempotencyRepo(), time.Hour)
+
+	first, fresh, err := uc.Claim("device-data:device:d1", "m1")
+	if err != nil || !fresh || first == nil {
+		t.Fatalf("first Claim = %v, %v, %v; want a fresh reservation", first, fresh, err)
+	}
+
+	// A retry while the first attempt is still storing the point must not be acked
+	if _, fresh, err := uc.Claim("device-data:device:d1", "m1"); !errors.Is(err, ErrIdempotencyInProgress) || fresh {
+		t.Errorf("Claim during first attempt = %v, %v; want ErrIdempotencyInProgress", fresh, err)
+	}
+
+	// Another device may use the same message id
+	if _, fresh, err := uc.Claim("device-data:device:d2", "m1"); err != nil || !fresh {
+		t.Errorf("Claim in another scope = %v, %v; want fresh", fresh, err)
+	}
+
+	uc.Complete(first, 0, nil)
+	if rec, fresh, err := uc.Claim("device-data:device:d1", "m1"); err != nil || fresh || rec != nil {
+		t.Errorf("Claim after Complete = %v, %v, %v; want a duplicate", rec, fresh, err)
+	}
+}
+
+func TestClaimAfterAbandon(t *testing.T) {
+	uc := NewIdempotencyUseCase(newMemIdempotencyRepo(), time.Hour)
+	rec, _, err := uc.Claim("s", "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc.Abandon(rec)
+	if _, fresh, err := uc.Claim("s", "m1"); err != nil || !fresh {
+		t.Errorf("Claim after Abandon = %v, %v; want fresh so the sender can retry", fresh, err)
+	}
+}
+
+func TestBeginMismatch(t *testing.T) {
+	uc := NewIdempotencyUseCase(newMemIdempotencyRepo(), time.Hour)
+	rec, fresh, err := uc.Begin("commands", "k", []byte(`{"a":1}`))
+	if err != nil || !fresh {
+		t.Fatal(fresh, err)
+	}
+	uc.Complete(rec, 201, []byte(`{"ok":true}`))
+
+	if _, _, err := uc.Begin("commands", "k", []byte(`{"a":2}`)); !errors.Is(err, ErrIdempotencyMismatch) {
+		t.Errorf("reused key with another body: err = %v, want ErrIdempotencyMismatch", err)
+	}
+	replay, fresh, err := uc.Begin("commands", "k", []byte(`{"a":1}`))
+	if err != nil || fresh || replay.StatusCode != 201 || replay.Response != `{"ok":true}` {
+		t.Errorf("replay = %+v, %v, %v", replay, fresh, err)
+	}
+	if _, _, err := uc.Begin("commands", "", nil); err == nil {
+		t.Error("empty key accepted")
+	}
+}
+
+func TestBeginReclaimsStaleReservation(t *testing.T) {
+	repo := newMemIdempotencyRepo()
+	uc := NewIdempotencyUseCase(repo, time.Hour)
+	uc.SetLease(time.Minute)
+	if _, fresh, err := uc.Begin("commands", "k", []byte("a")); err != nil || !fresh {
+		t.Fatal(fresh, err)
+	}
+	if _, _, err := uc.Begin("commands", "k", []byte("a")); !errors.Is(err, ErrIdempotencyInProgress) {
+		t.Fatalf("retry within the lease: err = %v, want ErrIdempotencyInProgress", err)
+	}
+
+	// The first request died without completing; once the lease is over the key is free again
+	repo.keys["commands|k"].CreatedAt = time.Now().Add(-2 * time.Minute).UTC().Format(time.RFC3339)
+	if _, fresh, err := uc.Begin("commands", "k", []byte("a")); err != nil || !fresh {
+		t.Errorf("retry after the lease = %v, %v; want a fresh reservation", fresh, err)
+	}
+}
+
+func TestClaimMatchesRequestAcrossTransports(t *testing.T) {
+	uc := NewIdempotencyUseCase(newMemIdempotencyRepo(), time.Hour)
+
+	// Sent over WebSocket first, retried over HTTP
+	claim, _, err := uc.Claim("device-data:device:d1", "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc.Complete(claim, 0, nil)
+	rec, fresh, err := uc.Begin("device-data:device:d1", "m1", []byte("POST /api/v1/device-data\n{}"))
+	if err != nil || fresh || rec.StatusCode != 0 {
+		t.Errorf("HTTP retry of a WS message = %+v, %v, %v; want a replay without stored response", rec, fresh, err)
+	}
+
+	// Sent over HTTP first, retried over WebSocket
+	rec, _, err = uc.Begin("device-data:device:d1", "m2", []byte("POST /api/v1/device-data\n{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := uc.Claim("device-data:device:d1", "m2"); !errors.Is(err, ErrIdempotencyInProgress) {
+		t.Errorf("WS retry while HTTP is storing: err = %v, want ErrIdempotencyInProgress", err)
+	}
+	uc.Complete(rec, 201, []byte(`{}`))
+	if _, fresh, err := uc.Claim("device-data:device:d1", "m2"); err != nil || fresh {
+		t.Errorf("WS retry of an HTTP request = %v, %v; want a duplicate", fresh, err)
+	}
+}
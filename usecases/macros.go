@@ -0,0 +1,398 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+const (
+	maxMacroSteps = 50
+	// maxMacroDelay caps the pause before a single step.
+	maxMacroDelay = time.Hour
+	// defaultMacroStepTimeout is how long a step waits for its ack unless it says otherwise.
+	defaultMacroStepTimeout = 30 * time.Second
+	// macroStaleAfter is the longest a running execution can go without saving progress.
+	macroStaleAfter = maxMacroDelay + MaxCommandWait + time.Minute
+)
+
+// MacroInput is what a client submits to create or replace a macro.
+type MacroInput struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Steps       []entities.MacroStep `json:"steps"`
+}
+
+// MacroUseCase manages macros and runs them step by step.
+type MacroUseCase struct {
+	repo     repositories.MacroRepository
+	commands *CommandsUseCase
+	authz    *Authorizer
+
+	stop     chan struct{} // closed by Stop to interrupt executions and the cleanup loop
+	mu       sync.Mutex
+	stopping bool
+	running  sync.WaitGroup // executions and the cleanup loop
+}
+
+func NewMacroUseCase(repo repositories.MacroRepository, commands *CommandsUseCase, authz *Authorizer) *MacroUseCase {
+	return &MacroUseCase{repo: repo, commands: commands, authz: authz, stop: make(chan struct{})}
+}
+
+// Stop interrupts running executions, which are saved as interrupted, ends
+// the cleanup loop and waits for both. Runs started afterwards are refused.
+func (uc *MacroUseCase) Stop() {
+	uc.mu.Lock()
+	if !uc.stopping {
+		uc.stopping = true
+		close(uc.stop)
+	}
+	uc.mu.Unlock()
+	uc.running.Wait()
+}
+
+// track registers a background goroutine with Stop, unless it was already called.
+func (uc *MacroUseCase) track() bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if uc.stopping {
+		return false
+	}
+	uc.running.Add(1)
+	return true
+}
+
+// Create validates and stores a macro for the caller.
+func (uc *MacroUseCase) Create(p auth.Principal, in MacroInput) (*entities.Macro, error) {
+	steps, err := uc.validate(p, in)
+	if err != nil {
+		return nil, err
+	}
+	m := &entities.Macro{
+		UserID:      p.UserID,
+		Name:        strings.TrimSpace(in.Name),
+		Description: in.Description,
+		Steps:       steps,
+	}
+	if err := uc.repo.Create(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// List returns the caller's macros.
+func (uc *MacroUseCase) List(p auth.Principal) ([]entities.Macro, error) {
+	return uc.repo.GetByUserID(p.UserID)
+}
+
+// RedactMacro returns a copy of m for showing to users, with sensitive step
+// params such as passwords masked.
+func RedactMacro(m entities.Macro) entities.Macro {
+	steps := make(entities.MacroSteps, len(m.Steps))
+	for i, step := range m.Steps {
+		step.Params = redactParamsMap(step.Params)
+		steps[i] = step
+	}
+	m.Steps = steps
+	return m
+}
+
+// Get loads a macro owned by the caller (or any macro, for admins).
+func (uc *MacroUseCase) Get(p auth.Principal, id string) (*entities.Macro, error) {
+	m, err := uc.repo.GetByID(id)
+	if err != nil || (m.UserID != p.UserID && !p.IsAdmin()) {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// Update replaces a macro's name, description and steps.
+func (uc *MacroUseCase) Update(p auth.Principal, id string, in MacroInput) (*entities.Macro, error) {
+	m, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := uc.validate(p, in)
+	if err != nil {
+		return nil, err
+	}
+	m.Name, m.Description, m.Steps = strings.TrimSpace(in.Name), in.Description, steps
+	if err := uc.repo.Update(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Delete removes a macro. Its past executions are kept.
+func (uc *MacroUseCase) Delete(p auth.Principal, id string) error {
+	m, err := uc.Get(p, id)
+	if err != nil {
+		return err
+	}
+	return uc.repo.Delete(m.ID)
+}
+
+// Run starts an execution of the macro in the background and returns it
+// right away. Access to every step's target is checked up front, so a run
+// the caller may not complete doesn't send its first commands.
+func (uc *MacroUseCase) Run(p auth.Principal, id string) (*entities.MacroExecution, error) {
+	m, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	results := make(entities.MacroStepResults, len(m.Steps))
+	for i, step := range m.Steps {
+		if err := uc.authz.CommandTarget(p, step.DeviceID, step.DeviceModuleID); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		results[i] = entities.MacroStepResult{
+			Index:          i,
+			DeviceID:       step.DeviceID,
+			DeviceModuleID: step.DeviceModuleID,
+			Command:        step.Command,
+		}
+	}
+	exec := &entities.MacroExecution{
+		MacroID: m.ID,
+		UserID:  p.UserID,
+		Status:  entities.MacroExecutionRunning,
+		Steps:   results,
+	}
+	if !uc.track() {
+		return nil, ErrShuttingDown
+	}
+	if err := uc.repo.CreateExecution(exec); err != nil {
+		uc.running.Done()
+		return nil, err
+	}
+	run := *exec
+	run.Steps = append(entities.MacroStepResults(nil), results...)
+	go func() {
+		defer uc.running.Done()
+		uc.execute(&run, m.Steps)
+	}()
+	return exec, nil
+}
+
+// Executions returns the most recent runs of a macro.
+func (uc *MacroUseCase) Executions(p auth.Principal, id string, limit int) ([]entities.MacroExecution, error) {
+	m, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	return uc.repo.GetExecutions(m.ID, limit)
+}
+
+// GetExecution loads an execution started by the caller (or any, for admins).
+func (uc *MacroUseCase) GetExecution(p auth.Principal, id string) (*entities.MacroExecution, error) {
+	e, err := uc.repo.GetExecution(id)
+	if err != nil || (e.UserID != p.UserID && !p.IsAdmin()) {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// StartCleanup periodically marks executions abandoned by a stopped server as interrupted.
+func (uc *MacroUseCase) StartCleanup(interval time.Duration) {
+	if !uc.track() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer uc.running.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-uc.stop:
+				return
+			}
+			if n, err := uc.repo.InterruptStale(time.Now().Add(-macroStaleAfter)); err != nil {
+				log.Printf("macros: marking stale executions failed: %v", err)
+			} else if n > 0 {
+				log.Printf("macros: marked %d stale execution(s) interrupted", n)
+			}
+		}
+	}()
+}
+
+// execute runs the steps in order, waiting for each command's ack before the
+// next. A failed step stops the run unless it allows continuing; the rest are
+// then skipped. A server shutdown interrupts the run at once, skipping the
+// remaining steps whatever they allow. Progress is saved after every step.
+func (uc *MacroUseCase) execute(exec *entities.MacroExecution, steps []entities.MacroStep) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-uc.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stopped, interrupted, failures := false, false, 0
+	for i, step := range steps {
+		res := &exec.Steps[i]
+		if stopped || interrupted {
+			res.Status = entities.MacroStepSkipped
+			continue
+		}
+		if !sleepCtx(ctx, time.Duration(step.DelaySeconds)*time.Second) {
+			interrupted = true
+			res.Status = entities.MacroStepSkipped
+			continue
+		}
+		uc.runStep(ctx, step, res)
+		switch res.Status {
+		case entities.MacroStepExecuted:
+		case entities.MacroStepInterrupted:
+			interrupted = true
+		default:
+			failures++
+			stopped = !step.ContinueOnFailure
+		}
+		uc.save(exec)
+	}
+
+	switch {
+	case interrupted:
+		exec.Status = entities.MacroExecutionInterrupted
+	case stopped:
+		exec.Status = entities.MacroExecutionFailed
+	case failures > 0:
+		exec.Status = entities.MacroExecutionPartial
+	default:
+		exec.Status = entities.MacroExecutionSucceeded
+	}
+	exec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	uc.save(exec)
+}
+
+// sleepCtx pauses for d, returning false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runStep enqueues one step's command and waits for the device's answer. A
+// command that isn't acknowledged in time is cancelled, so it can't run late
+// and out of order with the following steps.
+func (uc *MacroUseCase) runStep(ctx context.Context, step entities.MacroStep, res *entities.MacroStepResult) {
+	res.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	defer func() { res.FinishedAt = time.Now().UTC().Format(time.RFC3339) }()
+
+	cmd, err := uc.commands.Dispatch(step.DeviceID, step.DeviceModuleID, step.Command, copyParams(step.Params), EnqueueOptions{})
+	if err != nil {
+		res.Status, res.Error = entities.MacroStepRejected, err.Error()
+		return
+	}
+	res.CommandID = cmd.ID
+
+	timeout := defaultMacroStepTimeout
+	if step.TimeoutSeconds > 0 {
+		timeout = time.Duration(step.TimeoutSeconds) * time.Second
+	}
+	final, err := uc.commands.WaitForResult(ctx, cmd.ID, timeout)
+	if errors.Is(err, ErrShuttingDown) || ctx.Err() != nil {
+		res.Status, res.Error = entities.MacroStepInterrupted, "server shut down before the command was acknowledged"
+		return
+	}
+	if errors.Is(err, ErrWaitTimeout) {
+		if _, cerr := uc.commands.Cancel(cmd.ID); !errors.Is(cerr, ErrNotCancellable) {
+			res.Status, res.Error = entities.MacroStepTimedOut, "no acknowledgement within "+timeout.String()
+			return
+		}
+		// It finished just as we gave up
+		final, err = uc.commands.GetCommand(cmd.ID)
+	}
+	if err != nil {
+		res.Status, res.Error = entities.MacroStepFailed, err.Error()
+		return
+	}
+
+	if final.Response != "" && json.Valid([]byte(final.Response)) {
+		res.Response = json.RawMessage(final.Response)
+	}
+	if final.Status == entities.CommandStatusExecuted {
+		res.Status = entities.MacroStepExecuted
+		return
+	}
+	res.Status, res.Error = entities.MacroStepFailed, "command "+final.Status
+}
+
+func (uc *MacroUseCase) save(exec *entities.MacroExecution) {
+	if err := uc.repo.UpdateExecution(exec); err != nil {
+		log.Printf("macros: saving execution %s failed: %v", exec.ID, err)
+	}
+}
+
+// validate checks every step and returns them with module defaults applied.
+func (uc *MacroUseCase) validate(p auth.Principal, in MacroInput) (entities.MacroSteps, error) {
+	if strings.TrimSpace(in.Name) == "" {
+		return nil, errors.New("name is required")
+	}
+	if len(in.Steps) == 0 || len(in.Steps) > maxMacroSteps {
+		return nil, fmt.Errorf("a macro needs between 1 and %d steps", maxMacroSteps)
+	}
+	steps := make(entities.MacroSteps, 0, len(in.Steps))
+	for i, step := range in.Steps {
+		step.Command = strings.TrimSpace(step.Command)
+		if step.Command == "" {
+			return nil, fmt.Errorf("step %d: command is required", i+1)
+		}
+		if step.DelaySeconds < 0 || time.Duration(step.DelaySeconds)*time.Second > maxMacroDelay {
+			return nil, fmt.Errorf("step %d: delay_seconds must be between 0 and %d", i+1, int(maxMacroDelay/time.Second))
+		}
+		if step.TimeoutSeconds < 0 || time.Duration(step.TimeoutSeconds)*time.Second > MaxCommandWait {
+			return nil, fmt.Errorf("step %d: timeout_seconds must be between 0 and %d", i+1, int(MaxCommandWait/time.Second))
+		}
+		if err := uc.authz.CommandTarget(p, step.DeviceID, step.DeviceModuleID); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if step.DeviceModuleID != "" {
+			params, err := uc.commands.validateForModule(step.DeviceID, step.DeviceModuleID, step.Command, step.Params)
+			if err != nil {
+				return nil, stepValidationError(i, err)
+			}
+			step.Params = params
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// stepValidationError points a command validation error at the step it came from.
+func stepValidationError(i int, err error) error {
+	var verr *CommandValidationError
+	if !errors.As(err, &verr) {
+		return fmt.Errorf("step %d: %w", i+1, err)
+	}
+	out := &CommandValidationError{Errors: make([]FieldError, 0, len(verr.Errors))}
+	for _, fe := range verr.Errors {
+		fe.Field = fmt.Sprintf("steps[%d].%s", i, fe.Field)
+		out.Errors = append(out.Errors, fe)
+	}
+	return out
+}
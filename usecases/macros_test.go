@@ -0,0 +1,56 @@
+package usecases
+
+import (
+	"testing"
+	"time"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// discardMacroRepo accepts every write and stores nothing.
+type discardMacroRepo struct {
+	repositories.MacroRepository
+}
+
+func (discardMacroRepo) UpdateExecution(*entities.MacroExecution) error { return nil }
+
+func TestStopInterruptsMacroDelay(t *testing.T) {
+	uc := NewMacroUseCase(discardMacroRepo{}, nil, nil)
+	exec := &entities.MacroExecution{Status: entities.MacroExecutionRunning, Steps: make(entities.MacroStepResults, 2)}
+	steps := []entities.MacroStep{
+		{Command: "ON", DelaySeconds: 3600, ContinueOnFailure: true},
+		{Command: "OFF", ContinueOnFailure: true},
+	}
+
+	if !uc.track() {
+		t.Fatal("track refused before Stop")
+	}
+	go func() {
+		defer uc.running.Done()
+		uc.execute(exec, steps)
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		uc.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop still waiting on a delayed step")
+	}
+
+	if exec.Status != entities.MacroExecutionInterrupted {
+		t.Errorf("status = %s, want %s", exec.Status, entities.MacroExecutionInterrupted)
+	}
+	for i, res := range exec.Steps {
+		if res.Status != entities.MacroStepSkipped {
+			t.Errorf("step %d status = %s, want skipped", i, res.Status)
+		}
+	}
+	if uc.track() {
+		t.Error("track accepted new work after Stop")
+	}
+}
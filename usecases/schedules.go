@@ -0,0 +1,397 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // schedules name IANA timezones; don't depend on the host's zoneinfo
+
+	"iot-server/auth"
+	"iot-server/cron"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+const (
+	scheduleBatchSize = 100
+	// maxMissedRecords caps the run history written for one long outage.
+	maxMissedRecords = 100
+)
+
+// ScheduleInput is what a client submits to create a schedule. Exactly one of
+// Cron and RunAt must be set.
+type ScheduleInput struct {
+	Name           string                 `json:"name"`
+	DeviceID       string                 `json:"device_id"`
+	DeviceModuleID string                 `json:"device_module_id"`
+	Command        string                 `json:"command"`
+	Params         map[string]interface{} `json:"params"`
+	Cron           string                 `json:"cron"`     // five-field cron expression
+	RunAt          string                 `json:"run_at"`   // one-shot, RFC3339 or local "2006-01-02T15:04:05"
+	Timezone       string                 `json:"timezone"` // IANA name, default UTC
+}
+
+// ScheduleUseCase manages command schedules and runs the scheduler loop.
+type ScheduleUseCase struct {
+	repo     repositories.CommandScheduleRepository
+	commands *CommandsUseCase
+	authz    *Authorizer
+	users    repositories.UserRepository
+	// misfireGrace is how late a run may start; older due times are recorded as missed.
+	misfireGrace time.Duration
+
+	stop     chan struct{} // closed by Stop to end the scheduler loop
+	stopOnce sync.Once
+	loop     sync.WaitGroup
+}
+
+func NewScheduleUseCase(repo repositories.CommandScheduleRepository, commands *CommandsUseCase, authz *Authorizer, users repositories.UserRepository, misfireGrace time.Duration) *ScheduleUseCase {
+	return &ScheduleUseCase{repo: repo, commands: commands, authz: authz, users: users, misfireGrace: misfireGrace, stop: make(chan struct{})}
+}
+
+// Create validates and stores a schedule for the caller.
+func (uc *ScheduleUseCase) Create(p auth.Principal, in ScheduleInput) (*entities.CommandSchedule, error) {
+	in.Command = strings.TrimSpace(in.Command)
+	if in.Command == "" {
+		return nil, errors.New("command is required")
+	}
+	if (in.Cron == "") == (in.RunAt == "") {
+		return nil, errors.New("exactly one of cron and run_at is required")
+	}
+	if in.Timezone == "" {
+		in.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(in.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", in.Timezone)
+	}
+	if err := uc.authz.CommandTarget(p, in.DeviceID, in.DeviceModuleID); err != nil {
+		return nil, err
+	}
+	params := in.Params
+	if in.DeviceModuleID != "" {
+		if params, err = uc.commands.validateForModule(in.DeviceID, in.DeviceModuleID, in.Command, params); err != nil {
+			return nil, err
+		}
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	paramsJSON, _ := json.Marshal(params)
+
+	s := &entities.CommandSchedule{
+		UserID:         p.UserID,
+		Name:           strings.TrimSpace(in.Name),
+		DeviceID:       in.DeviceID,
+		DeviceModuleID: in.DeviceModuleID,
+		Command:        in.Command,
+		Params:         string(paramsJSON),
+		CronExpr:       strings.TrimSpace(in.Cron),
+		Timezone:       loc.String(),
+		Status:         entities.ScheduleStatusActive,
+	}
+	if s.Name == "" {
+		s.Name = s.Command
+	}
+	now := time.Now()
+	if s.CronExpr != "" {
+		sched, err := cron.Parse(s.CronExpr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression: %w", err)
+		}
+		next := sched.Next(now.In(loc))
+		if next.IsZero() {
+			return nil, errors.New("cron expression never matches")
+		}
+		s.NextRunAt = next.UTC().Format(time.RFC3339)
+	} else {
+		runAt, err := parseRunAt(in.RunAt, loc)
+		if err != nil {
+			return nil, err
+		}
+		if !runAt.After(now) {
+			return nil, errors.New("run_at must be in the future")
+		}
+		s.RunAt = runAt.UTC().Format(time.RFC3339)
+		s.NextRunAt = s.RunAt
+	}
+	if err := uc.repo.Create(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the caller's schedules.
+func (uc *ScheduleUseCase) List(p auth.Principal) ([]entities.CommandSchedule, error) {
+	schedules, err := uc.repo.GetByUserID(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// An API key limited to some devices only sees their schedules, as with Get
+	allowed := schedules[:0]
+	for _, s := range schedules {
+		if p.AllowsDevice(s.DeviceID) {
+			allowed = append(allowed, s)
+		}
+	}
+	return allowed, nil
+}
+
+// RedactSchedule returns a copy of s for showing to users, with sensitive
+// params such as passwords masked.
+func RedactSchedule(s entities.CommandSchedule) entities.CommandSchedule {
+	if s.Params != "" {
+		s.Params = string(redactParams(json.RawMessage(s.Params)))
+	}
+	return s
+}
+
+// Get loads a schedule owned by the caller (or any schedule, for admins).
+func (uc *ScheduleUseCase) Get(p auth.Principal, id string) (*entities.CommandSchedule, error) {
+	s, err := uc.repo.GetByID(id)
+	if err != nil || (s.UserID != p.UserID && !p.IsAdmin()) {
+		return nil, ErrNotFound
+	}
+	if !p.AllowsDevice(s.DeviceID) {
+		return nil, ErrForbidden
+	}
+	return s, nil
+}
+
+// Pause stops a schedule from firing until it is resumed.
+func (uc *ScheduleUseCase) Pause(p auth.Principal, id string) (*entities.CommandSchedule, error) {
+	s, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status != entities.ScheduleStatusActive {
+		return nil, fmt.Errorf("schedule is %s", s.Status)
+	}
+	if err := uc.repo.SetState(s.ID, entities.ScheduleStatusPaused, ""); err != nil {
+		return nil, err
+	}
+	s.Status, s.NextRunAt = entities.ScheduleStatusPaused, ""
+	return s, nil
+}
+
+// Resume re-activates a paused schedule from the next due time after now, so
+// runs that fell inside the pause are skipped rather than reported as missed.
+func (uc *ScheduleUseCase) Resume(p auth.Principal, id string) (*entities.CommandSchedule, error) {
+	s, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status != entities.ScheduleStatusPaused {
+		return nil, fmt.Errorf("schedule is %s", s.Status)
+	}
+	next, err := uc.nextAfter(s, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if next.IsZero() {
+		return nil, errors.New("schedule has no future runs")
+	}
+	s.Status, s.NextRunAt = entities.ScheduleStatusActive, next.UTC().Format(time.RFC3339)
+	if err := uc.repo.SetState(s.ID, s.Status, s.NextRunAt); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Delete removes a schedule.
+func (uc *ScheduleUseCase) Delete(p auth.Principal, id string) error {
+	s, err := uc.Get(p, id)
+	if err != nil {
+		return err
+	}
+	return uc.repo.Delete(s.ID)
+}
+
+// Runs returns the most recent runs of a schedule, including missed ones.
+func (uc *ScheduleUseCase) Runs(p auth.Principal, id string, limit int) ([]entities.CommandScheduleRun, error) {
+	s, err := uc.Get(p, id)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	return uc.repo.GetRuns(s.ID, limit)
+}
+
+// Start runs the scheduler every interval in the background until Stop.
+func (uc *ScheduleUseCase) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	uc.loop.Add(1)
+	go func() {
+		defer uc.loop.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				uc.Tick(time.Now())
+			case <-uc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the scheduler loop and waits for a tick in progress to finish.
+func (uc *ScheduleUseCase) Stop() {
+	uc.stopOnce.Do(func() { close(uc.stop) })
+	uc.loop.Wait()
+}
+
+// Tick fires every schedule that is due at now. Each due time is claimed with
+// a conditional update before anything is enqueued, so when several server
+// instances tick at once only one of them runs it.
+func (uc *ScheduleUseCase) Tick(now time.Time) {
+	due, err := uc.repo.GetDue(now, scheduleBatchSize)
+	if err != nil {
+		log.Printf("scheduler: loading due schedules failed: %v", err)
+		return
+	}
+	for i := range due {
+		uc.fire(&due[i], now)
+	}
+}
+
+func (uc *ScheduleUseCase) fire(s *entities.CommandSchedule, now time.Time) {
+	dueAt, err := time.Parse(time.RFC3339, s.NextRunAt)
+	if err != nil {
+		log.Printf("scheduler: schedule %s has invalid next_run_at %q", s.ID, s.NextRunAt)
+		return
+	}
+	cutoff := now.Add(-uc.misfireGrace)
+
+	// Walk forward over due times that are too old to run. After
+	// maxMissedRecords of them, jump straight to the first due time past the
+	// cutoff and estimate how many were skipped from the pace of those walked.
+	var missed []time.Time
+	runAt := dueAt
+	for !runAt.IsZero() && runAt.Before(cutoff) && len(missed) < maxMissedRecords {
+		missed = append(missed, runAt)
+		if runAt, err = uc.nextAfter(s, runAt); err != nil {
+			log.Printf("scheduler: schedule %s: %v", s.ID, err)
+			return
+		}
+	}
+	missedCount := len(missed)
+	if !runAt.IsZero() && runAt.Before(cutoff) {
+		pace := runAt.Sub(dueAt) / time.Duration(len(missed))
+		missedCount += int(cutoff.Sub(runAt)/pace) + 1
+		if runAt, err = uc.nextAfter(s, cutoff.Add(-time.Second)); err != nil {
+			log.Printf("scheduler: schedule %s: %v", s.ID, err)
+			return
+		}
+	}
+	run := !runAt.IsZero() && !runAt.After(now)
+
+	next, status := runAt, entities.ScheduleStatusActive
+	if run {
+		if next, err = uc.nextAfter(s, runAt); err != nil {
+			log.Printf("scheduler: schedule %s: %v", s.ID, err)
+			return
+		}
+	}
+	nextRunAt := ""
+	if next.IsZero() {
+		status = entities.ScheduleStatusCompleted
+	} else {
+		nextRunAt = next.UTC().Format(time.RFC3339)
+	}
+
+	ok, err := uc.repo.Claim(s.ID, s.NextRunAt, nextRunAt, status, missedCount)
+	if err != nil {
+		log.Printf("scheduler: claiming schedule %s failed: %v", s.ID, err)
+		return
+	}
+	if !ok {
+		return // another instance took it, or it was paused meanwhile
+	}
+
+	for _, t := range missed {
+		uc.recordRun(&entities.CommandScheduleRun{
+			ScheduleID:   s.ID,
+			ScheduledFor: t.UTC().Format(time.RFC3339),
+			Status:       entities.ScheduleRunMissed,
+		}, "")
+	}
+	if missedCount > 0 {
+		log.Printf("scheduler: schedule %s missed %d run(s)", s.ID, missedCount)
+	}
+	if run {
+		uc.execute(s, runAt)
+	}
+}
+
+// execute enqueues the schedule's command on behalf of its creator, whose
+// access to the device is checked again in case it was revoked.
+func (uc *ScheduleUseCase) execute(s *entities.CommandSchedule, dueAt time.Time) {
+	run := &entities.CommandScheduleRun{
+		ScheduleID:   s.ID,
+		ScheduledFor: dueAt.UTC().Format(time.RFC3339),
+		Status:       entities.ScheduleRunEnqueued,
+	}
+	var params map[string]interface{}
+	_ = json.Unmarshal([]byte(s.Params), &params)
+
+	user, err := uc.users.GetByID(s.UserID)
+	if err == nil {
+		err = uc.authz.CommandTarget(auth.Principal{UserID: user.ID, Role: user.Role}, s.DeviceID, s.DeviceModuleID)
+	}
+	var cmd *entities.Command
+	if err == nil {
+		cmd, err = uc.commands.Dispatch(s.DeviceID, s.DeviceModuleID, s.Command, params, EnqueueOptions{})
+	}
+	if err != nil {
+		run.Status = entities.ScheduleRunFailed
+		run.Error = err.Error()
+		log.Printf("scheduler: schedule %s failed to enqueue %s: %v", s.ID, s.Command, err)
+		uc.recordRun(run, "")
+		return
+	}
+	run.CommandID = cmd.ID
+	uc.recordRun(run, cmd.ID)
+}
+
+func (uc *ScheduleUseCase) recordRun(run *entities.CommandScheduleRun, commandID string) {
+	if err := uc.repo.RecordRun(run, commandID); err != nil {
+		log.Printf("scheduler: recording run of schedule %s failed: %v", run.ScheduleID, err)
+	}
+}
+
+// nextAfter returns the schedule's first due time after t, or zero when it has none.
+func (uc *ScheduleUseCase) nextAfter(s *entities.CommandSchedule, t time.Time) (time.Time, error) {
+	if s.CronExpr == "" {
+		runAt, err := time.Parse(time.RFC3339, s.RunAt)
+		if err != nil || !runAt.After(t) {
+			return time.Time{}, nil
+		}
+		return runAt, nil
+	}
+	sched, err := cron.Parse(s.CronExpr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return sched.Next(t.In(loc)), nil
+}
+
+func parseRunAt(v string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", v, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("run_at must be an RFC3339 timestamp")
+}
@@ -0,0 +1,35 @@
+package usecases
+
+import (
+	"testing"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// userSchedulesRepo returns a fixed list for any user.
+type userSchedulesRepo struct {
+	repositories.CommandScheduleRepository
+	schedules []entities.CommandSchedule
+}
+
+func (r userSchedulesRepo) GetByUserID(string) ([]entities.CommandSchedule, error) {
+	return append([]entities.CommandSchedule(nil), r.schedules...), nil
+}
+
+func TestListSchedulesHonoursDeviceAllowList(t *testing.T) {
+	uc := NewScheduleUseCase(userSchedulesRepo{schedules: []entities.CommandSchedule{
+		{ID: "s1", DeviceID: "d1"},
+		{ID: "s2", DeviceID: "d2"},
+	}}, nil, nil, nil, 0)
+
+	all, err := uc.List(auth.Principal{UserID: "u1"})
+	if err != nil || len(all) != 2 {
+		t.Fatalf("session List = %v, %v; want both schedules", all, err)
+	}
+	limited, err := uc.List(auth.Principal{UserID: "u1", DeviceIDs: []string{"d2"}})
+	if err != nil || len(limited) != 1 || limited[0].ID != "s2" {
+		t.Errorf("API key List = %v, %v; want only s2", limited, err)
+	}
+}
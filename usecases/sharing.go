@@ -0,0 +1,160 @@
+package usecases
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// SharingUseCase manages device memberships (invite, accept, revoke).
+// Callers are expected to have checked AccessManage on the device for
+// owner-side operations.
+type SharingUseCase struct {
+	members repositories.DeviceMemberRepository
+	users   repositories.UserRepository
+	devices repositories.DeviceRepository
+}
+
+func NewSharingUseCase(members repositories.DeviceMemberRepository, users repositories.UserRepository, devices repositories.DeviceRepository) *SharingUseCase {
+	return &SharingUseCase{members: members, users: users, devices: devices}
+}
+
+func validMemberRole(role string) bool {
+	return role == entities.MemberRoleEditor || role == entities.MemberRoleViewer
+}
+
+// Invite creates a pending membership for the user identified by username or email.
+func (uc *SharingUseCase) Invite(deviceID, inviterID, identifier, role string) (*entities.DeviceMember, error) {
+	if role == "" {
+		role = entities.MemberRoleViewer
+	}
+	if !validMemberRole(role) {
+		return nil, errors.New("role must be editor or viewer")
+	}
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, errors.New("username or email is required")
+	}
+
+	device, err := uc.devices.GetByID(deviceID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	invitee, err := uc.users.GetByUsername(identifier)
+	if err != nil {
+		invitee, err = uc.users.GetByEmail(identifier)
+	}
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if invitee.ID == device.UserID {
+		return nil, errors.New("user already owns this device")
+	}
+	if _, err := uc.members.GetByDeviceAndUser(deviceID, invitee.ID); err == nil {
+		return nil, errors.New("user is already a member or has a pending invitation")
+	}
+
+	member := &entities.DeviceMember{
+		DeviceID:  deviceID,
+		UserID:    invitee.ID,
+		Role:      role,
+		Status:    entities.MemberStatusPending,
+		InvitedBy: inviterID,
+	}
+	if err := uc.members.Create(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// ListMembers returns every membership (pending and accepted) of a device.
+func (uc *SharingUseCase) ListMembers(deviceID string) ([]entities.DeviceMember, error) {
+	if deviceID == "" {
+		return nil, errors.New("device id is required")
+	}
+	return uc.members.GetByDeviceID(deviceID)
+}
+
+// ListInvitations returns the pending invitations addressed to a user.
+func (uc *SharingUseCase) ListInvitations(userID string) ([]entities.DeviceMember, error) {
+	if userID == "" {
+		return nil, errors.New("user_id is required")
+	}
+	return uc.members.GetPendingByUserID(userID)
+}
+
+// Accept turns a pending invitation addressed to userID into an active membership.
+func (uc *SharingUseCase) Accept(invitationID, userID string) (*entities.DeviceMember, error) {
+	member, err := uc.invitationFor(invitationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	member.Status = entities.MemberStatusAccepted
+	member.AcceptedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := uc.members.Update(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// Decline removes a pending invitation addressed to userID.
+func (uc *SharingUseCase) Decline(invitationID, userID string) error {
+	member, err := uc.invitationFor(invitationID, userID)
+	if err != nil {
+		return err
+	}
+	return uc.members.Delete(member.ID)
+}
+
+// UpdateRole changes the role of a member of the device.
+func (uc *SharingUseCase) UpdateRole(deviceID, memberID, role string) (*entities.DeviceMember, error) {
+	if !validMemberRole(role) {
+		return nil, errors.New("role must be editor or viewer")
+	}
+	member, err := uc.memberOf(deviceID, memberID)
+	if err != nil {
+		return nil, err
+	}
+	member.Role = role
+	if err := uc.members.Update(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// Revoke removes a membership or invitation. Owners (and admins) may revoke
+// anyone; members may only remove themselves.
+func (uc *SharingUseCase) Revoke(p auth.Principal, canManage bool, deviceID, memberID string) error {
+	member, err := uc.memberOf(deviceID, memberID)
+	if err != nil {
+		return err
+	}
+	if !canManage && member.UserID != p.UserID {
+		return ErrForbidden
+	}
+	return uc.members.Delete(member.ID)
+}
+
+func (uc *SharingUseCase) memberOf(deviceID, memberID string) (*entities.DeviceMember, error) {
+	member, err := uc.members.GetByID(memberID)
+	if err != nil || member.DeviceID != deviceID {
+		return nil, ErrNotFound
+	}
+	return member, nil
+}
+
+func (uc *SharingUseCase) invitationFor(invitationID, userID string) (*entities.DeviceMember, error) {
+	member, err := uc.members.GetByID(invitationID)
+	if err != nil || member.UserID != userID {
+		return nil, ErrNotFound
+	}
+	if member.Status != entities.MemberStatusPending {
+		return nil, errors.New("invitation already accepted")
+	}
+	return member, nil
+}
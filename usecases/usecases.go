@@ -2,8 +2,10 @@ package usecases
 
 import (
 	"errors"
+	"iot-server/auth"
 	"iot-server/entities"
 	"iot-server/repositories"
+	"strings"
 )
 
 type DeviceUseCase struct {
@@ -27,9 +29,70 @@ func (uc *DeviceUseCase) CreateDevice(device *entities.Device) error {
 	if device.Type == "" {
 		return errors.New("device type is required")
 	}
+	device.Tags = normalizeTags(device.Tags)
 	return uc.DeviceRepo.Create(device)
 }
 
+// RegisterDevice creates a device and returns its secret. The secret is only
+// returned here; the device must present it on WS and device-facing endpoints.
+func (uc *DeviceUseCase) RegisterDevice(device *entities.Device) (string, error) {
+	secret, hash, err := auth.NewDeviceSecret()
+	if err != nil {
+		return "", err
+	}
+	device.SecretHash = hash
+	if err := uc.CreateDevice(device); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// RotateDeviceSecret replaces the secret of an existing device (also used to
+// provision devices registered before secrets existed).
+func (uc *DeviceUseCase) RotateDeviceSecret(id string) (string, error) {
+	device, err := uc.DeviceRepo.GetByID(id)
+	if err != nil {
+		return "", errors.New("device not found")
+	}
+	secret, hash, err := auth.NewDeviceSecret()
+	if err != nil {
+		return "", err
+	}
+	device.SecretHash = hash
+	if err := uc.DeviceRepo.Update(device); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// AuthenticateDevice verifies a device id/secret pair.
+func (uc *DeviceUseCase) AuthenticateDevice(id, secret string) (*entities.Device, error) {
+	if id == "" || secret == "" {
+		return nil, errors.New("device credentials required")
+	}
+	device, err := uc.DeviceRepo.GetByID(id)
+	if err != nil || !auth.VerifyDeviceSecret(device.SecretHash, secret) {
+		return nil, errors.New("invalid device credentials")
+	}
+	return device, nil
+}
+
+// AuthenticateLegacyDevice admits a device without credentials, which is only
+// allowed for devices registered before secrets existed.
+func (uc *DeviceUseCase) AuthenticateLegacyDevice(id string) (*entities.Device, error) {
+	if id == "" {
+		return nil, errors.New("device id required")
+	}
+	device, err := uc.DeviceRepo.GetByID(id)
+	if err != nil {
+		return nil, errors.New("invalid device credentials")
+	}
+	if device.SecretHash != "" {
+		return nil, errors.New("device credentials required")
+	}
+	return device, nil
+}
+
 func (uc *DeviceUseCase) GetDevice(id string) (*entities.Device, error) {
 	if id == "" {
 		return nil, errors.New("device id is required")
@@ -60,10 +123,27 @@ func (uc *DeviceUseCase) UpdateDevice(device *entities.Device) error {
 	if device.Status != "" {
 		existing.Status = device.Status
 	}
+	if device.Tags != nil {
+		existing.Tags = normalizeTags(device.Tags)
+	}
 
 	return uc.DeviceRepo.Update(existing)
 }
 
+// normalizeTags trims, lower-cases and de-duplicates tags.
+func normalizeTags(tags []string) entities.StringList {
+	out := entities.StringList{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 func (uc *DeviceUseCase) DeleteDevice(id string) error {
 	if id == "" {
 		return errors.New("device id is required")
@@ -88,10 +168,28 @@ func (uc *DeviceUseCase) CreateDeviceData(data *entities.DeviceData) error {
 	if err != nil {
 		return errors.New("device not found")
 	}
+	if err := uc.CheckModuleOwner(data.DeviceID, data.DeviceModuleID); err != nil {
+		return err
+	}
 
 	return uc.DeviceDataRepo.Create(data)
 }
 
+// ErrModuleNotOwned rejects telemetry tagged with another device's module.
+var ErrModuleNotOwned = errors.New("device module does not belong to this device")
+
+// CheckModuleOwner verifies that moduleID, when set, is a module of deviceID.
+func (uc *DeviceUseCase) CheckModuleOwner(deviceID, moduleID string) error {
+	if moduleID == "" {
+		return nil
+	}
+	module, err := uc.DeviceModuleRepo.GetByID(moduleID)
+	if err != nil || module.DeviceID != deviceID {
+		return ErrModuleNotOwned
+	}
+	return nil
+}
+
 func (uc *DeviceUseCase) GetDeviceData(id string) (*entities.DeviceData, error) {
 	if id == "" {
 		return nil, errors.New("data id is required")
@@ -99,17 +197,6 @@ func (uc *DeviceUseCase) GetDeviceData(id string) (*entities.DeviceData, error)
 	return uc.DeviceDataRepo.GetByID(id)
 }
 
-func (uc *DeviceUseCase) GetAllDeviceData() ([]entities.DeviceData, error) {
-	return uc.DeviceDataRepo.GetAll()
-}
-
-func (uc *DeviceUseCase) GetDeviceDataByDeviceID(deviceID string) ([]entities.DeviceData, error) {
-	if deviceID == "" {
-		return nil, errors.New("device_id is required")
-	}
-	return uc.DeviceDataRepo.GetByDeviceID(deviceID)
-}
-
 func (uc *DeviceUseCase) GetLatestDeviceDataByModuleID(moduleID string) (*entities.DeviceData, error) {
 	if moduleID == "" {
 		return nil, errors.New("module_id is required")
@@ -150,7 +237,7 @@ func (uc *DeviceUseCase) DeleteDeviceData(id string) error {
 	return uc.DeviceDataRepo.Delete(id)
 }
 
-func (uc *DeviceUseCase) GetDevicesByUserID(userID string) ([]entities.Device, error) {
+func (uc *DeviceUseCase) GetDevicesByUserID(userID string) ([]entities.DeviceWithRole, error) {
 	if userID == "" {
 		return nil, errors.New("user_id is required")
 	}
@@ -171,6 +258,9 @@ func (uc *DeviceUseCase) CreateDeviceModule(module *entities.DeviceModule) error
 	if err != nil {
 		return errors.New("device not found")
 	}
+	if _, _, err := ParseCommandSpecs(module.Commands); err != nil {
+		return err
+	}
 
 	return uc.DeviceModuleRepo.Create(module)
 }
@@ -186,7 +276,7 @@ func (uc *DeviceUseCase) GetAllDeviceModules() ([]entities.DeviceModule, error)
 	return uc.DeviceModuleRepo.GetAll()
 }
 
-func (uc *DeviceUseCase) GetDeviceModulesByUserID(userID string) ([]entities.DeviceModule, error) {
+func (uc *DeviceUseCase) GetDeviceModulesByUserID(userID string) ([]entities.DeviceModuleWithRole, error) {
 	if userID == "" {
 		return nil, errors.New("user_id is required")
 	}
@@ -219,6 +309,12 @@ func (uc *DeviceUseCase) UpdateDeviceModule(module *entities.DeviceModule) error
 	if module.UserID != "" {
 		existing.UserID = module.UserID
 	}
+	if module.Commands != "" {
+		if _, _, err := ParseCommandSpecs(module.Commands); err != nil {
+			return err
+		}
+		existing.Commands = module.Commands
+	}
 
 	return uc.DeviceModuleRepo.Update(existing)
 }
@@ -0,0 +1,42 @@
+package usecases
+
+import (
+	"errors"
+	"testing"
+
+	"iot-server/entities"
+	"iot-server/repositories"
+)
+
+// moduleLookupRepo knows a fixed set of modules by id.
+type moduleLookupRepo struct {
+	repositories.DeviceModuleRepository
+	modules map[string]entities.DeviceModule
+}
+
+func (r moduleLookupRepo) GetByID(id string) (*entities.DeviceModule, error) {
+	m, ok := r.modules[id]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+	return &m, nil
+}
+
+func TestCheckModuleOwner(t *testing.T) {
+	uc := NewDeviceUseCase(nil, nil, moduleLookupRepo{modules: map[string]entities.DeviceModule{
+		"m1": {ID: "m1", DeviceID: "d1"},
+	}})
+
+	if err := uc.CheckModuleOwner("d1", "m1"); err != nil {
+		t.Errorf("own module: err = %v", err)
+	}
+	if err := uc.CheckModuleOwner("d1", ""); err != nil {
+		t.Errorf("no module: err = %v", err)
+	}
+	if err := uc.CheckModuleOwner("d2", "m1"); !errors.Is(err, ErrModuleNotOwned) {
+		t.Errorf("another device's module: err = %v, want ErrModuleNotOwned", err)
+	}
+	if err := uc.CheckModuleOwner("d1", "missing"); !errors.Is(err, ErrModuleNotOwned) {
+		t.Errorf("unknown module: err = %v, want ErrModuleNotOwned", err)
+	}
+}
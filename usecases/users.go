@@ -0,0 +1,249 @@
+package usecases
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"iot-server/auth"
+	"iot-server/entities"
+	"iot-server/repositories"
+	"iot-server/services"
+)
+
+var (
+	ErrUsernameTaken      = errors.New("username already taken")
+	ErrEmailTaken         = errors.New("email already registered")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidUserToken   = errors.New("invalid or expired token")
+)
+
+const (
+	minPasswordLength = 8
+	userTokenBytes    = 32
+)
+
+type UserUseCase struct {
+	users      repositories.UserRepository
+	tokens     repositories.UserTokenRepository
+	mailer     services.Mailer
+	baseURL    string
+	verifyTTL  time.Duration
+	resetTTL   time.Duration
+	pairingTTL time.Duration
+}
+
+func NewUserUseCase(users repositories.UserRepository, tokens repositories.UserTokenRepository, mailer services.Mailer, baseURL string) *UserUseCase {
+	return &UserUseCase{
+		users:      users,
+		tokens:     tokens,
+		mailer:     mailer,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		verifyTTL:  48 * time.Hour,
+		resetTTL:   time.Hour,
+		pairingTTL: 30 * time.Minute,
+	}
+}
+
+// Register creates a new account and sends the email verification link.
+func (uc *UserUseCase) Register(username, email, password string) (*entities.User, error) {
+	username = strings.TrimSpace(username)
+	email = strings.TrimSpace(email)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		return nil, errors.New("a valid email is required")
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+
+	if _, err := uc.users.GetByUsername(username); err == nil {
+		return nil, ErrUsernameTaken
+	}
+	if _, err := uc.users.GetByEmail(email); err == nil {
+		return nil, ErrEmailTaken
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &entities.User{
+		Username:     username,
+		Email:        email,
+		PasswordHash: hash,
+	}
+	if err := uc.users.Create(user); err != nil {
+		return nil, err
+	}
+
+	if err := uc.sendVerification(user); err != nil {
+		// Account exists; the user can ask for a new link later
+		log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// ResendVerification issues a new verification link for an unverified account.
+func (uc *UserUseCase) ResendVerification(userID string) error {
+	user, err := uc.users.GetByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	if user.EmailVerified {
+		return errors.New("email already verified")
+	}
+	return uc.sendVerification(user)
+}
+
+// VerifyEmail consumes a verification token and marks the email as verified.
+func (uc *UserUseCase) VerifyEmail(token string) error {
+	t, err := uc.consumeToken(entities.TokenPurposeVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+	return uc.users.MarkEmailVerified(t.UserID)
+}
+
+// ChangePassword updates the password of an authenticated user.
+func (uc *UserUseCase) ChangePassword(userID, currentPassword, newPassword string) error {
+	user, err := uc.users.GetByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	if ok, _ := auth.VerifyPassword(user.PasswordHash, currentPassword); !ok {
+		return ErrInvalidCredentials
+	}
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+	return uc.setPassword(user.ID, newPassword)
+}
+
+// RequestPasswordReset emails a reset link if the address belongs to an account.
+// Unknown addresses are ignored so callers can't probe for accounts.
+func (uc *UserUseCase) RequestPasswordReset(email string) error {
+	user, err := uc.users.GetByEmail(strings.TrimSpace(email))
+	if err != nil {
+		return nil
+	}
+
+	// Only the most recent reset link stays valid
+	_ = uc.tokens.DeleteByUser(user.ID, entities.TokenPurposeResetPassword)
+
+	token, err := uc.issueToken(user.ID, entities.TokenPurposeResetPassword, uc.resetTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nUse the link below to reset your password. It expires in %s.\n\n%s/reset-password?token=%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+		user.Username, uc.resetTTL, uc.baseURL, token)
+	return uc.mailer.Send(user.Email, "Reset your password", body)
+}
+
+// ResetPassword consumes a reset token and sets a new password.
+func (uc *UserUseCase) ResetPassword(token, newPassword string) error {
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+	t, err := uc.consumeToken(entities.TokenPurposeResetPassword, token)
+	if err != nil {
+		return err
+	}
+	return uc.setPassword(t.UserID, newPassword)
+}
+
+func (uc *UserUseCase) setPassword(userID, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return uc.users.UpdatePassword(userID, hash)
+}
+
+func (uc *UserUseCase) sendVerification(user *entities.User) error {
+	_ = uc.tokens.DeleteByUser(user.ID, entities.TokenPurposeVerifyEmail)
+
+	token, err := uc.issueToken(user.ID, entities.TokenPurposeVerifyEmail, uc.verifyTTL)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s/api/v1/auth/verify-email?token=%s\n\nThe link expires in %s.\n",
+		user.Username, uc.baseURL, token, uc.verifyTTL)
+	return uc.mailer.Send(user.Email, "Confirm your email", body)
+}
+
+// IssuePairingToken returns a single-use token that registers one device into
+// userID's account, and when it expires. The token is handed to the device
+// during provisioning in place of a user id.
+func (uc *UserUseCase) IssuePairingToken(userID string) (string, time.Time, error) {
+	expiresAt := time.Now().UTC().Add(uc.pairingTTL)
+	token, err := uc.issueToken(userID, entities.TokenPurposeDevicePairing, uc.pairingTTL)
+	return token, expiresAt, err
+}
+
+// ConsumePairingToken redeems a pairing token and returns the user the new
+// device belongs to.
+func (uc *UserUseCase) ConsumePairingToken(token string) (string, error) {
+	t, err := uc.consumeToken(entities.TokenPurposeDevicePairing, token)
+	if err != nil {
+		return "", err
+	}
+	return t.UserID, nil
+}
+
+// issueToken stores the hash of a new random token and returns the plain token.
+func (uc *UserUseCase) issueToken(userID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, userTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	t := &entities.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashUserToken(token),
+		ExpiresAt: time.Now().UTC().Add(ttl).Format(time.RFC3339),
+	}
+	if err := uc.tokens.Create(t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (uc *UserUseCase) consumeToken(purpose, token string) (*entities.UserToken, error) {
+	if token == "" {
+		return nil, ErrInvalidUserToken
+	}
+	t, err := uc.tokens.GetByHash(purpose, hashUserToken(token))
+	if err != nil || t.UsedAt != "" {
+		return nil, ErrInvalidUserToken
+	}
+	exp, err := time.Parse(time.RFC3339, t.ExpiresAt)
+	if err != nil || !time.Now().Before(exp) {
+		return nil, ErrInvalidUserToken
+	}
+	if err := uc.tokens.MarkUsed(t.ID); err != nil {
+		return nil, ErrInvalidUserToken
+	}
+	return t, nil
+}
+
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
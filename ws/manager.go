@@ -3,57 +3,76 @@ package ws
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Client is a websocket connection bound to a verified device identity.
+type Client struct {
+	DeviceID    string
+	Conn        *websocket.Conn
+	ConnectedAt time.Time
+
+	writeMu sync.Mutex // gorilla connections allow a single concurrent writer
+}
+
+// Write sends a text message on the client's connection.
+func (c *Client) Write(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(websocket.TextMessage, payload)
+}
+
 // Manager keeps track of active device websocket connections.
 type Manager struct {
-	mu          sync.RWMutex
-	connections map[string]*websocket.Conn // deviceID -> conn
+	mu      sync.RWMutex
+	clients map[string]*Client // deviceID -> client
 }
 
 func NewManager() *Manager {
-	return &Manager{connections: make(map[string]*websocket.Conn)}
+	return &Manager{clients: make(map[string]*Client)}
 }
 
-// Register registers a device connection, replacing any existing one.
-func (m *Manager) Register(deviceID string, conn *websocket.Conn) {
+// Register binds a connection to an already authenticated device, replacing any existing one.
+func (m *Manager) Register(deviceID string, conn *websocket.Conn) *Client {
+	client := &Client{DeviceID: deviceID, Conn: conn, ConnectedAt: time.Now()}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if old, ok := m.connections[deviceID]; ok && old != conn {
+	if old, ok := m.clients[deviceID]; ok && old.Conn != conn {
 		// close old connection to avoid leaks
-		_ = old.Close()
+		_ = old.Conn.Close()
 	}
-	m.connections[deviceID] = conn
+	m.clients[deviceID] = client
+	return client
 }
 
-// Unregister removes a device connection.
-func (m *Manager) Unregister(deviceID string) {
+// Unregister removes a client if it is still the device's current connection.
+func (m *Manager) Unregister(client *Client) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if conn, ok := m.connections[deviceID]; ok {
-		_ = conn.Close()
-		delete(m.connections, deviceID)
+	if cur, ok := m.clients[client.DeviceID]; ok && cur == client {
+		delete(m.clients, client.DeviceID)
 	}
+	_ = client.Conn.Close()
 }
 
 // SendToDevice sends a text message to a device if connected.
 func (m *Manager) SendToDevice(deviceID string, payload []byte) error {
 	m.mu.RLock()
-	conn, ok := m.connections[deviceID]
+	client, ok := m.clients[deviceID]
 	m.mu.RUnlock()
-	if !ok || conn == nil {
+	if !ok || client == nil {
 		return errors.New("device not connected")
 	}
-	return conn.WriteMessage(websocket.TextMessage, payload)
+	return client.Write(payload)
 }
 
 // IsConnected returns whether a device is currently connected.
 func (m *Manager) IsConnected(deviceID string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	_, ok := m.connections[deviceID]
+	_, ok := m.clients[deviceID]
 	return ok
 }
 
@@ -61,9 +80,25 @@ func (m *Manager) IsConnected(deviceID string) bool {
 func (m *Manager) List() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	ids := make([]string, 0, len(m.connections))
-	for id := range m.connections {
+	ids := make([]string, 0, len(m.clients))
+	for id := range m.clients {
 		ids = append(ids, id)
 	}
 	return ids
 }
+
+// CloseAll sends every connected device a close frame with the given code
+// and reason, then drops its connection. Used on server shutdown.
+func (m *Manager) CloseAll(code int, reason string) {
+	m.mu.Lock()
+	clients := m.clients
+	m.clients = make(map[string]*Client)
+	m.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	deadline := time.Now().Add(time.Second)
+	for _, c := range clients {
+		_ = c.Conn.WriteControl(websocket.CloseMessage, msg, deadline)
+		_ = c.Conn.Close()
+	}
+}